@@ -1,151 +1,632 @@
+// generate_tests generates the Rust tests of rlox from the .lox files under test/, with the
+// loxgen package. The input and output can be set with the -input and -output flags.
+// Each value can also be overridden through the environment, which is convenient
+// where passing arguments is awkward (e.g. Docker entrypoints):
+//
+//	RLOX_TEST_INPUT    directory, or .zip/.tar/.tar.gz archive, containing the .lox test files
+//	RLOX_TEST_OUTPUT   path of the generated Rust file
+//	RLOX_TEST_MODULES  comma separated glob patterns of the test directories to generate (-include)
+//	RLOX_TEST_EXCLUDE  comma separated glob patterns of test directories to leave out (-exclude)
+//
+// Subdirectories of a test directory are generated as nested modules, e.g. test/class/super/
+// becomes class_tests::super_tests.
+//
+// A test directory can carry a suite.toml setting its module name, tags, default timeout,
+// dialect and whether it is skipped, or generated without -include selecting it (see loxgen.SUITE_FILE).
+//
+// The run subcommand checks the tests against the rlox executable (-rlox) directly,
+// without generating Rust: `go run generate_tests.go run`.
+//
+// The new subcommand creates a test file to fill in, e.g. `go run generate_tests.go new
+// string/unicode_escape` creates test/string/unicode_escape.lox. With -generate, the tests
+// are generated afterwards.
+//
+// The coverage subcommand compares the test files with the upstream craftinginterpreters
+// suite, by directory: how many of them are generated, missing or left out, and why.
+//
+// The corpus subcommand copies the programs of the tests, without their comments, to a
+// cargo-fuzz corpus directory (-corpus-directory), to seed fuzzing the scanner and compiler.
+//
+// The mutate subcommand runs the tests, like run, on mutants of their sources: operators
+// swapped, literals changed, statements deleted. It lists the mutants a test still passes
+// on, which point at expectations too weak to notice the change.
+//
+// The fix subcommand normalizes the expectation comments of the test files in place: the
+// spelling of their markers, the spacing before them and trailing whitespace.
+//
+// With -record, the selected test files that expect nothing are run with the rlox executable
+// instead, and get `// expect: ` and error comments written from what it printed, to be
+// checked by hand: `go run generate_tests.go -record -include string`.
+//
+// The compare subcommand runs the tests with two rlox executables, -a and -b, e.g. the
+// builds before and after a refactoring, and lists the files they differ on: in what they
+// print on stdout or stderr, or in their exit status. The expectations play no part.
+//
+// The bench subcommand times the programs of -bench-directory with the rlox executable,
+// -bench-runs times each, and compares their median with those of a baseline file
+// (-bench-baseline). It fails if one of them got slower by more than -bench-threshold percent.
+//
+// The affected subcommand prints the cargo test filters of the test modules that the files
+// changed since -since plausibly affect, going by a mapping of the crate's sources to test
+// directories (-affected-map): `cargo test -- $(go run generate_tests.go affected)`.
+//
+// Options can also be set in a loxgen.toml or loxgen.yaml config file (see loxgen.ReadConfigFile).
+//
+// Flags take precedence over environment variables, which take precedence over the config file,
+// which takes precedence over the defaults of loxgen.DefaultOptions.
 package main
 
 import (
-	"bufio"
+	"errors"
+	"flag"
 	"fmt"
 	"io/fs"
-	"io/ioutil"
 	"log"
 	"os"
-	"regexp"
+	"os/exec"
+	"path/filepath"
+	"runtime/pprof"
+	"sort"
 	"strings"
+	"time"
+
+	"github.com/fsnotify/fsnotify"
+	"github.com/olapokon/rlox/loxgen"
 )
 
-const OUTPUT_FILE = "./tests.rs"
-const INPUT_DIRECTORY = "./test/"
+// options are set from the command line flags, the environment and the config file.
+var options = loxgen.DefaultOptions()
 
-func writeLine(outputFile *os.File, text string, indentationLevel int) {
-	outputFile.WriteString(fmt.Sprintf("%s%s\n", strings.Repeat("    ", indentationLevel), text))
-}
+// Flags of the command itself rather than options of the generator.
+var configPath string
+var generateNew bool
+var watchMode bool
+var watchInterval time.Duration
+var cpuProfile string
 
-func writeTest(outputFile *os.File, fileInfo *fs.FileInfo, moduleName string, indentationLevel int) {
-	if !strings.HasSuffix((*fileInfo).Name(), ".lox") {
-		log.Fatal("Invalid file input. Only .lox files should be present in the input directory.")
+// envOrDefault returns the value of the environment variable key,
+// or def if it is unset or empty.
+func envOrDefault(key string, def string) string {
+	if value, ok := os.LookupEnv(key); ok && len(value) > 0 {
+		return value
 	}
-	name := strings.Replace((*fileInfo).Name(), ".lox", "", 1)
+	return def
+}
 
-	outputFile.WriteString("\n")
-	writeLine(outputFile, "#[test]", indentationLevel)
-	writeLine(outputFile, fmt.Sprintf("fn %s_test() -> VMResult {", name), indentationLevel)
+// isFlagSet reports whether the flag was set, on the command line or from the environment.
+func isFlagSet(name string) bool {
+	set := false
+	flag.Visit(func(f *flag.Flag) {
+		if f.Name == name {
+			set = true
+		}
+	})
+	return set
+}
 
-	// Write test body.
-	var path string
-	if len(moduleName) > 0 {
-		path = INPUT_DIRECTORY + moduleName + "/" + (*fileInfo).Name()
-	} else {
-		path = INPUT_DIRECTORY + (*fileInfo).Name()
+// Config files looked for in the current directory when -config is not set.
+var DEFAULT_CONFIG_FILES = []string{"loxgen.toml", "loxgen.yaml", "loxgen.yml"}
+
+// readConfig reads the file given with -config, or the first default config file found.
+// It returns an empty configuration if there is none.
+func readConfig() (map[string][]string, string, error) {
+	if len(configPath) > 0 {
+		config, err := loxgen.ReadConfigFile(configPath)
+		return config, configPath, err
+	}
+	for _, path := range DEFAULT_CONFIG_FILES {
+		if _, err := os.Stat(path); err == nil {
+			config, err := loxgen.ReadConfigFile(path)
+			return config, path, err
+		}
 	}
-	f, err := os.Open(path)
+	return map[string][]string{}, "", nil
+}
+
+// Options that can also be set through the environment, with their variables.
+var environmentOptions = []struct {
+	flag     string
+	variable string
+}{
+	{"input", "RLOX_TEST_INPUT"},
+	{"output", "RLOX_TEST_OUTPUT"},
+	{"include", "RLOX_TEST_MODULES"},
+	{"exclude", "RLOX_TEST_EXCLUDE"},
+}
+
+// loadConfig fills in the options not given on the command line,
+// from the environment or else from the config file.
+func loadConfig() {
+	config, path, err := readConfig()
 	if err != nil {
 		log.Fatal(err)
 	}
-	defer f.Close()
-	sc := bufio.NewScanner(f)
+	if modules, ok := config["modules"]; ok {
+		config["include"] = modules
+		delete(config, "modules")
+	}
 
-	writeLine(outputFile, "let source = r#\"", indentationLevel+1)
-	assertError := ""
-	assertValues := make([]string, 0)
-	for sc.Scan() {
-		line := sc.Text()
-		writeLine(outputFile, line, 0)
+	for _, option := range environmentOptions {
+		if value := envOrDefault(option.variable, ""); len(value) > 0 && !isFlagSet(option.flag) {
+			if err := flag.Set(option.flag, value); err != nil {
+				log.Fatalf("%s: %v", option.variable, err)
+			}
+		}
+	}
 
-		// There may be edge cases, error comment not always consistent?
-		matchError, _ := regexp.MatchString("(?i)error", line)
-		// There is at least one test file where there are two error comments,
-		// the second error is for Java (unexpected_character.lox)
-		if matchError && len(assertError) == 0 {
-			assertError = strings.SplitAfter(line, ": ")[1]
+	keys := make([]string, 0, len(config))
+	for key := range config {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	for _, key := range keys {
+		if flag.Lookup(key) == nil || key == "config" {
+			log.Fatalf("%s: unknown option %q", path, key)
+		}
+		if isFlagSet(key) {
+			continue
 		}
-		matchExpect, _ := regexp.MatchString("// expect: ", line)
-		if matchExpect {
-			assertValues = append(assertValues, strings.SplitAfter(line, ": ")[1])
+		if err := flag.Set(key, strings.Join(config[key], ",")); err != nil {
+			log.Fatalf("%s: invalid value for %q: %v", path, key, err)
 		}
 	}
-	writeLine(outputFile, "\"#", 0)
-	writeLine(outputFile, ".to_string();", indentationLevel+1)
-	writeLine(outputFile, "let mut vm = VM::new();", indentationLevel+1)
+}
 
-	if len(assertValues) > 0 {
-		// This test expects certain values to be printed.
-		writeLine(outputFile, "vm.interpret(source)?;", indentationLevel+1)
+// OPERATIONAL_FLAGS change how the generator runs rather than what it generates. They are left
+// out of the command in the header, so that -check regenerates the same header.
+var OPERATIONAL_FLAGS = []string{"cache", "check", "config", "cpuprofile", "dry-run", "fail-fast", "profile", "summary-json", "sync-timeout", "verify", "watch", "watch-interval"}
 
-		// Write one assertion for each expected value.
-		for i := len(assertValues) - 1; i >= 0; i-- {
-			writeLine(outputFile, "assert_eq!(", indentationLevel+1)
-			writeLine(outputFile, fmt.Sprintf("\"%s\",", assertValues[i]), indentationLevel+2)
-			writeLine(outputFile, "vm.printed_values.pop().unwrap().to_string()", indentationLevel+2)
-			writeLine(outputFile, ");", indentationLevel+1)
+// watch generates the output, then generates it again whenever a file under the input is created,
+// modified or deleted, as fsnotify reports it. Each generation runs in a child process with the same
+// arguments, so a failing one only reports its errors and the next change is picked up all the same.
+func watch(generator *loxgen.Generator) {
+	executable, err := os.Executable()
+	if err != nil {
+		log.Fatal(err)
+	}
+	// The last occurrence of a flag wins.
+	args := append(os.Args[1:len(os.Args):len(os.Args)], "-watch=false")
+	generate := func() {
+		command := exec.Command(executable, args...)
+		command.Stdout = os.Stdout
+		command.Stderr = os.Stderr
+		if err := command.Run(); err == nil {
+			log.Printf("Generated %s, watching %s for changes.", generator.OutputFilePath, generator.InputDirectory)
 		}
+	}
 
-	} else if len(assertError) > 0 {
-		// This test expects a specific error.
-		writeLine(outputFile, "#[allow(unused_must_use)]", indentationLevel+1)
-		writeLine(outputFile, "{ vm.interpret(source); }", indentationLevel+1)
-		writeLine(outputFile, "assert_eq!(", indentationLevel+1)
-		writeLine(outputFile, fmt.Sprintf("\"%s\",", assertError), indentationLevel+2)
-		writeLine(outputFile, "vm.latest_error_message", indentationLevel+2)
-		writeLine(outputFile, ");", indentationLevel+1)
+	watcher, err := fsnotify.NewWatcher()
+	if err != nil {
+		log.Fatal(err)
+	}
+	defer watcher.Close()
+	// An archive is watched through its directory, as tools writing it often replace the file.
+	archive := ""
+	if info, err := os.Stat(generator.InputDirectory); err == nil && !info.IsDir() {
+		archive = filepath.Clean(generator.InputDirectory)
+		err = watcher.Add(filepath.Dir(archive))
+	} else {
+		err = watchDirectories(watcher, generator.InputDirectory)
+	}
+	if err != nil {
+		log.Fatal(err)
 	}
 
-	writeLine(outputFile, "Ok(())", indentationLevel+1)
-	writeLine(outputFile, "}", indentationLevel)
+	generate()
+	// Saving a file takes several events, the generation waits for them to stop for -watch-interval.
+	settled := time.NewTimer(watchInterval)
+	settled.Stop()
+	for {
+		select {
+		case event, ok := <-watcher.Events:
+			if !ok {
+				return
+			}
+			if event.Op == fsnotify.Chmod || len(archive) > 0 && filepath.Clean(event.Name) != archive {
+				continue
+			}
+			// fsnotify does not watch subdirectories by itself, new ones are added as they appear.
+			if event.Has(fsnotify.Create) && len(archive) == 0 {
+				if info, err := os.Stat(event.Name); err == nil && info.IsDir() {
+					if err := watchDirectories(watcher, event.Name); err != nil {
+						log.Print(err)
+					}
+				}
+			}
+			settled.Reset(watchInterval)
+		case err, ok := <-watcher.Errors:
+			if !ok {
+				return
+			}
+			log.Print(err)
+		case <-settled.C:
+			generate()
+		}
+	}
 }
 
-func writeModule(outputFile *os.File, moduleName string, modFilesInfo []fs.FileInfo, indentationLevel int) {
-	outputFile.WriteString("\n")
-	writeLine(outputFile, fmt.Sprintf("mod %s_tests {", moduleName), indentationLevel)
-	writeLine(outputFile, "use super::*;", indentationLevel+1)
+// watchDirectories adds a directory and every directory under it to the watcher.
+func watchDirectories(watcher *fsnotify.Watcher, root string) error {
+	return filepath.WalkDir(root, func(path string, entry fs.DirEntry, err error) error {
+		if err != nil || !entry.IsDir() {
+			return err
+		}
+		return watcher.Add(path)
+	})
+}
 
-	for _, tf := range modFilesInfo {
-		writeTest(outputFile, &tf, moduleName, indentationLevel+1)
+// init defines the flags of the options, defaulting to loxgen.DefaultOptions.
+func init() {
+	flag.StringVar(&options.InputDirectory, "input", options.InputDirectory,
+		"directory, or .zip/.tar/.tar.gz archive, containing the .lox test files")
+	flag.StringVar(&options.OutputFilePath, "output", options.OutputFilePath,
+		"path of the generated Rust file (default: "+loxgen.DEFAULT_OUTPUT_FILE+", or "+loxgen.DEFAULT_INTEGRATION_OUTPUT_FILE+" with -integration)")
+	flag.StringVar(&options.SplitOutput, "split-output", options.SplitOutput,
+		"write each top level module to a file of its own in this directory instead of -output,\n"+
+			"e.g. tests/string.rs, along with a tests/mod.rs declaring them, to include with `#[cfg(test)] mod tests;`.\n"+
+			"The generated files of directories that are gone are removed.")
+	flag.StringVar(&options.IncludePatterns, "include", options.IncludePatterns,
+		"comma separated glob patterns of the test directories to generate\n"+
+			"(default: "+loxgen.DEFAULT_INCLUDE+", and the directories whose suite.toml sets skip = false)")
+	flag.StringVar(&options.ExcludePatterns, "exclude", options.ExcludePatterns,
+		"comma separated glob patterns of test directories to leave out, e.g. benchmark,regression;\n"+
+			"nested directories are matched by their path, e.g. class/inheritance")
+	flag.BoolVar(&options.IgnoreExcluded, "ignore-excluded", options.IgnoreExcluded,
+		"generate the directories -include and -exclude leave out as well, with their tests marked #[ignore],\n"+
+			"so `cargo test -- --ignored` shows which parts of the suite are not passing yet")
+	flag.BoolVar(&options.AllowEmptySource, "allow-empty-source", options.AllowEmptySource,
+		"emit zero-byte .lox files as tests that only check the empty program runs")
+	flag.StringVar(&options.ReferenceDirectory, "reference-dir", options.ReferenceDirectory,
+		"directory of <module>/<file>.lox.ref files holding jlox output to compare against")
+	flag.BoolVar(&options.PerFileModule, "per-file-module", options.PerFileModule,
+		"wrap each test in a module named after its file, containing a single `run` test")
+	flag.StringVar(&options.AssertMessage, "assert-message", options.AssertMessage,
+		"failure message template for generated assertions, may use {file}, {line} and {index}")
+	flag.BoolVar(&options.ShouldPanic, "should-panic", options.ShouldPanic,
+		"generate the tests expecting a runtime error as #[should_panic(expected = \"<message>\")] tests,\n"+
+			"for a VM that still panics instead of reporting the error, like the files with `// expect panic: ` comments")
+	flag.BoolVar(&options.ExplodeExpectations, "explode-expectations", options.ExplodeExpectations,
+		"write one test per `// expect:` line (each one runs the whole program again)")
+	flag.BoolVar(&options.Lossy, "lossy", options.Lossy,
+		"replace invalid UTF-8 in test files with the replacement character instead of failing")
+	flag.BoolVar(&options.SummaryTest, "summary-test", options.SummaryTest,
+		"also write a conformance_summary test that runs every source and reports all failures at once")
+	flag.BoolVar(&options.SnapshotOutput, "snapshot-output", options.SnapshotOutput,
+		"assert against a copy of -printed-values taken after the program ran, instead of -output-accessor")
+	flag.BoolVar(&options.IncludeSource, "include-source", options.IncludeSource,
+		"read the sources with include_str! from the input directory instead of inlining them,\n"+
+			"so editing a .lox file needs no regeneration (not for -doctest nor archives)")
+	flag.BoolVar(&options.WholeOutput, "whole-output", options.WholeOutput,
+		"assert the expected values against everything printed with a single assert_eq! on a Vec,\n"+
+			"which also fails on extra output and shows the whole expected and actual output on failure")
+	flag.BoolVar(&options.Insta, "insta", options.Insta,
+		"check the printed values with insta::assert_snapshot! and write the expected output as .snap files,\n"+
+			"to be reviewed with `cargo insta review` (needs insta in the dev-dependencies)")
+	flag.StringVar(&options.InstaSnapshotDirectory, "insta-snapshots", options.InstaSnapshotDirectory,
+		"directory the -insta snapshots are written to, next to the file including the generated tests")
+	flag.StringVar(&options.InstaCrate, "insta-crate", options.InstaCrate,
+		"name of the crate the generated tests are compiled in, which starts the name of the -insta snapshots")
+	flag.StringVar(&options.PrintedValues, "printed-values", options.PrintedValues,
+		"expression for the collection of printed values, copied with -snapshot-output")
+	flag.StringVar(&options.OutputAccessor, "output-accessor", options.OutputAccessor,
+		"expression returning the {i}-th printed value, used by the generated assertions with -snapshot-output=false")
+	flag.Float64Var(&options.FloatEpsilon, "float-epsilon", options.FloatEpsilon,
+		"when above 0, compare the expected values that are fractional numbers, e.g. `// expect: 0.3`, with the printed\n"+
+			"number within this tolerance instead of as text, in the generated assertions and the run subcommand")
+	flag.StringVar(&options.VmConstructor, "vm-constructor", options.VmConstructor,
+		"expression creating the VM each generated test runs its source on, bound to vm")
+	flag.StringVar(&options.InterpretCall, "interpret-call", options.InterpretCall,
+		"expression interpreting the source with the VM, {source} standing for the String of the source;\n"+
+			"it has to return a Result whose error is -error-type")
+	flag.StringVar(&options.ErrorMessageAccessor, "error-message-accessor", options.ErrorMessageAccessor,
+		"expression for the message of the latest error the VM reported")
+	flag.StringVar(&options.ResultType, "result-type", options.ResultType,
+		"type returned by the generated test functions, a Result the VM's errors convert into with ?")
+	flag.StringVar(&options.ErrorType, "error-type", options.ErrorType,
+		"enum of the VM's errors, with CompileError and RuntimeError variants")
+	flag.BoolVar(&options.FailFast, "fail-fast", options.FailFast,
+		"stop at the first invalid test file instead of reporting all of them")
+	flag.BoolVar(&options.Doctest, "doctest", options.Doctest,
+		"write the tests as rustdoc examples, run by `cargo test --doc` on a library crate")
+	flag.BoolVar(&options.Integration, "integration", options.Integration,
+		"write a Cargo integration test, by default "+loxgen.DEFAULT_INTEGRATION_OUTPUT_FILE+", using the public API of the library\n"+
+			"instead of a #[cfg(test)] module of the crate; the crate needs a library target exporting the VM")
+	flag.StringVar(&options.IntegrationImport, "integration-import", options.IntegrationImport,
+		"use path bringing VM, VMError and VMResult into scope in the -integration test")
+	flag.StringVar(&options.DoctestImport, "doctest-import", options.DoctestImport,
+		"use path bringing VM and VMError into scope in the generated doctests")
+	flag.StringVar(&options.RunPattern, "run", options.RunPattern,
+		"only generate or run the test files whose path in the input, without .lox, matches this regular expression,\n"+
+			"e.g. 'string/.*escape'")
+	flag.StringVar(&options.FeatureGatesList, "feature-gates", options.FeatureGatesList,
+		"comma separated directory=feature pairs gating the modules of the matching test directories behind Cargo\n"+
+			"features, e.g. closure=closures,class*=classes, so that only the suites of implemented features are compiled")
+	flag.StringVar(&options.Shard, "shard", options.Shard,
+		"only generate or run shard i of n of the test files, written i/n, e.g. 2/4 on the second of four CI machines;\n"+
+			"files are assigned to shards by a hash of their path, and stay in theirs as the suite grows")
+	flag.StringVar(&options.FilterExpectPattern, "filter-expect", options.FilterExpectPattern,
+		"only write tests with an expected value or error matching this regular expression")
+	flag.StringVar(&options.StdinSetup, "stdin-setup", options.StdinSetup,
+		"statement giving `vm` the lines of the `// input: ` comments as its standard input, {input} standing for them\n"+
+			"as a string, e.g. vm.set_input({input}); the tests of files with `// input: ` comments need it")
+	flag.DurationVar(&options.DefaultTimeout, "timeout", options.DefaultTimeout,
+		"time a test may run for, unless it has a `// timeout: ` comment of its own, e.g. 10s (default: no limit)")
+	flag.StringVar(&options.TagsList, "tags", options.TagsList,
+		"only generate or run the test files with one of these comma separated `// tags: ` tags")
+	flag.StringVar(&options.SkipTagsList, "skip-tags", options.SkipTagsList,
+		"leave out the test files with one of these comma separated `// tags: ` tags")
+	flag.StringVar(&options.TagAttribute, "tag-attribute", options.TagAttribute,
+		"attribute written on the tests for each of their tags, {tag} standing for the tag,\n"+
+			"e.g. '#[cfg_attr(not(feature = \"{tag}\"), ignore)]'")
+	flag.StringVar(&options.TimeoutAttribute, "timeout-attribute", options.TimeoutAttribute,
+		"attribute failing a generated test that runs for longer than its timeout, {ms} standing for it in milliseconds;\n"+
+			"the default needs ntest as a dev-dependency")
+	flag.StringVar(&options.GcStressSetup, "gc-stress-setup", options.GcStressSetup,
+		"statement enabling GC stress on `vm`, e.g. vm.set_gc_stress(true); the tests marked `// gc: stress` need it")
+	flag.StringVar(&options.BenchesPath, "benches", options.BenchesPath,
+		"also write criterion benchmarks of the -bench-directory programs to this file, e.g. benches/lox_benchmarks.rs\n"+
+			"(needs criterion in the dev-dependencies and a [[bench]] with harness = false)")
+	flag.StringVar(&options.BenchDirectory, "bench-directory", options.BenchDirectory,
+		"test directory holding the programs -benches benchmarks, whether or not it is included")
+	flag.StringVar(&options.BenchImport, "bench-import", options.BenchImport,
+		"use path bringing VM into scope in the -benches file")
+	flag.StringVar(&options.CompareBinaryA, "a", options.CompareBinaryA,
+		"with the compare subcommand, path of the first rlox executable, e.g. the build before a change")
+	flag.StringVar(&options.CompareBinaryB, "b", options.CompareBinaryB,
+		"with the compare subcommand, path of the rlox executable compared with -a")
+	flag.IntVar(&options.BenchRuns, "bench-runs", options.BenchRuns,
+		"with the bench subcommand, number of times each program is timed, after a first run to warm up")
+	flag.StringVar(&options.BenchBaselinePath, "bench-baseline", options.BenchBaselinePath,
+		"with the bench subcommand, JSON file of the timings the programs are compared with")
+	flag.Float64Var(&options.BenchThreshold, "bench-threshold", options.BenchThreshold,
+		"with the bench subcommand, percentage by which the median of a program may exceed its baseline")
+	flag.BoolVar(&options.UpdateBaseline, "update-baseline", options.UpdateBaseline,
+		"with the bench subcommand, write the timings to -bench-baseline instead of comparing with it")
+	flag.StringVar(&options.AffectedSince, "since", options.AffectedSince,
+		"with the affected subcommand, git revision the changed files are taken from")
+	flag.StringVar(&options.ChangedFiles, "changed", options.ChangedFiles,
+		"with the affected subcommand, comma separated files to consider changed instead of asking git")
+	flag.StringVar(&options.AffectedMapPath, "affected-map", options.AffectedMapPath,
+		"with the affected subcommand, TOML or YAML file mapping glob patterns of source files to lists of\n"+
+			"test directory patterns, replacing the built-in mapping of the rlox sources")
+	flag.BoolVar(&watchMode, "watch", false,
+		"keep running and regenerate the output whenever a file under the input is created, modified or deleted")
+	flag.DurationVar(&watchInterval, "watch-interval", 100*time.Millisecond,
+		"how long -watch waits for the changes to the input to stop before regenerating the output")
+	flag.StringVar(&options.CachePath, "cache", options.CachePath,
+		"with -split-output, keep the content hashes of each module's inputs in this file and only regenerate\n"+
+			"the modules whose inputs or options changed (every module is regenerated with -summary-test, -manifest or -insta)")
+	flag.BoolVar(&options.DryRun, "dry-run", options.DryRun,
+		"print a unified diff of the generated files against the files on disk instead of writing them")
+	flag.BoolVar(&options.Check, "check", options.Check,
+		"write nothing, list the generated files that are out of date and exit with status 1 if there are any")
+	flag.BoolVar(&options.Verify, "verify", options.Verify,
+		"check the generated files parse with rustfmt, then that the crate compiles with cargo check --tests")
+	flag.StringVar(&options.VerifyCrate, "verify-crate", options.VerifyCrate,
+		"directory of the crate -verify runs cargo check in")
+	flag.StringVar(&options.TemplateDirectory, "template-dir", options.TemplateDirectory,
+		"directory with file.tmpl, module.tmpl or test.tmpl text/template files replacing the built-in\n"+
+			"templates of the generated file, of its modules and of each test function (see DEFAULT_TEMPLATES)")
+	flag.StringVar(&options.ManifestPath, "manifest", options.ManifestPath,
+		"also write a JSON description of every test file: its path, module, expected output, expected errors and tags")
+	flag.StringVar(&options.MapOut, "map-out", options.MapOut,
+		"also write a JSON file mapping each generated test to its source file and the line of its #[test] in the output")
+	flag.StringVar(&options.SummaryJSON, "summary-json", options.SummaryJSON,
+		"also write the summary printed after generation, of the tests generated per module, the skipped files\n"+
+			"and the directories left out, as JSON to this file")
+	flag.StringVar(&options.CompileEntryPoint, "compile-entry", options.CompileEntryPoint,
+		"expression compiling `source` without running it, returning a Result, e.g. vm.compile(source);\n"+
+			"the `// expect compile error:` tests need it")
+	flag.IntVar(&options.GroupSize, "group-size", options.GroupSize,
+		"split modules with more than this many test files into part1, part2, ... submodules (0 to disable)")
+	flag.StringVar(&options.MergedOutputAccessor, "merged-output-accessor", options.MergedOutputAccessor,
+		"expression for the VM's merged output, whose iter() yields (stream, line) pairs with stream \"out\" or \"err\",\n"+
+			"e.g. vm.output_log; the `// expect out:` and `// expect err:` tests need it")
+	flag.StringVar(&options.RloxBinary, "rlox", options.RloxBinary,
+		"path of the rlox executable the run subcommand checks the tests with,\n"+
+			"built without the debug output features (cargo build --no-default-features)")
+	flag.IntVar(&options.Jobs, "j", options.Jobs,
+		"number of tests the run subcommand runs at the same time")
+	flag.IntVar(&options.Retries, "retries", options.Retries,
+		"number of times the run subcommand runs a failing test again before reporting it, at least 2 for `// flaky` tests")
+	flag.StringVar(&options.RunFormat, "format", options.RunFormat,
+		"how the run subcommand prints its results: text, tap for the Test Anything Protocol,\n"+
+			"or github for GitHub Actions annotations on the lines of the failing files")
+	flag.StringVar(&options.HtmlReportPath, "html", options.HtmlReportPath,
+		"also write the results of the run subcommand to this file as an HTML report with diffs")
+	flag.StringVar(&options.MarkdownReportPath, "report-md", options.MarkdownReportPath,
+		"also write the results of the run subcommand to this file as a Markdown summary,\n"+
+			"with a table per directory and the diff of each failure, e.g. for a pull request comment")
+	flag.StringVar(&options.KnownFailuresPath, "known-failures", options.KnownFailuresPath,
+		"file listing the tests the VM does not pass yet, one path or glob under the input directory per line:\n"+
+			"their generated tests are marked #[ignore = \"known failure\"], and the run subcommand expects them to fail\n"+
+			"(default: "+loxgen.DEFAULT_KNOWN_FAILURES_FILE+", if it exists)")
+	flag.StringVar(&options.JunitPath, "junit", options.JunitPath,
+		"also write the results of the run subcommand to this file as JUnit XML")
+	flag.StringVar(&options.Dialect, "dialect", options.Dialect,
+		"implementation the expectations are read for, clox or jlox: `[c line N]` comments only apply to clox\n"+
+			"and `[java line N]` comments only to jlox")
+	flag.StringVar(&options.ErrorMessagesAccessor, "error-messages-accessor", options.ErrorMessagesAccessor,
+		"expression for every error message the VM reported, in order, e.g. vm.error_messages;\n"+
+			"when set, the files expecting several errors assert all of them instead of the latest one")
+	flag.BoolVar(&options.ExactErrors, "exact-errors", options.ExactErrors,
+		"assert the count and the messages of every error the VM reported against -error-messages-accessor,\n"+
+			"also for files expecting a single error, so that errors no comment expects fail the test")
+	flag.StringVar(&options.StackTraceAccessor, "stack-trace-accessor", options.StackTraceAccessor,
+		"expression for the lines of the stack trace of the VM's latest runtime error, e.g. vm.stack_trace;\n"+
+			"when set, the files with `// [line N] in function()` comments assert them, e.g. \"[line 3] in inner()\"")
+	flag.StringVar(&options.ErrorLineAccessor, "error-line-accessor", options.ErrorLineAccessor,
+		"expression for the line the VM reported its latest error on, e.g. vm.latest_error_line;\n"+
+			"when set, the tests of files expecting a single error also assert the line of `[line N]` and `// expect runtime error:` comments")
+	flag.BoolVar(&options.Profile, "profile", options.Profile,
+		"print how long discovering, reading, parsing and writing took")
+	flag.StringVar(&cpuProfile, "cpuprofile", "",
+		"write a pprof CPU profile of the generation to this file")
+	flag.BoolVar(&options.RequireMarker, "require-marker", options.RequireMarker,
+		"fail if a test file has no expectation, no error marker and no `// no-output` directive")
+	flag.BoolVar(&options.Strict, "strict", options.Strict,
+		"fail if a comment looks like an expectation but is none of the known markers, e.g. `// expects: 1`")
+	flag.StringVar(&options.Chapter, "chapter", options.Chapter,
+		"only generate the tests of the upstream suite the clox test harness runs for this chapter, e.g. chap25_closures;\n"+
+			"directories outside the upstream suite are left out, and -include defaults to * unless set")
+	flag.StringVar(&options.SyncRef, "ref", options.SyncRef,
+		"with the sync subcommand, branch, tag or commit of the craftinginterpreters repository to fetch the tests of")
+	flag.StringVar(&options.SyncURL, "sync-url", options.SyncURL,
+		"with the sync subcommand, URL of the .tar.gz archive of the repository, %s standing for -ref")
+	flag.DurationVar(&options.SyncTimeout, "sync-timeout", options.SyncTimeout,
+		"how long downloading the archive of -sync-url may take")
+	flag.BoolVar(&options.Record, "record", options.Record,
+		"instead of generating tests, run the test files without expectations with -rlox and write comments\n"+
+			"expecting what it printed into them, to be verified by hand")
+	flag.BoolVar(&generateNew, "generate", false,
+		"with the new subcommand, generate the tests once the file is created")
+	flag.StringVar(&options.SyncDirectory, "sync-directory", options.SyncDirectory,
+		"with the sync subcommand, directory to write the tests to (default: -input)")
+	flag.StringVar(&options.UpstreamInput, "upstream", options.UpstreamInput,
+		"with the coverage subcommand, directory or archive of the upstream test directory to compare with\n"+
+			"(default: downloaded from -sync-url at -ref)")
+	flag.StringVar(&options.CorpusDirectory, "corpus-directory", options.CorpusDirectory,
+		"with the corpus subcommand, cargo-fuzz corpus directory to copy the programs to")
+	flag.StringVar(&configPath, "config", "",
+		"config file to read options from (default: loxgen.toml or loxgen.yaml in the current directory)")
+}
+
+// SUBCOMMANDS are the subcommands main accepts, with the number of arguments each takes.
+// Without one, the tests are generated.
+var SUBCOMMANDS = map[string]int{
+	"affected":     0,
+	"bench":        0,
+	"canonicalize": 0,
+	"compare":      0,
+	"corpus":       0,
+	"coverage":     0,
+	"fix":          0,
+	"mutate":       0,
+	"new":          1,
+	"run":          0,
+	"sync":         0,
+}
+
+// checkArguments exits with a usage error unless the positional arguments are a known
+// subcommand and its arguments, so that a misspelled one does not generate the tests instead.
+func checkArguments(args []string) {
+	if len(args) == 0 {
+		return
+	}
+	count, ok := SUBCOMMANDS[args[0]]
+	if !ok {
+		fmt.Fprintf(os.Stderr, "unknown subcommand %q\n", args[0])
+	} else if len(args)-1 != count {
+		fmt.Fprintf(os.Stderr, "the %s subcommand takes %d argument(s), got %d\n", args[0], count, len(args)-1)
+	} else {
+		return
 	}
+	names := make([]string, 0, len(SUBCOMMANDS))
+	for name := range SUBCOMMANDS {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	fmt.Fprintf(os.Stderr, "usage: go run generate_tests.go [flags] [%s]\n", strings.Join(names, " | "))
+	flag.Usage()
+	os.Exit(2)
+}
 
-	// Closing bracket for the module.
-	writeLine(outputFile, "}", indentationLevel)
+// commandLine returns the options set on the command line, from the environment or from the
+// config file, for the header of the generated files. OPERATIONAL_FLAGS are left out.
+func commandLine() []string {
+	var command []string
+	flag.Visit(func(f *flag.Flag) {
+		for _, name := range OPERATIONAL_FLAGS {
+			if f.Name == name {
+				return
+			}
+		}
+		command = append(command, fmt.Sprintf("-%s=%s", f.Name, f.Value))
+	})
+	return command
 }
 
-func writeToFile(files []fs.FileInfo) {
-	f, err := os.Create(OUTPUT_FILE)
+func main() {
+	flag.Parse()
+	checkArguments(flag.Args())
+	loadConfig()
+	options.Command = commandLine()
+
+	generator, err := loxgen.New(options)
 	if err != nil {
 		log.Fatal(err)
 	}
-	defer f.Close()
 
-	// Write the top level tests module.
-	writeLine(f, "#[cfg(test)]", 0)
-	writeLine(f, "mod tests {", 0)
-	writeLine(f, "use super::*;", 1)
+	if watchMode {
+		watch(generator)
+		return
+	}
 
-	for _, fileInfo := range files {
-		name := fileInfo.Name()
+	if flag.Arg(0) == "fix" {
+		// Normalize the expectation comments of the fixtures instead of generating tests.
+		if err := generator.Fix(); err != nil {
+			log.Fatal(err)
+		}
+		return
+	}
 
-		if !fileInfo.IsDir() {
-			// If it is a file, write the test in the top level module.
-			// writeTest(f, &fileInfo, "", 1)
-			continue
+	if flag.Arg(0) == "canonicalize" {
+		// Rewrite the marker spelling of the fixtures instead of generating tests.
+		if err := generator.Canonicalize(); err != nil {
+			log.Fatal(err)
 		}
+		return
+	}
 
-		// If it is a directory, create a new test module for its tests.
-		// if name == "benchmark" || name == "regression" {
-		if name != "function" {
-			// Directories to exclude.
-			continue
+	if flag.Arg(0) == "sync" {
+		// Fetch the upstream test suite instead of generating tests.
+		if err := generator.SyncTests(); err != nil {
+			log.Fatal(err)
 		}
-		modTestFilesInfo, err := ioutil.ReadDir(INPUT_DIRECTORY + name)
-		if err != nil {
+		return
+	}
+
+	if flag.Arg(0) == "new" {
+		// Add a test file, and only generate the tests if asked to.
+		if err := generator.NewTestFile(flag.Arg(1)); err != nil {
 			log.Fatal(err)
 		}
-		writeModule(f, name, modTestFilesInfo, 1)
+		if !generateNew {
+			return
+		}
 	}
 
-	// Closing bracket for the top level tests module.
-	writeLine(f, "}", 0)
-}
+	// The profile is stopped before exiting, failed or not, as os.Exit runs no deferred calls.
+	stopProfile := func() {}
+	if len(cpuProfile) > 0 {
+		f, err := os.Create(cpuProfile)
+		if err != nil {
+			log.Fatal(err)
+		}
+		if err := pprof.StartCPUProfile(f); err != nil {
+			f.Close()
+			log.Fatal(err)
+		}
+		stopProfile = func() {
+			pprof.StopCPUProfile()
+			if err := f.Close(); err != nil {
+				log.Print(err)
+			}
+		}
+	}
 
-func main() {
-	files, err := ioutil.ReadDir(INPUT_DIRECTORY)
-	if err != nil {
+	input, closer, err := generator.OpenInput()
+	if err == nil {
+		err = generator.Generate(input, flag.Arg(0))
+		if closeErr := closer.Close(); err == nil {
+			err = closeErr
+		}
+	}
+	stopProfile()
+	if errors.Is(err, loxgen.ErrFailed) {
+		// The failures were reported already.
+		os.Exit(1)
+	} else if err != nil {
 		log.Fatal(err)
 	}
-	writeToFile(files)
 }
@@ -0,0 +1,2886 @@
+package main
+
+import (
+	"archive/tar"
+	"archive/zip"
+	"bytes"
+	"compress/gzip"
+	"encoding/json"
+	"encoding/xml"
+	"errors"
+	"flag"
+	"fmt"
+	"io/fs"
+	"log"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"os/exec"
+	"path"
+	"path/filepath"
+	"regexp"
+	"runtime"
+	"sort"
+	"strconv"
+	"strings"
+	"testing"
+	"testing/fstest"
+	"time"
+	"unicode/utf8"
+
+	"github.com/olapokon/rlox/loxgen"
+)
+
+// resetFlags gives the options their defaults back and forgets which flags a previous test set.
+func resetFlags(t *testing.T) {
+	previous := flag.CommandLine
+	commandLine := flag.NewFlagSet(os.Args[0], flag.ContinueOnError)
+	flag.VisitAll(func(f *flag.Flag) {
+		commandLine.Var(f.Value, f.Name, f.Usage)
+	})
+	flag.CommandLine = commandLine
+	options = loxgen.DefaultOptions()
+	configPath = ""
+	t.Cleanup(func() {
+		flag.CommandLine = previous
+		options = loxgen.DefaultOptions()
+		configPath = ""
+	})
+}
+
+// chdir moves to a directory for the rest of the test, so that no config file of the
+// current directory is read.
+func chdir(t *testing.T, directory string) {
+	previous, err := os.Getwd()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Chdir(directory); err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { os.Chdir(previous) })
+}
+
+func TestEnvironmentOptions(t *testing.T) {
+	type locations struct {
+		input, output, include, exclude string
+	}
+	tests := []struct {
+		name        string
+		environment map[string]string
+		config      string
+		args        []string
+		want        locations
+	}{
+		{
+			name: "defaults",
+			want: locations{loxgen.DEFAULT_INPUT_DIRECTORY, "", "", ""},
+		},
+		{
+			name: "environment",
+			environment: map[string]string{
+				"RLOX_TEST_INPUT":   "suite.zip",
+				"RLOX_TEST_OUTPUT":  "src/generated.rs",
+				"RLOX_TEST_MODULES": "string,bool",
+				"RLOX_TEST_EXCLUDE": "benchmark",
+			},
+			want: locations{"suite.zip", "src/generated.rs", "string,bool", "benchmark"},
+		},
+		{
+			name: "flags override the environment",
+			environment: map[string]string{
+				"RLOX_TEST_INPUT":   "suite.zip",
+				"RLOX_TEST_OUTPUT":  "src/generated.rs",
+				"RLOX_TEST_MODULES": "string,bool",
+			},
+			args: []string{"-input", "lox", "-include", "variable"},
+			want: locations{"lox", "src/generated.rs", "variable", ""},
+		},
+		{
+			name:        "environment overrides the config file",
+			environment: map[string]string{"RLOX_TEST_MODULES": "string"},
+			config:      "include = \"bool\"\noutput = \"config.rs\"\n",
+			want:        locations{loxgen.DEFAULT_INPUT_DIRECTORY, "config.rs", "string", ""},
+		},
+		{
+			name:        "empty variables are unset",
+			environment: map[string]string{"RLOX_TEST_OUTPUT": ""},
+			want:        locations{loxgen.DEFAULT_INPUT_DIRECTORY, "", "", ""},
+		},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			resetFlags(t)
+			chdir(t, t.TempDir())
+			for _, option := range environmentOptions {
+				t.Setenv(option.variable, test.environment[option.variable])
+			}
+			if len(test.config) > 0 {
+				if err := os.WriteFile("loxgen.toml", []byte(test.config), 0644); err != nil {
+					t.Fatal(err)
+				}
+			}
+			if err := flag.CommandLine.Parse(test.args); err != nil {
+				t.Fatal(err)
+			}
+			loadConfig()
+
+			got := locations{options.InputDirectory, options.OutputFilePath, options.IncludePatterns, options.ExcludePatterns}
+			if got != test.want {
+				t.Errorf("got %+v, want %+v", got, test.want)
+			}
+		})
+	}
+}
+
+// testTree returns a test tree of the contents of its files, by path.
+func testTree(files map[string]string) fstest.MapFS {
+	tree := make(fstest.MapFS)
+	for name, content := range files {
+		tree[name] = &fstest.MapFile{Data: []byte(content)}
+	}
+	return tree
+}
+
+// generate returns the Rust generated from a test tree, with every directory included and
+// the options set by configure, if any.
+func generate(t *testing.T, files map[string]string, configure func(opts *loxgen.Options)) string {
+	t.Helper()
+	opts := loxgen.DefaultOptions()
+	opts.IncludePatterns = "*"
+	if configure != nil {
+		configure(&opts)
+	}
+	return emit(t, testTree(files), opts)
+}
+
+// emit returns the Rust generated from a test tree with the options.
+func emit(t *testing.T, tree fs.FS, opts loxgen.Options) string {
+	t.Helper()
+	suite, err := loxgen.Parse(tree, opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+	output, err := loxgen.Emit(suite, opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return string(output)
+}
+
+// containsLines reports whether the output has the lines, one after the other, ignoring
+// their indentation.
+func containsLines(output string, lines ...string) bool {
+	var outputLines []string
+	for _, line := range strings.Split(output, "\n") {
+		outputLines = append(outputLines, strings.TrimSpace(line))
+	}
+	for start := 0; start+len(lines) <= len(outputLines); start++ {
+		found := true
+		for i, line := range lines {
+			if outputLines[start+i] != line {
+				found = false
+				break
+			}
+		}
+		if found {
+			return true
+		}
+	}
+	return false
+}
+
+// testFunction returns the generated test function of the name, up to the next test or the
+// list of the tests of its module, or an empty string if there is none.
+func testFunction(output string, name string) string {
+	start := strings.Index(output, "fn "+name+"()")
+	if start < 0 {
+		return ""
+	}
+	end := len(output)
+	for _, next := range []string{"#[test]", "const TESTS:"} {
+		if index := strings.Index(output[start:], next); index >= 0 && start+index < end {
+			end = start + index
+		}
+	}
+	return output[start:end]
+}
+
+// captureLog returns what is logged for the rest of the test.
+func captureLog(t *testing.T) *bytes.Buffer {
+	var logged bytes.Buffer
+	log.SetOutput(&logged)
+	t.Cleanup(func() { log.SetOutput(os.Stderr) })
+	return &logged
+}
+
+func TestEmptySource(t *testing.T) {
+	files := map[string]string{
+		"empty/blank.lox": "",
+		"empty/one.lox":   "print 1; // expect: 1\n",
+	}
+	tests := []struct {
+		name      string
+		allow     bool
+		generated bool
+		warning   bool
+	}{
+		{name: "skipped by default", generated: false, warning: true},
+		{name: "with -allow-empty-source", allow: true, generated: true, warning: false},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			logged := captureLog(t)
+			output := generate(t, files, func(opts *loxgen.Options) {
+				opts.AllowEmptySource = test.allow
+			})
+
+			if got := strings.Contains(output, "fn blank_test() -> VMResult {"); got != test.generated {
+				t.Errorf("blank_test generated: %v, want %v\n%s", got, test.generated, output)
+			}
+			if !strings.Contains(output, "fn one_test() -> VMResult {") {
+				t.Errorf("one_test is missing\n%s", output)
+			}
+			if got := strings.Contains(logged.String(), "Warning: skipping empty file test/empty/blank.lox."); got != test.warning {
+				t.Errorf("warned: %v, want %v, logged:\n%s", got, test.warning, logged)
+			}
+		})
+	}
+}
+
+func TestReferenceOutput(t *testing.T) {
+	references := t.TempDir()
+	if err := os.MkdirAll(filepath.Join(references, "string"), 0755); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(filepath.Join(references, "string", "two_lines.lox.ref"), []byte("1\n2\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	logged := captureLog(t)
+	output := generate(t, map[string]string{
+		"string/two_lines.lox":    "print 1;\nprint 2;\n",
+		"string/no_reference.lox": "print 3;\n",
+	}, func(opts *loxgen.Options) {
+		opts.ReferenceDirectory = references
+	})
+
+	tests := []struct {
+		name  string
+		lines []string
+		want  bool
+	}{
+		{"reference file", []string{
+			"let output: Vec<String> = vm.printed_values.iter().map(|v| v.to_string()).collect();",
+			"assert_eq!(",
+			`"1\n2",`,
+			`output.join("\n")`,
+		}, true},
+		{"missing reference file", []string{"fn no_reference_test() -> VMResult {"}, false},
+	}
+	for _, test := range tests {
+		if got := containsLines(output, test.lines...); got != test.want {
+			t.Errorf("%s: generated %v, want %v\n%s", test.name, got, test.want, output)
+		}
+	}
+	if !strings.Contains(logged.String(), "Warning: skipping test/string/no_reference.lox, no reference output found.") {
+		t.Errorf("no warning about the missing reference file, logged:\n%s", logged)
+	}
+}
+
+func TestPerFileModule(t *testing.T) {
+	tests := []struct {
+		file   string
+		module string
+	}{
+		{"string/literals.lox", "literals"},
+		{"string/if-else.lox", "if_else"},
+		{"string/while.lox", "while_"},
+		{"string/2nd.lox", "_2nd"},
+		{"string/try.lox", "try_"},
+		{"string/+.lox", "__"},
+		// Same identifier as if-else.lox, listed before it.
+		{"string/if_else.lox", "if_else_2"},
+	}
+	files := make(map[string]string)
+	for _, test := range tests {
+		files[test.file] = "print 1; // expect: 1\n"
+	}
+	output := generate(t, files, func(opts *loxgen.Options) {
+		opts.PerFileModule = true
+	})
+
+	for _, test := range tests {
+		if !containsLines(output, "mod "+test.module+" {", "use super::*;", "", "#[test]", "pub(super) fn run() -> VMResult {") {
+			t.Errorf("%s: no module %s with a run test\n%s", test.file, test.module, output)
+		}
+		if !containsLines(output, test.module+"::run,") {
+			t.Errorf("%s: %s::run is not listed in the module's tests\n%s", test.file, test.module, output)
+		}
+	}
+	if strings.Contains(output, "fn literals_test()") {
+		t.Errorf("the tests are also written as functions of the directory's module\n%s", output)
+	}
+}
+
+func TestAssertMessage(t *testing.T) {
+	files := map[string]string{"string/values.lox": "print 1; // expect: 1\nprint 2; // expect: 2\n"}
+	tests := []struct {
+		template string
+		messages []string
+	}{
+		{"", nil},
+		{"{file}:{line} value {index}", []string{`"{}", "test/string/values.lox:1 value 0"`, `"{}", "test/string/values.lox:2 value 1"`}},
+		{"see {file}", []string{`"{}", "see test/string/values.lox"`, `"{}", "see test/string/values.lox"`}},
+	}
+	for _, test := range tests {
+		output := generate(t, files, func(opts *loxgen.Options) {
+			opts.AssertMessage = test.template
+		})
+		if len(test.messages) == 0 && strings.Contains(output, `"{}", `) {
+			t.Errorf("%q: unexpected assertion message\n%s", test.template, output)
+		}
+		for i, message := range test.messages {
+			value := fmt.Sprint(i + 1)
+			if !containsLines(output, "assert_eq!(", `"`+value+`",`, fmt.Sprintf("printed[%d],", i), message) {
+				t.Errorf("%q: no assertion of %s with the message %s\n%s", test.template, value, message, output)
+			}
+		}
+	}
+
+	opts := loxgen.DefaultOptions()
+	opts.AssertMessage = "{file}:{column}"
+	if _, err := loxgen.Parse(testTree(files), opts); err == nil || !strings.Contains(err.Error(), "unknown placeholder {column}") {
+		t.Errorf("got error %v, want an unknown placeholder", err)
+	}
+}
+
+// generatedTestCount matches the constant of the generated test count.
+var generatedTestCount = regexp.MustCompile(`const GENERATED_TEST_COUNT: usize = (\d+);`)
+
+func TestGeneratedTestCount(t *testing.T) {
+	value := "print 1; // expect: 1\nprint 2; // expect: 2\n"
+	tests := []struct {
+		name      string
+		files     map[string]string
+		configure func(opts *loxgen.Options)
+		want      int
+	}{
+		{"one file", map[string]string{"string/a.lox": value}, nil, 1},
+		{"nested directories", map[string]string{
+			"bool/a.lox":          value,
+			"string/b.lox":        value,
+			"string/c.lox":        value,
+			"string/nested/d.lox": value,
+		}, nil, 4},
+		{"one test per expectation", map[string]string{"string/a.lox": value, "string/b.lox": value}, func(opts *loxgen.Options) {
+			opts.ExplodeExpectations = true
+		}, 4},
+		{"parts", map[string]string{"string/a.lox": value, "string/b.lox": value, "string/c.lox": value}, func(opts *loxgen.Options) {
+			opts.GroupSize = 2
+		}, 3},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			output := generate(t, test.files, test.configure)
+
+			match := generatedTestCount.FindStringSubmatch(output)
+			if match == nil {
+				t.Fatalf("no GENERATED_TEST_COUNT\n%s", output)
+			}
+			// Every #[test] but generated_test_count itself.
+			functions := strings.Count(output, "#[test]") - 1
+			if match[1] != fmt.Sprint(test.want) || functions != test.want {
+				t.Errorf("GENERATED_TEST_COUNT is %s for %d test function(s), want %d\n%s", match[1], functions, test.want, output)
+			}
+		})
+	}
+}
+
+// archive returns a .zip or .tar.gz archive of the files, by path.
+func archive(t *testing.T, format string, files map[string]string) []byte {
+	var data bytes.Buffer
+	names := make([]string, 0, len(files))
+	for name := range files {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	switch format {
+	case "zip":
+		w := zip.NewWriter(&data)
+		for _, name := range names {
+			f, err := w.Create(name)
+			if err != nil {
+				t.Fatal(err)
+			}
+			f.Write([]byte(files[name]))
+		}
+		if err := w.Close(); err != nil {
+			t.Fatal(err)
+		}
+	case "tar.gz":
+		compressed := gzip.NewWriter(&data)
+		w := tar.NewWriter(compressed)
+		for _, name := range names {
+			if err := w.WriteHeader(&tar.Header{Name: name, Mode: 0644, Size: int64(len(files[name]))}); err != nil {
+				t.Fatal(err)
+			}
+			w.Write([]byte(files[name]))
+		}
+		if err := w.Close(); err != nil {
+			t.Fatal(err)
+		}
+		if err := compressed.Close(); err != nil {
+			t.Fatal(err)
+		}
+	}
+	return data.Bytes()
+}
+
+func TestArchiveInput(t *testing.T) {
+	files := map[string]string{
+		"string/a.lox":        "print 1; // expect: 1\n",
+		"string/nested/b.lox": "print 2; // expect: 2\n",
+	}
+	opts := loxgen.DefaultOptions()
+	opts.IncludePatterns = "*"
+	tests := []struct {
+		name   string
+		format string
+		// Test tree of the archive, given its data.
+		open func(t *testing.T, format string, data []byte) fs.FS
+	}{
+		{"in memory", "zip", func(t *testing.T, format string, data []byte) fs.FS {
+			tree, err := zip.NewReader(bytes.NewReader(data), int64(len(data)))
+			if err != nil {
+				t.Fatal(err)
+			}
+			return tree
+		}},
+		{"zip file", "zip", openArchive},
+		{"tar.gz file", "tar.gz", openArchive},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			output := emit(t, test.open(t, test.format, archive(t, test.format, files)), opts)
+
+			for _, lines := range [][]string{
+				{"mod string_tests {", "use super::*;", "", "#[test]", "fn a_test() -> VMResult {"},
+				{"pub(crate) mod nested_tests {", "use super::*;", "", "#[test]", "fn b_test() -> VMResult {"},
+			} {
+				if !containsLines(output, lines...) {
+					t.Errorf("no %s\n%s", lines[0], output)
+				}
+			}
+		})
+	}
+
+	t.Run("closed", func(t *testing.T) {
+		opts := opts
+		opts.InputDirectory = filepath.Join(t.TempDir(), "suite.zip")
+		if err := os.WriteFile(opts.InputDirectory, archive(t, "zip", files), 0644); err != nil {
+			t.Fatal(err)
+		}
+		generator, err := loxgen.New(opts)
+		if err != nil {
+			t.Fatal(err)
+		}
+		tree, closer, err := generator.OpenInput()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err := closer.Close(); err != nil {
+			t.Fatal(err)
+		}
+		if _, err := fs.ReadFile(tree, "string/a.lox"); err == nil {
+			t.Error("expected the archive to be closed")
+		}
+	})
+}
+
+// openArchive writes an archive to a file and opens it as the -input of a generator.
+func openArchive(t *testing.T, format string, data []byte) fs.FS {
+	opts := loxgen.DefaultOptions()
+	opts.InputDirectory = filepath.Join(t.TempDir(), "suite."+format)
+	if err := os.WriteFile(opts.InputDirectory, data, 0644); err != nil {
+		t.Fatal(err)
+	}
+	generator, err := loxgen.New(opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tree, closer, err := generator.OpenInput()
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { closer.Close() })
+	return tree
+}
+
+func TestRewriteArchive(t *testing.T) {
+	data := archive(t, "zip", map[string]string{"string/a.lox": "print 1; // Expect: 1\n"})
+	opts := loxgen.DefaultOptions()
+	opts.InputDirectory = filepath.Join(t.TempDir(), "suite.zip")
+	if err := os.WriteFile(opts.InputDirectory, data, 0644); err != nil {
+		t.Fatal(err)
+	}
+	generator, err := loxgen.New(opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tests := []struct {
+		name    string
+		rewrite func() error
+	}{
+		{"canonicalize", generator.Canonicalize},
+		{"fix", generator.Fix},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			want := "canonicalize and fix rewrite the test files in place, they need an input directory, not an archive"
+			if err := test.rewrite(); err == nil || err.Error() != want {
+				t.Errorf("got error %v, want %q", err, want)
+			}
+			if written, err := os.ReadFile(opts.InputDirectory); err != nil || !bytes.Equal(written, data) {
+				t.Errorf("archive rewritten: %v", err)
+			}
+		})
+	}
+}
+
+func TestExplodeExpectations(t *testing.T) {
+	tests := []struct {
+		name   string
+		source string
+		values []string
+	}{
+		{"one expectation", "print 1; // expect: 1\n", []string{"1"}},
+		{"three expectations", "print 1; // expect: 1\nprint 2; // expect: 2\nprint \"a\"; // expect: a\n", []string{"1", "2", "a"}},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			output := generate(t, map[string]string{"string/values.lox": test.source}, func(opts *loxgen.Options) {
+				opts.ExplodeExpectations = true
+			})
+
+			if got := strings.Count(output, "#[test]") - 1; got != len(test.values) {
+				t.Errorf("%d test function(s), want %d\n%s", got, len(test.values), output)
+			}
+			for i, value := range test.values {
+				name := fmt.Sprintf("values_expect_%d", i)
+				if !containsLines(testFunction(output, name), `"`+value+`",`, fmt.Sprintf("printed[%d]", i)) {
+					t.Errorf("no %s asserting %q\n%s", name, value, output)
+				}
+			}
+		})
+	}
+}
+
+func TestInvalidUTF8(t *testing.T) {
+	files := map[string]string{"string/corrupt.lox": "print \"\xff\"; // expect: \xff\n"}
+	tests := []struct {
+		name  string
+		lossy bool
+		// The error Emit returns, or the value the test expects with -lossy.
+		want string
+	}{
+		{"diagnostic", false, "test/string/corrupt.lox: invalid UTF-8 at byte offset 7 (use -lossy to replace invalid bytes)"},
+		{"with -lossy", true, "\"�\","},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			opts := loxgen.DefaultOptions()
+			opts.IncludePatterns = "*"
+			opts.Lossy = test.lossy
+			if !test.lossy {
+				suite, err := loxgen.Parse(testTree(files), opts)
+				if err != nil {
+					t.Fatal(err)
+				}
+				if _, err := loxgen.Emit(suite, opts); err == nil || err.Error() != test.want {
+					t.Errorf("got error %v, want %q", err, test.want)
+				}
+				return
+			}
+			output := emit(t, testTree(files), opts)
+			if !containsLines(output, test.want, "printed[0]") || !utf8.ValidString(output) {
+				t.Errorf("invalid bytes not replaced\n%s", output)
+			}
+		})
+	}
+}
+
+func TestSummaryTest(t *testing.T) {
+	tests := []struct {
+		file   string
+		source string
+		// The expected values and error of the file's case.
+		values string
+		error  string
+	}{
+		{"string/values.lox", "print 1; // expect: 1\nprint \"a: b\"; // expect: a: b\n", `&["1", "a: b"],`, `"",`},
+		{"string/error.lox", "print nil.x; // expect runtime error: Only instances have properties.\n", `&[],`, `"Only instances have properties.",`},
+		{"bool/nested/value.lox", "print true; // expect: true\n", `&["true"],`, `"",`},
+	}
+	files := make(map[string]string)
+	for _, test := range tests {
+		files[test.file] = test.source
+	}
+	// The summary cannot check these, they are left to their own tests.
+	skipped := map[string]string{
+		"string/compile.lox": "var = 1; // expect compile error: Expect variable name.\n",
+		"string/exit.lox":    "print 1; // expect: 1\nnil.x; // expect exit: 70\n",
+		"string/streams.lox": "print 1; // expect out: 1\n",
+		"string/input.lox":   "// input: 1\nprint 1; // expect: 1\n",
+		"string/stress.lox":  "// gc: stress\nprint 1; // expect: 1\n",
+	}
+	for file, source := range skipped {
+		files[file] = source
+	}
+	output := generate(t, files, func(opts *loxgen.Options) {
+		opts.SummaryTest = true
+		opts.CompileEntryPoint = "vm.compile(source)"
+		opts.MergedOutputAccessor = "vm.output_log"
+		opts.StdinSetup = "vm.set_input({input});"
+		opts.GcStressSetup = "vm.set_gc_stress(true);"
+	})
+
+	summary := testFunction(output, "conformance_summary")
+	if len(summary) == 0 {
+		t.Fatalf("no conformance_summary\n%s", output)
+	}
+	for _, test := range tests {
+		lines := []string{"(", `"test/` + test.file + `",`, "r#\""}
+		lines = append(lines, strings.Split(strings.TrimSuffix(test.source, "\n"), "\n")...)
+		lines = append(lines, `"#,`, test.values, test.error, "),")
+		if !containsLines(summary, lines...) {
+			t.Errorf("no case of %s\n%s", test.file, summary)
+		}
+	}
+	for file := range skipped {
+		if strings.Contains(summary, `"test/`+file+`"`) {
+			t.Errorf("case of %s in the summary\n%s", file, summary)
+		}
+	}
+}
+
+func TestColonInExpectation(t *testing.T) {
+	tests := []struct {
+		name     string
+		source   string
+		expected []string
+	}{
+		{
+			name:     "value",
+			source:   `print "a: b: c"; // expect: a: b: c`,
+			expected: []string{"assert_eq!(", `"a: b: c",`, "printed[0]"},
+		},
+		{
+			name:     "runtime error",
+			source:   `foo(); // expect runtime error: Undefined variable: 'foo': here.`,
+			expected: []string{"assert_eq!(", `"Undefined variable: 'foo': here.",`, "vm.latest_error_message"},
+		},
+		{
+			name:     "compile error",
+			source:   `// [line 2] Error at 'x': Expect: thing.`,
+			expected: []string{"assert_eq!(", `"Expect: thing.",`, "vm.latest_error_message"},
+		},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			output := generate(t, map[string]string{"string/colon.lox": test.source + "\n"}, nil)
+			if !containsLines(testFunction(output, "colon_test"), test.expected...) {
+				t.Errorf("expected %q in\n%s", test.expected, output)
+			}
+		})
+	}
+}
+
+func TestErrorIdentifier(t *testing.T) {
+	files := map[string]string{"variable/error.lox": "var error = 1;\nprint error; // expect: 1\n"}
+	function := testFunction(generate(t, files, nil), "error_test")
+	if !containsLines(function, "assert_eq!(", `"1",`, "printed[0]") || strings.Contains(function, "RuntimeError") {
+		t.Errorf("expected a value test\n%s", function)
+	}
+
+	if runtime.GOOS == "windows" {
+		t.Skip("the stand-in rlox executable is a shell script")
+	}
+	directory := t.TempDir()
+	for file, source := range files {
+		path := filepath.Join(directory, "suite", file)
+		if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+			t.Fatal(err)
+		}
+		if err := os.WriteFile(path, []byte(source), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	rlox := filepath.Join(directory, "rlox")
+	if err := os.WriteFile(rlox, []byte("#!/bin/sh\necho 1\n"), 0755); err != nil {
+		t.Fatal(err)
+	}
+	output, err := runMain(t, directory, "-input", "suite", "-include", "*", "-rlox", rlox, "run")
+	if err != nil || strings.Contains(output, "FAIL") {
+		t.Errorf("got %v, want the run to pass\n%s", err, output)
+	}
+}
+
+func TestEscapedExpectation(t *testing.T) {
+	tests := []struct {
+		name     string
+		source   string
+		expected []string
+	}{
+		{
+			name:     "backslash",
+			source:   `print "C:\dir"; // expect: C:\dir`,
+			expected: []string{"assert_eq!(", `"C:\\dir",`},
+		},
+		{
+			name:     "quotes",
+			source:   `foo(); // expect runtime error: Undefined variable "foo".`,
+			expected: []string{"assert_eq!(", `"Undefined variable \"foo\".",`, "vm.latest_error_message"},
+		},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			output := generate(t, map[string]string{"string/escaped.lox": test.source + "\n"}, nil)
+			if !containsLines(testFunction(output, "escaped_test"), test.expected...) {
+				t.Errorf("expected %q in\n%s", test.expected, output)
+			}
+		})
+	}
+}
+
+func TestSeveralErrors(t *testing.T) {
+	files := map[string]string{
+		"string/errors.lox": "var = 1; // Error at '=': Expect variable name.\nvar = 2; // Error at '=': Expect expression.\n",
+	}
+	tests := []struct {
+		name     string
+		accessor string
+		expected []string
+	}{
+		{"latest error", "", []string{"assert_eq!(", `"Expect expression.",`, "vm.latest_error_message"}},
+		{"every error", "vm.error_messages", []string{"assert_eq!(", `vec!["Expect variable name.", "Expect expression."],`, "vm.error_messages"}},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			function := testFunction(generate(t, files, func(opts *loxgen.Options) {
+				opts.ErrorMessagesAccessor = test.accessor
+			}), "errors_test")
+			if !containsLines(function, test.expected...) {
+				t.Errorf("expected %q in\n%s", test.expected, function)
+			}
+			if len(test.accessor) == 0 && strings.Contains(function, `"Expect variable name."`) {
+				t.Errorf("the first error is compared with the latest one\n%s", function)
+			}
+		})
+	}
+}
+
+func TestValuesThenError(t *testing.T) {
+	files := map[string]string{
+		"string/values.lox": "print 1; // expect: 1\nnil.x; // expect runtime error: Only instances have properties.\n",
+	}
+	function := testFunction(generate(t, files, nil), "values_test")
+	if !containsLines(function,
+		"let result = vm.interpret(source);",
+		`assert!(matches!(result, Err(VMError::RuntimeError)), "expected a runtime error, got {:?}", result);`,
+	) {
+		t.Errorf("no runtime error assertion\n%s", function)
+	}
+	for _, lines := range [][]string{
+		{"assert_eq!(", `"1",`, "printed[0]"},
+		{"assert_eq!(", `"Only instances have properties.",`, "vm.latest_error_message"},
+	} {
+		if !containsLines(function, lines...) {
+			t.Errorf("expected %q in\n%s", lines, function)
+		}
+	}
+	if strings.Contains(function, "?;") {
+		t.Errorf("the error returns from the test before the values are checked\n%s", function)
+	}
+}
+
+func TestErrorLine(t *testing.T) {
+	tests := []struct {
+		name     string
+		source   string
+		asserted bool
+	}{
+		{"single error", "\n// [line 2] Error at 'x': Expect ';'.\n", true},
+		{"several errors", "\n// [line 2] Error at 'x': Expect ';'.\n// [line 3] Error at 'y': Expect ';'.\n", false},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			function := testFunction(generate(t, map[string]string{"string/line.lox": test.source}, func(opts *loxgen.Options) {
+				opts.ErrorLineAccessor = "vm.latest_error_line"
+			}), "line_test")
+			if asserted := containsLines(function, "assert_eq!(", "2,", "vm.latest_error_line - 1"); asserted != test.asserted {
+				t.Errorf("line asserted: %v, want %v\n%s", asserted, test.asserted, function)
+			}
+		})
+	}
+}
+
+func TestOutputAccessor(t *testing.T) {
+	tests := []struct {
+		name      string
+		configure func(*loxgen.Options)
+		values    []string
+	}{
+		{
+			name:      "default",
+			configure: func(opts *loxgen.Options) { opts.SnapshotOutput = false },
+			values:    []string{"vm.printed_values[0].to_string()", "vm.printed_values[1].to_string()"},
+		},
+		{
+			name: "accessor",
+			configure: func(opts *loxgen.Options) {
+				opts.SnapshotOutput = false
+				opts.OutputAccessor = "vm.output_at({i})"
+			},
+			values: []string{"vm.output_at(0).to_string()", "vm.output_at(1).to_string()"},
+		},
+	}
+	files := map[string]string{"string/values.lox": "print 1; // expect: 1\nprint 2; // expect: 2\n"}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			function := testFunction(generate(t, files, test.configure), "values_test")
+			for i, value := range test.values {
+				if !containsLines(function, "assert_eq!(", fmt.Sprintf(`"%d",`, i+1), value) {
+					t.Errorf("expected value %d read with %s\n%s", i+1, value, function)
+				}
+			}
+			if strings.Contains(function, ".pop()") {
+				t.Errorf("printed values popped\n%s", function)
+			}
+		})
+	}
+}
+
+// runMain runs the generator's main in a subprocess, from directory, with args, and returns
+// its combined output; a subprocess is needed for the paths that end in log.Fatal.
+func runMain(t *testing.T, directory string, args ...string) (string, error) {
+	command := exec.Command(os.Args[0], "-test.run=^TestRunMain$")
+	command.Dir = directory
+	command.Env = append(os.Environ(), "GENERATE_TESTS_ARGS="+strings.Join(args, "\n"))
+	output, err := command.CombinedOutput()
+	return string(output), err
+}
+
+// TestRunMain is the entry point of runMain's subprocess; it is skipped in the test run itself.
+func TestRunMain(t *testing.T) {
+	args, ok := os.LookupEnv("GENERATE_TESTS_ARGS")
+	if !ok {
+		t.Skip("only run by runMain")
+	}
+	os.Args = append([]string{"generate_tests"}, strings.Split(args, "\n")...)
+	main()
+	os.Exit(0)
+}
+
+// writeFiles writes the files, by path relative to directory, creating their directories.
+func writeFiles(t *testing.T, directory string, files map[string]string) {
+	t.Helper()
+	for file, content := range files {
+		path := filepath.Join(directory, file)
+		if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+			t.Fatal(err)
+		}
+		if err := os.WriteFile(path, []byte(content), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+}
+
+// fakeRlox writes a shell script standing in for the rlox executable to directory, and returns
+// its path. The script gets the path of a copy of the test's source, named <test>-*.lox, as $1.
+func fakeRlox(t *testing.T, directory string, script string) string {
+	t.Helper()
+	if runtime.GOOS == "windows" {
+		t.Skip("the stand-in rlox executable is a shell script")
+	}
+	rlox := filepath.Join(directory, "rlox")
+	if err := os.WriteFile(rlox, []byte("#!/bin/sh\n"+script), 0755); err != nil {
+		t.Fatal(err)
+	}
+	return rlox
+}
+
+func TestGeneratorErrors(t *testing.T) {
+	directory := t.TempDir()
+	opts := loxgen.DefaultOptions()
+	opts.IncludePatterns = "*"
+	opts.InputDirectory = directory
+	opts.OutputFilePath = filepath.Join(directory, "tests.rs")
+	generator, err := loxgen.New(opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+	captureLog(t)
+	tree := testTree(map[string]string{"string/a.lox": "print \"a\"; // expect-regex: (\n"})
+	// With -fail-fast, the first invalid file stops generation, and running the tests.
+	failFast := func(subcommand string) error {
+		opts := opts
+		opts.FailFast = true
+		generator, err := loxgen.New(opts)
+		if err != nil {
+			return err
+		}
+		return generator.Generate(testTree(map[string]string{
+			"string/a.lox": "print \"a\"; // expect-regex: (\n",
+			"string/b.lox": "print \"b\"; // expect-regex: [\n",
+		}), subcommand)
+	}
+	firstError := filepath.Join(directory, "string", "a.lox") + ":1: invalid // expect-regex: pattern: error parsing regexp: missing closing ): `(`"
+	tests := []struct {
+		name string
+		run  func() error
+		want string
+	}{
+		{"generate", func() error { return generator.Generate(tree, "") }, "1 error(s), " + opts.OutputFilePath + " was not written."},
+		{"compare", func() error { return generator.Generate(tree, "compare") }, "the compare subcommand needs the two executables to run, with -a and -b"},
+		{"new", func() error { return generator.NewTestFile("") }, "the new subcommand expects the path of the test to create, e.g. new string/unicode_escape"},
+		{"new outside", func() error { return generator.NewTestFile("../x") }, "../x is not inside the input directory"},
+		{"fail fast", func() error { return failFast("") }, firstError},
+		{"fail fast run", func() error { return failFast("run") }, firstError},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			if err := test.run(); err == nil || err.Error() != test.want {
+				t.Errorf("got error %v, want %q", err, test.want)
+			}
+		})
+	}
+}
+
+func TestFailFast(t *testing.T) {
+	tests := []struct {
+		name     string
+		args     []string
+		reported []string
+	}{
+		{"accumulate", nil, []string{"test/string/a.lox:1", "test/string/b.lox:1"}},
+		{"fail fast", []string{"-fail-fast"}, []string{"test/string/a.lox:1"}},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			directory := t.TempDir()
+			for file, source := range map[string]string{
+				"test/string/a.lox": "print \"a\"; // expect-regex: (\n",
+				"test/string/b.lox": "print \"b\"; // expect-regex: [\n",
+				"tests.rs":          "previous output\n",
+			} {
+				path := filepath.Join(directory, file)
+				if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+					t.Fatal(err)
+				}
+				if err := os.WriteFile(path, []byte(source), 0644); err != nil {
+					t.Fatal(err)
+				}
+			}
+			args := append([]string{"-include", "*", "-output", "tests.rs"}, test.args...)
+			output, err := runMain(t, directory, args...)
+			if err == nil {
+				t.Fatalf("expected the generator to fail\n%s", output)
+			}
+			var reported []string
+			for _, line := range strings.Split(output, "\n") {
+				if strings.Contains(line, "invalid // expect-regex: pattern") {
+					reported = append(reported, line)
+				}
+			}
+			if len(reported) != len(test.reported) {
+				t.Fatalf("expected %d error(s), got\n%s", len(test.reported), output)
+			}
+			for i, location := range test.reported {
+				if !strings.Contains(reported[i], location) {
+					t.Errorf("expected error %d at %s, got %s", i+1, location, reported[i])
+				}
+			}
+			previous, err := os.ReadFile(filepath.Join(directory, "tests.rs"))
+			if err != nil {
+				t.Fatal(err)
+			}
+			if string(previous) != "previous output\n" {
+				t.Errorf("previous output overwritten with\n%s", previous)
+			}
+		})
+	}
+}
+
+func TestDoctest(t *testing.T) {
+	tests := []struct {
+		name     string
+		source   string
+		expected []string
+	}{
+		{
+			name:   "plain",
+			source: "print 1; // expect: 1\n",
+			expected: []string{
+				"/// Example generated from test/string/example.lox.",
+				"///",
+				"/// ```rust",
+				"/// # use rlox::vm::vm::*;",
+				`/// let source = r#"`,
+				"/// print 1; // expect: 1",
+				`/// "#`,
+			},
+		},
+		{
+			name:     "fence in source",
+			source:   "// ```\nprint 1; // expect: 1\n",
+			expected: []string{"/// ````rust", "/// # use rlox::vm::vm::*;", `/// let source = r#"`, "/// // ```"},
+		},
+		{
+			name:     "hidden line marker in source",
+			source:   "# x\nprint 1; // expect: 1\n",
+			expected: []string{`/// let source = r#"`, "/// ## x"},
+		},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			output := generate(t, map[string]string{"string/example.lox": test.source}, func(opts *loxgen.Options) {
+				opts.Doctest = true
+			})
+			if !containsLines(output, test.expected...) {
+				t.Errorf("expected %q in\n%s", test.expected, output)
+			}
+			if !containsLines(output, "/// # Ok::<(), VMError>(())") || !strings.Contains(output, "pub fn example_test() {}") {
+				t.Errorf("doctest not closed on a dummy item\n%s", output)
+			}
+			if strings.Contains(output, "#[test]") {
+				t.Errorf("test function emitted with -doctest\n%s", output)
+			}
+		})
+	}
+}
+
+var testFunctionName = regexp.MustCompile(`(?m)^\s*fn (\w+)_test\(\)`)
+
+func TestFilterExpect(t *testing.T) {
+	files := map[string]string{
+		"string/undefined.lox": "foo; // expect runtime error: Undefined variable 'foo'.\n",
+		"string/other.lox":     "print bar; // expect runtime error: Undefined variable 'bar'.\n",
+		"string/property.lox":  "nil.x; // expect runtime error: Only instances have properties.\n",
+		"string/value.lox":     "print 1; // expect: 1\n",
+	}
+	tests := []struct {
+		pattern  string
+		selected []string
+	}{
+		{"", []string{"other", "property", "undefined", "value"}},
+		{"Undefined variable", []string{"other", "undefined"}},
+		{"'foo'", []string{"undefined"}},
+		{"^1$", []string{"value"}},
+	}
+	for _, test := range tests {
+		t.Run(test.pattern, func(t *testing.T) {
+			output := generate(t, files, func(opts *loxgen.Options) {
+				opts.FilterExpectPattern = test.pattern
+			})
+			var selected []string
+			for _, match := range testFunctionName.FindAllStringSubmatch(output, -1) {
+				selected = append(selected, match[1])
+			}
+			if strings.Join(selected, " ") != strings.Join(test.selected, " ") {
+				t.Errorf("expected %q, got %q", test.selected, selected)
+			}
+		})
+	}
+}
+
+func TestCanonicalize(t *testing.T) {
+	tests := []struct {
+		file      string
+		source    string
+		canonical string
+	}{
+		{
+			file:      "string/messy.lox",
+			source:    "print 1; //expect: 1\nprint \"x //expect: y\"; // Expect : a\nfoo; // ERROR: bad\n",
+			canonical: "print 1; // expect: 1\nprint \"x //expect: y\"; // expect: a\nfoo; // Error: bad\n",
+		},
+		{
+			file:      "string/clean.lox",
+			source:    "print 1; // expect: 1\nnil.x; // expect runtime error: Only instances have properties.\n",
+			canonical: "print 1; // expect: 1\nnil.x; // expect runtime error: Only instances have properties.\n",
+		},
+	}
+	opts := loxgen.DefaultOptions()
+	opts.InputDirectory = t.TempDir()
+	unchanged := time.Date(2020, 1, 1, 0, 0, 0, 0, time.UTC)
+	for _, test := range tests {
+		path := filepath.Join(opts.InputDirectory, test.file)
+		if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+			t.Fatal(err)
+		}
+		if err := os.WriteFile(path, []byte(test.source), 0644); err != nil {
+			t.Fatal(err)
+		}
+		if err := os.Chtimes(path, unchanged, unchanged); err != nil {
+			t.Fatal(err)
+		}
+	}
+	generator, err := loxgen.New(opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+	captureLog(t)
+
+	// The second pass checks that canonicalizing is idempotent.
+	for pass := 1; pass <= 2; pass++ {
+		if err := generator.Canonicalize(); err != nil {
+			t.Fatal(err)
+		}
+		for _, test := range tests {
+			path := filepath.Join(opts.InputDirectory, test.file)
+			data, err := os.ReadFile(path)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if string(data) != test.canonical {
+				t.Errorf("pass %d: expected %s to be\n%s\ngot\n%s", pass, test.file, test.canonical, data)
+			}
+			info, err := os.Stat(path)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if test.source == test.canonical && !info.ModTime().Equal(unchanged) {
+				t.Errorf("pass %d: %s was rewritten", pass, test.file)
+			}
+		}
+	}
+}
+
+func TestGcStress(t *testing.T) {
+	files := map[string]string{
+		"string/stress.lox": "// gc: stress\nprint 1; // expect: 1\n",
+		"string/plain.lox":  "print 1; // expect: 1\n",
+	}
+	tests := []struct {
+		name  string
+		setup string
+	}{
+		{"flag", "vm.set_gc_stress(true);"},
+		{"custom", "vm.gc_every_allocation();"},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			output := generate(t, files, func(opts *loxgen.Options) {
+				opts.GcStressSetup = test.setup
+			})
+			if !containsLines(testFunction(output, "stress_test"), "let mut vm = VM::new();", test.setup, "vm.interpret(source)?;") {
+				t.Errorf("expected %s before interpreting\n%s", test.setup, output)
+			}
+			if strings.Contains(testFunction(output, "plain_test"), test.setup) {
+				t.Errorf("GC stress set up for an untagged test\n%s", output)
+			}
+		})
+	}
+}
+
+func TestMissingHooks(t *testing.T) {
+	tests := []struct {
+		name   string
+		source string
+		want   string
+	}{
+		{
+			name:   "gc stress",
+			source: "// gc: stress\nprint 1; // expect: 1\n",
+			want:   "test/string/hook.lox: // gc: stress needs -gc-stress-setup, the statement enabling GC stress on the VM, e.g. vm.set_gc_stress(true);",
+		},
+		{
+			name:   "input",
+			source: "// input: 1\nprint 1; // expect: 1\n",
+			want:   "test/string/hook.lox: // input: needs -stdin-setup, the statement giving the VM its standard input, e.g. vm.set_input({input});",
+		},
+		{
+			name:   "compile error",
+			source: "var = 1; // expect compile error: Expect variable name.\n",
+			want:   "test/string/hook.lox:1: // expect compile error: needs -compile-entry, the expression compiling the source without running it, e.g. vm.compile(source)",
+		},
+		{
+			name:   "streams",
+			source: "print 1; // expect out: 1\n",
+			want:   "test/string/hook.lox:1: // expect out: and // expect err: need -merged-output-accessor, the expression for the VM's merged output, e.g. vm.output_log",
+		},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			opts := loxgen.DefaultOptions()
+			opts.IncludePatterns = "*"
+			suite, err := loxgen.Parse(testTree(map[string]string{"string/hook.lox": test.source}), opts)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if _, err := loxgen.Emit(suite, opts); err == nil || err.Error() != test.want {
+				t.Errorf("got error %v, want %q", err, test.want)
+			}
+		})
+	}
+}
+
+func TestMapOut(t *testing.T) {
+	files := map[string]string{
+		"string/a.lox":        "print 1; // expect: 1\n",
+		"string/b.lox":        "nil.x; // expect runtime error: Only instances have properties.\n",
+		"bool/nested/c.lox":   "print true; // expect: true\n",
+		"closure/closure.lox": "print nil; // expect: nil\n",
+	}
+	directory := t.TempDir()
+	opts := loxgen.DefaultOptions()
+	opts.IncludePatterns = "*"
+	opts.OutputFilePath = filepath.Join(directory, "tests.rs")
+	opts.MapOut = filepath.Join(directory, "tests.map.json")
+	generator, err := loxgen.New(opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+	captureLog(t)
+	if err := generator.Generate(testTree(files), ""); err != nil {
+		t.Fatal(err)
+	}
+
+	data, err := os.ReadFile(opts.MapOut)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var entries []struct {
+		Name   string
+		Source string
+		Line   int
+	}
+	if err := json.Unmarshal(data, &entries); err != nil {
+		t.Fatal(err)
+	}
+	output, err := os.ReadFile(opts.OutputFilePath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	lines := strings.Split(string(output), "\n")
+	sources := make(map[string]string)
+	for _, entry := range entries {
+		function := entry.Name[strings.LastIndex(entry.Name, "::")+2:]
+		sources[function] = entry.Source
+		if entry.Line < 1 || entry.Line >= len(lines) || strings.TrimSpace(lines[entry.Line-1]) != "#[test]" {
+			t.Errorf("%s: line %d is not a #[test]", entry.Name, entry.Line)
+		} else if !strings.Contains(lines[entry.Line], "fn "+function+"()") {
+			t.Errorf("%s: line %d is followed by %s", entry.Name, entry.Line, lines[entry.Line])
+		}
+	}
+	functions := testFunctionName.FindAllStringSubmatch(string(output), -1)
+	if len(functions) != len(files) {
+		t.Fatalf("expected %d test functions, got %d", len(files), len(functions))
+	}
+	for _, function := range functions {
+		source, ok := sources[function[1]+"_test"]
+		if !ok {
+			t.Errorf("%s_test is not in the map", function[1])
+			continue
+		}
+		if _, ok := files[strings.TrimPrefix(source, "test/")]; !ok || path.Base(source) != function[1]+".lox" {
+			t.Errorf("%s_test is mapped to %s", function[1], source)
+		}
+	}
+}
+
+func TestCompileError(t *testing.T) {
+	files := map[string]string{
+		"string/compile.lox": "var = 1; // expect compile error: Expect variable name.\n",
+		"string/runtime.lox": "nil.x; // expect runtime error: Only instances have properties.\n",
+	}
+	tests := []struct {
+		name       string
+		entryPoint string
+	}{
+		{"compile", "vm.compile(source)"},
+		{"custom", "vm.compile_only(&source)"},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			output := generate(t, files, func(opts *loxgen.Options) {
+				opts.CompileEntryPoint = test.entryPoint
+			})
+			compile := testFunction(output, "compile_test")
+			if !containsLines(compile,
+				"let mut vm = VM::new();",
+				"let result = "+test.entryPoint+";",
+				`assert!(result.is_err(), "expected a compile error");`,
+				"assert_eq!(",
+				`"Expect variable name.",`,
+				"vm.latest_error_message",
+			) {
+				t.Errorf("no compile-only assertion\n%s", compile)
+			}
+			if strings.Contains(compile, "interpret") {
+				t.Errorf("compile-only test interprets its source\n%s", compile)
+			}
+			runtime := testFunction(output, "runtime_test")
+			if !containsLines(runtime, "let result = vm.interpret(source);") || strings.Contains(runtime, test.entryPoint) {
+				t.Errorf("runtime error test not interpreted\n%s", runtime)
+			}
+		})
+	}
+}
+
+func TestGroupSize(t *testing.T) {
+	tests := []struct {
+		tests     int
+		groupSize int
+		parts     []string
+	}{
+		{5, 0, nil},
+		{5, 5, nil},
+		{5, 2, []string{"t1 t2", "t3 t4", "t5"}},
+		{6, 3, []string{"t1 t2 t3", "t4 t5 t6"}},
+		{3, 1, []string{"t1", "t2", "t3"}},
+	}
+	for _, test := range tests {
+		t.Run(fmt.Sprintf("%d by %d", test.tests, test.groupSize), func(t *testing.T) {
+			files := map[string]string{"bool/small.lox": "print true; // expect: true\n"}
+			for i := 1; i <= test.tests; i++ {
+				files[fmt.Sprintf("string/t%d.lox", i)] = "print 1; // expect: 1\n"
+			}
+			output := generate(t, files, func(opts *loxgen.Options) {
+				opts.GroupSize = test.groupSize
+			})
+			// The first piece holds the header and bool_tests, which is never over the size.
+			pieces := strings.Split(output, "pub(crate) mod part")
+			var parts []string
+			for i, piece := range pieces[1:] {
+				if !strings.HasPrefix(piece, fmt.Sprintf("%d {\n", i+1)) || !containsLines(piece, "use super::*;") {
+					t.Errorf("part %d is not a numbered submodule using its parent\n%s", i+1, piece)
+				}
+				var functions []string
+				for _, match := range testFunctionName.FindAllStringSubmatch(piece, -1) {
+					functions = append(functions, match[1])
+				}
+				parts = append(parts, strings.Join(functions, " "))
+			}
+			if strings.Join(parts, ", ") != strings.Join(test.parts, ", ") {
+				t.Errorf("expected parts %q, got %q", test.parts, parts)
+			}
+		})
+	}
+}
+
+func TestInterleavedStreams(t *testing.T) {
+	tests := []struct {
+		name     string
+		accessor string
+		source   string
+		log      string
+	}{
+		{
+			name:     "interleaved",
+			source:   "print 1; // expect out: 1\nfoo(); // expect err: Undefined: foo.\nprint 2; // expect out: 2\n",
+			log:      `vec!["out: 1", "err: Undefined: foo.", "out: 2"],`,
+			accessor: "vm.output_log",
+		},
+		{
+			name:     "custom accessor",
+			source:   "foo(); // expect err: Undefined.\nprint 1; // expect out: 1\n",
+			log:      `vec!["err: Undefined.", "out: 1"],`,
+			accessor: "vm.merged_output()",
+		},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			output := generate(t, map[string]string{"string/streams.lox": test.source}, func(opts *loxgen.Options) {
+				opts.MergedOutputAccessor = test.accessor
+			})
+			function := testFunction(output, "streams_test")
+			if !containsLines(function,
+				fmt.Sprintf(`let log: Vec<String> = %s.iter().map(|(stream, line)| format!("{}: {}", stream, line)).collect();`, test.accessor),
+				"assert_eq!(",
+				test.log,
+				"log",
+			) {
+				t.Errorf("no interleaved assertion against %s\n%s", test.accessor, function)
+			}
+		})
+	}
+}
+
+var profileLine = regexp.MustCompile(`(?m)^  (\w+) +(\S+)$`)
+
+func TestProfile(t *testing.T) {
+	tests := []struct {
+		name       string
+		cpuProfile string
+	}{
+		{"summary", ""},
+		{"cpu profile", "cpu.prof"},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			directory := t.TempDir()
+			if err := os.MkdirAll(filepath.Join(directory, "test", "string"), 0755); err != nil {
+				t.Fatal(err)
+			}
+			if err := os.WriteFile(filepath.Join(directory, "test", "string", "value.lox"), []byte("print 1; // expect: 1\n"), 0644); err != nil {
+				t.Fatal(err)
+			}
+			args := []string{"-include", "*", "-output", "tests.rs", "-profile"}
+			if len(test.cpuProfile) > 0 {
+				args = append(args, "-cpuprofile", test.cpuProfile)
+			}
+			output, err := runMain(t, directory, args...)
+			if err != nil {
+				t.Fatalf("%v\n%s", err, output)
+			}
+			_, profile, ok := strings.Cut(output, "Profile:\n")
+			if !ok {
+				t.Fatalf("no profile\n%s", output)
+			}
+			durations := make(map[string]time.Duration)
+			for _, match := range profileLine.FindAllStringSubmatch(profile, -1) {
+				duration, err := time.ParseDuration(match[2])
+				if err != nil {
+					t.Errorf("%s: %v", match[1], err)
+				}
+				durations[match[1]] = duration
+			}
+			var phases time.Duration
+			for _, phase := range []string{"discovery", "reading", "parsing", "writing"} {
+				duration, ok := durations[phase]
+				if !ok {
+					t.Errorf("no %s phase in\n%s", phase, profile)
+				}
+				phases += duration
+			}
+			if total, ok := durations["total"]; !ok || total < phases {
+				t.Errorf("total is not at least the sum of the phases\n%s", profile)
+			}
+			if len(test.cpuProfile) > 0 {
+				if info, err := os.Stat(filepath.Join(directory, test.cpuProfile)); err != nil || info.Size() == 0 {
+					t.Errorf("no CPU profile written: %v", err)
+				}
+			}
+		})
+	}
+}
+
+func TestFailedCPUProfile(t *testing.T) {
+	directory := t.TempDir()
+	if err := os.MkdirAll(filepath.Join(directory, "test", "string"), 0755); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(filepath.Join(directory, "test", "string", "a.lox"), []byte("print \"a\"; // expect-regex: (\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	output, err := runMain(t, directory, "-include", "*", "-output", "tests.rs", "-cpuprofile", "cpu.prof")
+	if err == nil {
+		t.Fatalf("expected the generator to fail\n%s", output)
+	}
+	if info, err := os.Stat(filepath.Join(directory, "cpu.prof")); err != nil || info.Size() == 0 {
+		t.Errorf("no CPU profile written: %v", err)
+	}
+}
+
+func TestDirectoryDefaults(t *testing.T) {
+	files := map[string]string{
+		"string/_defaults.lox.expect": "// expect no error\n",
+		"string/quiet.lox":            "var x = 1;\n",
+		"string/value.lox":            "print 1; // expect: 1\n",
+		"string/error.lox":            "nil.x; // expect runtime error: Only instances have properties.\n",
+		"string/nested/deeper.lox":    "var y = 1;\n",
+	}
+	output := generate(t, files, nil)
+	tests := []struct {
+		function string
+		expected []string
+		// mustNotError is whether the test fails on any error of interpret, with `?`.
+		mustNotError bool
+	}{
+		{"quiet_test", []string{"let mut vm = VM::new();", "vm.interpret(source)?;", "Ok(())"}, true},
+		{"value_test", []string{"vm.interpret(source)?;", "let printed: Vec<String> = vm.printed_values.iter().map(|v| v.to_string()).collect();"}, true},
+		{"error_test", []string{"let result = vm.interpret(source);", `assert!(matches!(result, Err(VMError::RuntimeError)), "expected a runtime error, got {:?}", result);`}, false},
+		{"deeper_test", []string{"let mut vm = VM::new();", "Ok(())"}, false},
+	}
+	for _, test := range tests {
+		function := testFunction(output, test.function)
+		if !containsLines(function, test.expected...) {
+			t.Errorf("%s: expected %q in\n%s", test.function, test.expected, function)
+		}
+		if mustNotError := strings.Contains(function, "vm.interpret(source)?;"); mustNotError != test.mustNotError {
+			t.Errorf("%s: must not error is %t, expected %t\n%s", test.function, mustNotError, test.mustNotError, function)
+		}
+	}
+}
+
+func TestSnapshotOutput(t *testing.T) {
+	tests := []struct {
+		name          string
+		printedValues string
+	}{
+		{"default", "vm.printed_values"},
+		{"custom buffer", "vm.output()"},
+	}
+	files := map[string]string{"string/values.lox": "print 1; // expect: 1\nprint 2; // expect: 2\n"}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			function := testFunction(generate(t, files, func(opts *loxgen.Options) {
+				opts.PrintedValues = test.printedValues
+			}), "values_test")
+			if !containsLines(function,
+				"vm.interpret(source)?;",
+				fmt.Sprintf("let printed: Vec<String> = %s.iter().map(|v| v.to_string()).collect();", test.printedValues),
+				"assert_eq!(",
+				`"1",`,
+				"printed[0]",
+				");",
+				"assert_eq!(",
+				`"2",`,
+				"printed[1]",
+			) {
+				t.Errorf("no assertions against a snapshot of %s\n%s", test.printedValues, function)
+			}
+			if strings.Contains(function, ".pop()") || strings.Count(function, test.printedValues) != 1 {
+				t.Errorf("VM buffer used beyond the snapshot\n%s", function)
+			}
+		})
+	}
+}
+
+func TestRequireMarker(t *testing.T) {
+	tests := []struct {
+		name   string
+		source string
+		// The error generating fails with, or the assertion the test is emitted with.
+		want []string
+		fail bool
+	}{
+		{"no marker", "var x = 1;\n", []string{"test/string/program.lox: no expectation, error marker or // no-output directive"}, true},
+		{"no-output", "// no-output\nvar x = 1;\n", []string{"vm.interpret(source)?;", "assert_eq!(", "0,", "vm.printed_values.len()", ");"}, false},
+		{"expectation", "print 1; // expect: 1\n", []string{"assert_eq!(", `"1",`, "printed[0]"}, false},
+	}
+	files := map[string]string{"string/other.lox": "print 1; // expect: 1\n"}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			files["string/program.lox"] = test.source
+			opts := loxgen.DefaultOptions()
+			opts.IncludePatterns = "*"
+			opts.RequireMarker = true
+			suite, err := loxgen.Parse(testTree(files), opts)
+			var output []byte
+			if err == nil {
+				output, err = loxgen.Emit(suite, opts)
+			}
+			if test.fail {
+				if err == nil || err.Error() != test.want[0] {
+					t.Errorf("got error %v, want %q", err, test.want[0])
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			if function := testFunction(string(output), "program_test"); !containsLines(function, test.want...) {
+				t.Errorf("expected %q in\n%s", test.want, function)
+			}
+		})
+	}
+}
+
+// reversedFS lists every directory in reverse name order, as no file system has to list
+// them in any order.
+type reversedFS struct {
+	fstest.MapFS
+}
+
+func (r reversedFS) ReadDir(name string) ([]fs.DirEntry, error) {
+	entries, err := r.MapFS.ReadDir(name)
+	sort.SliceStable(entries, func(i, j int) bool { return entries[i].Name() > entries[j].Name() })
+	return entries, err
+}
+
+func TestListingOrder(t *testing.T) {
+	files := map[string]string{
+		"beta/lower.lox":   "print 1; // expect: 1\n",
+		"beta/Upper.lox":   "print 1; // expect: 1\n",
+		"beta/a2.lox":      "print 1; // expect: 1\n",
+		"beta/a10.lox":     "print 1; // expect: 1\n",
+		"alpha/only.lox":   "print 1; // expect: 1\n",
+		"Zeta/zeta.lox":    "print 1; // expect: 1\n",
+		"Zeta/inner/x.lox": "print 1; // expect: 1\n",
+	}
+	// Byte order: upper case before lower case and "a10" before "a2", by module then file.
+	directories := []string{"Zeta", "alpha", "beta"}
+	paths := []string{"Zeta/zeta.lox", "Zeta/inner/x.lox", "alpha/only.lox", "beta/Upper.lox", "beta/a10.lox", "beta/a2.lox", "beta/lower.lox"}
+	opts := loxgen.DefaultOptions()
+	opts.IncludePatterns = "*"
+
+	var outputs []string
+	for _, tree := range []fs.FS{testTree(files), reversedFS{testTree(files)}} {
+		suite, err := loxgen.Parse(tree, opts)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if strings.Join(suite.Directories, " ") != strings.Join(directories, " ") {
+			t.Errorf("expected directories %q, got %q", directories, suite.Directories)
+		}
+		var listed []string
+		for _, test := range suite.Tests {
+			listed = append(listed, strings.TrimPrefix(test.Path, "test/"))
+		}
+		if strings.Join(listed, " ") != strings.Join(paths, " ") {
+			t.Errorf("expected tests %q, got %q", paths, listed)
+		}
+		outputs = append(outputs, emit(t, tree, opts))
+	}
+	if outputs[0] != outputs[1] {
+		t.Errorf("output depends on the listing order\n%s\n%s", outputs[0], outputs[1])
+	}
+}
+
+func TestInputFileSystem(t *testing.T) {
+	files := map[string]string{
+		"string/values.lox": "print 1; // expect: 1\nprint \"a: b\"; // expect: a: b\n",
+		"string/error.lox":  "nil.x; // expect runtime error: Only instances have properties.\n",
+		"bool/nested/x.lox": "print true; // expect: true\n",
+	}
+	directory := t.TempDir()
+	for file, source := range files {
+		path := filepath.Join(directory, "suite", file)
+		if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+			t.Fatal(err)
+		}
+		if err := os.WriteFile(path, []byte(source), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	// As an embed.FS would hold it, under the directory it was embedded from.
+	embedded := make(map[string]string)
+	for file, source := range files {
+		embedded["testdata/suite/"+file] = source
+	}
+	sub, err := fs.Sub(testTree(embedded), "testdata/suite")
+	if err != nil {
+		t.Fatal(err)
+	}
+	trees := []struct {
+		name string
+		tree fs.FS
+	}{
+		{"directory", os.DirFS(filepath.Join(directory, "suite"))},
+		{"sub tree", sub},
+		{"archive", openArchive(t, "zip", archive(t, "zip", files))},
+	}
+
+	opts := loxgen.DefaultOptions()
+	opts.IncludePatterns = "*"
+	want := emit(t, testTree(files), opts)
+	if !containsLines(testFunction(want, "values_test"), `"a: b",`, "printed[1]") {
+		t.Fatalf("in-memory tree not generated\n%s", want)
+	}
+	for _, tree := range trees {
+		t.Run(tree.name, func(t *testing.T) {
+			if output := emit(t, tree.tree, opts); output != want {
+				t.Errorf("expected the output of the in-memory tree\n%s\ngot\n%s", want, output)
+			}
+		})
+	}
+
+	t.Run("ignored directory", func(t *testing.T) {
+		opts := opts
+		opts.ExcludePatterns = "bool"
+		opts.IgnoreExcluded = true
+		output := emit(t, testTree(files), opts)
+		if !containsLines(output, `#[ignore = "bool is left out by -exclude"]`, "fn x_test() -> VMResult {") {
+			t.Errorf("expected the excluded directory to be ignored\n%s", output)
+		}
+	})
+
+	t.Run("Generate", func(t *testing.T) {
+		opts := opts
+		// Nothing is read from the input directory, which does not exist.
+		opts.InputDirectory = filepath.Join(directory, "missing")
+		opts.OutputFilePath = filepath.Join(directory, "tests.rs")
+		generator, err := loxgen.New(opts)
+		if err != nil {
+			t.Fatal(err)
+		}
+		captureLog(t)
+		if err := generator.Generate(testTree(files), ""); err != nil {
+			t.Fatal(err)
+		}
+		output, err := os.ReadFile(opts.OutputFilePath)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if generated := testFunctionName.FindAllString(string(output), -1); len(generated) != len(files) {
+			t.Errorf("expected %d tests, got %q", len(files), generated)
+		}
+	})
+}
+
+func TestMutate(t *testing.T) {
+	directory := t.TempDir()
+	writeFiles(t, directory, map[string]string{
+		"suite/string/a.lox": "print \"a\"; // expect: a\n",
+		"suite/string/b.lox": "print \"b\"; // expect: b\n",
+		"known_failures.txt": "string/b.lox\n",
+	})
+	// Prints a for every program, b.lox fails as expected. The mutant changing the string
+	// runs until its timeout.
+	rlox := fakeRlox(t, directory, `grep -q '"ax"' "$1" && exec sleep 30
+grep -q print "$1" && echo a
+exit 0
+`)
+	output, err := runMain(t, directory, "-input", "suite", "-include", "*", "-rlox", rlox,
+		"-known-failures", "known_failures.txt", "mutate")
+	if err != nil {
+		t.Fatalf("%v\n%s", err, output)
+	}
+	if !strings.Contains(output, "skipping suite/string/b.lox, it is a known failure.") {
+		t.Errorf("mutants of a known failure run\n%s", output)
+	}
+	if !strings.Contains(output, "2 mutant(s) of 1 test(s): 2 killed (1 timed out), 0 survived.") {
+		t.Errorf("expected both mutants of a.lox killed\n%s", output)
+	}
+}
+
+func TestRawStringHashes(t *testing.T) {
+	tests := []struct {
+		name   string
+		source string
+		hashes string
+	}{
+		{"quote", `print "a"; // expect: a`, "#"},
+		{"quote and hash", `print "#"; // expect: #`, "##"},
+		{"quote and two hashes", `print "##"; // expect: ##`, "###"},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			directory := t.TempDir()
+			opts := loxgen.DefaultOptions()
+			opts.IncludePatterns = "string"
+			opts.SummaryTest = true
+			opts.OutputFilePath = filepath.Join(directory, "tests.rs")
+			opts.BenchesPath = filepath.Join(directory, "benches.rs")
+			generator, err := loxgen.New(opts)
+			if err != nil {
+				t.Fatal(err)
+			}
+			captureLog(t)
+			files := map[string]string{"string/quoted.lox": test.source + "\n", "benchmark/quoted.lox": test.source + "\n"}
+			if err := generator.Generate(testTree(files), ""); err != nil {
+				t.Fatal(err)
+			}
+			output, err := os.ReadFile(opts.OutputFilePath)
+			if err != nil {
+				t.Fatal(err)
+			}
+			benches, err := os.ReadFile(opts.BenchesPath)
+			if err != nil {
+				t.Fatal(err)
+			}
+			for _, source := range []struct {
+				name string
+				text string
+				// The lines of the raw string literal, the closing one ending with what follows it.
+				lines []string
+			}{
+				{"test", testFunction(string(output), "quoted_test"), []string{"let source = r" + test.hashes + `"`, test.source, `"` + test.hashes}},
+				{"summary case", testFunction(string(output), "conformance_summary"), []string{"r" + test.hashes + `"`, test.source, `"` + test.hashes + ","}},
+				{"benchmark", string(benches), []string{"let source = r" + test.hashes + `"`, test.source, `"` + test.hashes + ";"}},
+			} {
+				if !containsLines(source.text, source.lines...) {
+					t.Errorf("%s not delimited with %s\n%s", source.name, test.hashes, source.text)
+				}
+			}
+		})
+	}
+}
+
+func TestCache(t *testing.T) {
+	directory := t.TempDir()
+	writeFiles(t, directory, map[string]string{
+		"suite/string/a.lox":         "print 1; // expect: 1\n",
+		"suite/bool/b.lox":           "print true; // expect: true\n",
+		"reference/string/a.lox.ref": "1\n",
+		"reference/bool/b.lox.ref":   "true\n",
+	})
+	opts := loxgen.DefaultOptions()
+	opts.IncludePatterns = "*"
+	opts.InputDirectory = filepath.Join(directory, "suite")
+	opts.SplitOutput = filepath.Join(directory, "tests")
+	opts.CachePath = filepath.Join(directory, "cache.json")
+	opts.ReferenceDirectory = filepath.Join(directory, "reference")
+	captureLog(t)
+	generate := func() {
+		t.Helper()
+		generator, err := loxgen.New(opts)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err := generator.Generate(os.DirFS(opts.InputDirectory), ""); err != nil {
+			t.Fatal(err)
+		}
+	}
+	// A module file that is not written again keeps the line added to it.
+	const kept = "// not written again\n"
+	markModules := func() {
+		t.Helper()
+		for _, module := range []string{"string.rs", "bool.rs"} {
+			path := filepath.Join(opts.SplitOutput, module)
+			data, err := os.ReadFile(path)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if err := os.WriteFile(path, append(data, kept...), 0644); err != nil {
+				t.Fatal(err)
+			}
+		}
+	}
+	checkWritten := func(step string, want map[string]bool) {
+		t.Helper()
+		for module, written := range want {
+			data, err := os.ReadFile(filepath.Join(opts.SplitOutput, module))
+			if err != nil {
+				t.Fatal(err)
+			}
+			if strings.HasSuffix(string(data), kept) == written {
+				t.Errorf("%s: %s written: %v, want %v", step, module, !written, written)
+			}
+		}
+	}
+
+	generate()
+	markModules()
+	generate()
+	checkWritten("unchanged", map[string]bool{"string.rs": false, "bool.rs": false})
+
+	writeFiles(t, directory, map[string]string{"suite/string/a.lox": "// changed\nprint 1; // expect: 1\n"})
+	markModules()
+	generate()
+	checkWritten("input changed", map[string]bool{"string.rs": true, "bool.rs": false})
+
+	writeFiles(t, directory, map[string]string{"reference/bool/b.lox.ref": "false\n"})
+	markModules()
+	generate()
+	checkWritten("reference changed", map[string]bool{"string.rs": false, "bool.rs": true})
+}
+
+func TestSplitOutput(t *testing.T) {
+	directory := t.TempDir()
+	writeFiles(t, directory, map[string]string{
+		"suite/string/a.lox":      "print 1; // expect: 1\n",
+		"suite/bool/b.lox":        "print true; // expect: true\n",
+		"suite/bool/nested/c.lox": "print false; // expect: false\n",
+		"tests/helpers.rs":        "// Written by hand.\n",
+		"tests/removed.rs.orig":   loxgen.GENERATED_MARKER + "\n",
+	})
+	opts := loxgen.DefaultOptions()
+	opts.IncludePatterns = "*"
+	opts.InputDirectory = filepath.Join(directory, "suite")
+	opts.SplitOutput = filepath.Join(directory, "tests")
+	captureLog(t)
+	generate := func() {
+		t.Helper()
+		generator, err := loxgen.New(opts)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err := generator.Generate(os.DirFS(opts.InputDirectory), ""); err != nil {
+			t.Fatal(err)
+		}
+	}
+	read := func(file string) string {
+		t.Helper()
+		data, err := os.ReadFile(filepath.Join(opts.SplitOutput, file))
+		if err != nil {
+			t.Fatal(err)
+		}
+		return string(data)
+	}
+
+	generate()
+	mod := read("mod.rs")
+	for _, module := range []string{"bool", "string"} {
+		if !containsLines(mod, fmt.Sprintf("#[path = %q]", module+".rs"), "mod "+module+"_tests;") {
+			t.Errorf("mod.rs does not declare %s\n%s", module, mod)
+		}
+	}
+	if module := read("string.rs"); testFunction(module, "a_test") == "" || strings.Contains(module, "b_test") {
+		t.Errorf("string.rs does not only have the string tests\n%s", module)
+	}
+	if module := read("bool.rs"); testFunction(module, "b_test") == "" || !containsLines(module, "pub(crate) mod nested_tests {") || testFunction(module, "c_test") == "" {
+		t.Errorf("bool.rs does not have the bool tests and their nested module\n%s", module)
+	}
+
+	// The module file of a directory that is gone is removed, but not the files written by hand.
+	if err := os.RemoveAll(filepath.Join(opts.InputDirectory, "string")); err != nil {
+		t.Fatal(err)
+	}
+	generate()
+	if _, err := os.Stat(filepath.Join(opts.SplitOutput, "string.rs")); !errors.Is(err, fs.ErrNotExist) {
+		t.Errorf("string.rs not removed: %v", err)
+	}
+	if mod := read("mod.rs"); strings.Contains(mod, "string") {
+		t.Errorf("mod.rs still declares string\n%s", mod)
+	}
+	for _, file := range []string{"bool.rs", "helpers.rs", "removed.rs.orig"} {
+		read(file)
+	}
+}
+
+func TestDryRun(t *testing.T) {
+	var source strings.Builder
+	for i := 1; i <= 10; i++ {
+		fmt.Fprintf(&source, "print %d; // expect: %d\n", i, i)
+	}
+	directory := t.TempDir()
+	writeFiles(t, directory, map[string]string{"test/string/a.lox": source.String()})
+	args := []string{"-include", "*", "-output", "tests.rs"}
+	if output, err := runMain(t, directory, args...); err != nil {
+		t.Fatalf("%v\n%s", err, output)
+	}
+	data, err := os.ReadFile(filepath.Join(directory, "tests.rs"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	generated := strings.SplitAfter(string(data), "\n")
+	generated = generated[:len(generated)-1]
+	// changed returns the generated file with some of its lines, numbered from 1, changed.
+	changed := func(lines ...int) string {
+		current := append([]string(nil), generated...)
+		for _, line := range lines {
+			current[line-1] = "changed\n"
+		}
+		return strings.Join(current, "")
+	}
+	last := len(generated)
+	tests := []struct {
+		name    string
+		current string
+		diff    []string
+	}{
+		{"up to date", string(data), nil},
+		{"one change", changed(5), []string{"@@ -2,7 +2,7 @@", "-changed", "+" + strings.TrimSuffix(generated[4], "\n")}},
+		{"close changes", changed(5, 12), []string{"@@ -2,14 +2,14 @@"}},
+		{"distant changes", changed(5, 13), []string{"@@ -2,7 +2,7 @@", "@@ -10,7 +10,7 @@"}},
+		{"no newline", strings.TrimSuffix(string(data), "\n"), []string{
+			fmt.Sprintf("@@ -%d,4 +%d,4 @@", last-3, last-3),
+			"-" + strings.TrimSuffix(generated[last-1], "\n"),
+			`\ No newline at end of file`,
+			"+" + strings.TrimSuffix(generated[last-1], "\n"),
+		}},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			path := filepath.Join(directory, "tests.rs")
+			if err := os.WriteFile(path, []byte(test.current), 0644); err != nil {
+				t.Fatal(err)
+			}
+			output, err := runMain(t, directory, append(args, "-dry-run")...)
+			if err != nil {
+				t.Fatalf("%v\n%s", err, output)
+			}
+			var diff []string
+			for _, line := range strings.Split(output, "\n") {
+				if strings.HasPrefix(line, "@@") || strings.HasPrefix(line, "+") || strings.HasPrefix(line, "-") || strings.HasPrefix(line, `\`) {
+					diff = append(diff, line)
+				}
+			}
+			if test.diff == nil {
+				if len(diff) > 0 {
+					t.Errorf("expected no diff, got\n%s", output)
+				}
+			} else if len(diff) < 2 || diff[0] != "--- tests.rs" || diff[1] != "+++ tests.rs" {
+				t.Errorf("expected the diff of tests.rs, got\n%s", output)
+			} else {
+				var hunks []string
+				for _, line := range diff[2:] {
+					if strings.HasPrefix(line, "@@") {
+						hunks = append(hunks, line)
+					}
+				}
+				if wantHunks := strings.HasPrefix(test.diff[len(test.diff)-1], "@@"); wantHunks && strings.Join(hunks, "\n") != strings.Join(test.diff, "\n") {
+					t.Errorf("got hunks\n%s\nwant\n%s", strings.Join(hunks, "\n"), strings.Join(test.diff, "\n"))
+				} else if !wantHunks && strings.Join(diff[2:], "\n") != strings.Join(test.diff, "\n") {
+					t.Errorf("got diff\n%s\nwant\n%s", strings.Join(diff[2:], "\n"), strings.Join(test.diff, "\n"))
+				}
+			}
+			current, err := os.ReadFile(path)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if string(current) != test.current {
+				t.Errorf("tests.rs written by -dry-run")
+			}
+		})
+	}
+}
+
+func TestCheck(t *testing.T) {
+	files := map[string]string{
+		"test/string/a.lox": "print 1; // expect: 1\n",
+		"test/bool/b.lox":   "print true; // expect: true\n",
+	}
+	tests := []struct {
+		name   string
+		output []string
+		// change edits the generated files, or the input, before -check runs.
+		change func(directory string) error
+		stale  []string
+	}{
+		{"up to date", []string{"-output", "tests.rs"}, nil, nil},
+		{"edited", []string{"-output", "tests.rs"}, func(directory string) error {
+			return os.WriteFile(filepath.Join(directory, "tests.rs"), []byte("edited\n"), 0644)
+		}, []string{"tests.rs"}},
+		{"missing", []string{"-output", "tests.rs"}, func(directory string) error {
+			return os.Remove(filepath.Join(directory, "tests.rs"))
+		}, []string{"tests.rs"}},
+		{"input changed", []string{"-split-output", "tests"}, func(directory string) error {
+			return os.WriteFile(filepath.Join(directory, "test", "string", "a.lox"), []byte("print 2; // expect: 2\n"), 0644)
+		}, []string{filepath.Join("tests", "mod.rs"), filepath.Join("tests", "string.rs")}},
+		{"directory removed", []string{"-split-output", "tests"}, func(directory string) error {
+			return os.RemoveAll(filepath.Join(directory, "test", "string"))
+		}, []string{filepath.Join("tests", "mod.rs"), filepath.Join("tests", "string.rs")}},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			directory := t.TempDir()
+			writeFiles(t, directory, files)
+			args := append([]string{"-include", "*"}, test.output...)
+			if output, err := runMain(t, directory, args...); err != nil {
+				t.Fatalf("%v\n%s", err, output)
+			}
+			if test.change != nil {
+				if err := test.change(directory); err != nil {
+					t.Fatal(err)
+				}
+			}
+			output, err := runMain(t, directory, append(args, "-check")...)
+			if len(test.stale) == 0 {
+				if err != nil {
+					t.Errorf("expected the files to be up to date, got %v\n%s", err, output)
+				}
+				return
+			}
+			if err == nil {
+				t.Fatalf("expected -check to fail\n%s", output)
+			}
+			if want := fmt.Sprintf("%d generated file(s) out of date", len(test.stale)); !strings.Contains(output, want) {
+				t.Errorf("expected %q, got\n%s", want, output)
+			}
+			if !containsLines(output, test.stale...) {
+				t.Errorf("expected the stale files %v, got\n%s", test.stale, output)
+			}
+		})
+	}
+}
+
+func TestExitStatus(t *testing.T) {
+	tests := []struct {
+		name     string
+		source   string
+		expected []string
+	}{
+		{"success", "var a = 1; // expect exit: 0\n", []string{"vm.interpret(source)?;"}},
+		{"compile error", "var; // expect exit: 65\n", []string{
+			"let result = vm.interpret(source);",
+			`assert!(matches!(result, Err(VMError::CompileError)), "expected a compile error, got {:?}", result);`,
+		}},
+		{"runtime error after values", "print 1; // expect: 1\nnil.x; // expect exit: 70\n", []string{
+			"let result = vm.interpret(source);",
+			`assert!(matches!(result, Err(VMError::RuntimeError)), "expected a runtime error, got {:?}", result);`,
+		}},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			output := generate(t, map[string]string{"string/exit.lox": test.source}, nil)
+			if function := testFunction(output, "exit_test"); !containsLines(function, test.expected...) {
+				t.Errorf("expected\n%s\ngot\n%s", strings.Join(test.expected, "\n"), function)
+			}
+		})
+	}
+
+	invalid := []struct {
+		name   string
+		source string
+		want   string
+	}{
+		{"unknown status", "print 1;\n// expect exit: 3\n", `test/string/exit.lox:2: invalid exit status "3", expected 0, 65 or 70`},
+		{"success and an error", "nil.x; // expect runtime error: Only instances have properties.\n// expect exit: 0\n",
+			"test/string/exit.lox:2: expects exit status 0, but also an error"},
+		{"other kind of error", "var; // expect compile error: Expect variable name.\n// expect exit: 70\n",
+			"test/string/exit.lox:2: expects exit status 70, but the error comment is not a runtime error"},
+	}
+	for _, test := range invalid {
+		t.Run(test.name, func(t *testing.T) {
+			opts := loxgen.DefaultOptions()
+			opts.IncludePatterns = "*"
+			_, err := loxgen.Parse(testTree(map[string]string{"string/exit.lox": test.source}), opts)
+			if err == nil || err.Error() != test.want {
+				t.Errorf("got error %v, want %q", err, test.want)
+			}
+		})
+	}
+}
+
+func TestRun(t *testing.T) {
+	files := map[string]string{
+		"suite/string/pass.lox":   "print 1; // expect: 1\n",
+		"suite/string/fail.lox":   "print 2; // expect: 2\n",
+		"suite/string/known.lox":  "print 4; // expect: 4\n",
+		"suite/string/fixed.lox":  "print 6; // expect: 6\n",
+		"suite/string/flaky.lox":  "// flaky\nprint 5; // expect: 5\n",
+		"suite/string/silent.lox": "var a = 1; // expect exit: 0\n",
+		"known_failures.txt":      "string/known.lox\nstring/fixed.lox\n",
+	}
+	// The flaky test prints the wrong value the first time it is run.
+	script := `case "$1" in
+*/pass-*) echo 1 ;;
+*/fail-*) echo 3 ;;
+*/known-*) echo wrong ;;
+*/fixed-*) echo 6 ;;
+*/flaky-*) if [ -e "$0.flaky" ]; then echo 5; else touch "$0.flaky"; echo 0; fi ;;
+*/silent-*) echo stray ;;
+esac
+`
+	const summary = "2 passed (1 flaky), 1 known failure(s), 3 failed."
+	failures := map[string]string{
+		"fail":   `expected the output ["2"], got ["3"]`,
+		"fixed":  "passed unexpectedly, remove it from known_failures.txt",
+		"silent": `expected the output [], got ["stray"]`,
+	}
+	tests := []struct {
+		name     string
+		args     []string
+		expected []string
+	}{
+		{"text", nil, []string{
+			"PASS suite/string/pass.lox",
+			"FAIL suite/string/fail.lox: " + failures["fail"],
+			"FAIL suite/string/fixed.lox: " + failures["fixed"],
+			"FAIL suite/string/silent.lox: " + failures["silent"],
+			`XFAIL suite/string/known.lox: expected the output ["4"], got ["wrong"]`,
+			`FLAKY suite/string/flaky.lox: passed on attempt 2, after expected the output ["5"], got ["0"]`,
+			summary,
+		}},
+		{"tap", []string{"-format", "tap"}, []string{
+			"TAP version 13",
+			"1..6",
+			"not ok 1 - suite/string/fail.lox",
+			"not ok 2 - suite/string/fixed.lox",
+			"ok 3 - suite/string/flaky.lox (flaky, passed on attempt 2)",
+			`not ok 4 - suite/string/known.lox # TODO known failure: expected the output ["4"], got ["wrong"]`,
+			"ok 5 - suite/string/pass.lox",
+			"not ok 6 - suite/string/silent.lox",
+			"message: " + strconv.Quote(failures["silent"]),
+			"# " + summary,
+		}},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			directory := t.TempDir()
+			writeFiles(t, directory, files)
+			rlox := fakeRlox(t, directory, script)
+			args := append([]string{"-input", "suite", "-include", "*", "-rlox", rlox, "-known-failures", "known_failures.txt",
+				"-junit", "junit.xml", "-html", "report.html"}, test.args...)
+			output, err := runMain(t, directory, append(args, "run")...)
+			if err == nil {
+				t.Errorf("expected the run to fail\n%s", output)
+			}
+			for _, line := range test.expected {
+				if !containsLines(output, line) {
+					t.Errorf("expected %q in\n%s", line, output)
+				}
+			}
+
+			data, err := os.ReadFile(filepath.Join(directory, "junit.xml"))
+			if err != nil {
+				t.Fatal(err)
+			}
+			var report struct {
+				Suites []struct {
+					Name     string `xml:"name,attr"`
+					Tests    int    `xml:"tests,attr"`
+					Failures int    `xml:"failures,attr"`
+					Skipped  int    `xml:"skipped,attr"`
+					Cases    []struct {
+						Name    string `xml:"name,attr"`
+						File    string `xml:"file,attr"`
+						Failure *struct {
+							Message string `xml:"message,attr"`
+							Body    string `xml:",chardata"`
+						} `xml:"failure"`
+						Skipped *struct {
+							Message string `xml:"message,attr"`
+						} `xml:"skipped"`
+						FlakyFailures []struct {
+							Message string `xml:"message,attr"`
+						} `xml:"flakyFailure"`
+					} `xml:"testcase"`
+				} `xml:"testsuite"`
+			}
+			if err := xml.Unmarshal(data, &report); err != nil {
+				t.Fatal(err)
+			}
+			if len(report.Suites) != 1 || report.Suites[0].Name != "string" || report.Suites[0].Tests != 6 ||
+				report.Suites[0].Failures != 3 || report.Suites[0].Skipped != 1 {
+				t.Fatalf("unexpected JUnit suites\n%s", data)
+			}
+			for _, testCase := range report.Suites[0].Cases {
+				name := strings.TrimSuffix(path.Base(testCase.File), ".lox")
+				switch {
+				case failures[name] != "":
+					if testCase.Failure == nil || testCase.Failure.Message != failures[name] {
+						t.Errorf("%s: expected the failure %q\n%s", name, failures[name], data)
+					}
+				case name == "known":
+					if testCase.Skipped == nil || !strings.HasPrefix(testCase.Skipped.Message, "known failure: ") {
+						t.Errorf("known: expected to be skipped as a known failure\n%s", data)
+					}
+				case name == "flaky":
+					if testCase.Failure != nil || len(testCase.FlakyFailures) != 1 {
+						t.Errorf("flaky: expected one flaky failure\n%s", data)
+					}
+				case testCase.Failure != nil || testCase.Skipped != nil || len(testCase.FlakyFailures) > 0:
+					t.Errorf("%s: expected to pass\n%s", name, data)
+				}
+			}
+			if fail := report.Suites[0].Cases[0]; fail.Failure == nil || !strings.Contains(fail.Failure.Body, "- 2\n+ 3\n") {
+				t.Errorf("expected the diff of the output in the failure\n%s", data)
+			}
+
+			data, err = os.ReadFile(filepath.Join(directory, "report.html"))
+			if err != nil {
+				t.Fatal(err)
+			}
+			page := string(data)
+			for name, class := range map[string]string{
+				"pass": "pass", "fail": "fail", "fixed": "fail", "silent": "fail", "known": "xfail", "flaky": "flaky",
+			} {
+				open := ""
+				if class == "fail" {
+					open = " open"
+				}
+				if want := fmt.Sprintf("<details class=%q%s>\n<summary>suite/string/%s.lox", class, open, name); !strings.Contains(page, want) {
+					t.Errorf("expected %q in the HTML report", want)
+				}
+			}
+			if !strings.Contains(page, "<p>2 passed, 3 failed.</p>") || !strings.Contains(page, `<span class="removed">- 2</span>`) {
+				t.Errorf("expected the counts and the diff in the HTML report\n%s", page)
+			}
+		})
+	}
+}
+
+func TestErrorAtEnd(t *testing.T) {
+	tests := []struct {
+		name    string
+		source  string
+		message string
+	}{
+		{"at end", "{\n  print 1;\n// [line 3] Error at end: Expect '}' after block.\n", "Expect '}' after block."},
+		{"unterminated string", "\"unterminated\n// [line 2] Error: Unterminated string.\n", "Unterminated string."},
+		{"lexeme with a colon", "print \"a: b\" \"c\"; // [line 1] Error at '\"c\"': Expect ';' after value.\n", "Expect ';' after value."},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			output := generate(t, map[string]string{"block/error.lox": test.source}, nil)
+			expected := []string{
+				`assert!(matches!(result, Err(VMError::CompileError)), "expected a compile error, got {:?}", result);`,
+				"assert_eq!(",
+				fmt.Sprintf("%q,", test.message),
+				"vm.latest_error_message",
+			}
+			if function := testFunction(output, "error_test"); !containsLines(function, expected...) {
+				t.Errorf("expected\n%s\ngot\n%s", strings.Join(expected, "\n"), function)
+			}
+		})
+	}
+
+	// The runner only checks that the error is reported at the end, whatever the lexeme is quoted like.
+	runs := []struct {
+		name    string
+		stderr  string
+		problem string
+	}{
+		{"at end", "[line 3] Error at end: Expect '}' after block.", ""},
+		{"at a lexeme", "[line 3] Error at '}': Expect '}' after block.", `expected the error "Expect '}' after block." at end`},
+	}
+	for _, run := range runs {
+		t.Run("run "+run.name, func(t *testing.T) {
+			directory := t.TempDir()
+			writeFiles(t, directory, map[string]string{"suite/block/error.lox": tests[0].source})
+			rlox := fakeRlox(t, directory, fmt.Sprintf("cat >&2 <<'EOF'\n%s\nEOF\nexit 65\n", run.stderr))
+			output, err := runMain(t, directory, "-input", "suite", "-include", "*", "-rlox", rlox, "run")
+			if len(run.problem) == 0 {
+				if err != nil || !containsLines(output, "PASS suite/block/error.lox") {
+					t.Errorf("got %v, want the run to pass\n%s", err, output)
+				}
+			} else if err == nil || !strings.Contains(output, "FAIL suite/block/error.lox: "+run.problem) {
+				t.Errorf("got %v, want the run to fail with %q\n%s", err, run.problem, output)
+			}
+		})
+	}
+}
+
+func TestStackTrace(t *testing.T) {
+	source := "fun f() {\n  nil.x; // expect runtime error: Only instances have properties.\n}\nf();\n// [line 2] in f()\n// [line 4] in script\n"
+	tests := []struct {
+		name      string
+		configure func(opts *loxgen.Options)
+		expected  []string
+	}{
+		{"without accessor", nil, nil},
+		{"accessor", func(opts *loxgen.Options) { opts.StackTraceAccessor = "vm.stack_trace" }, []string{
+			"assert_eq!(",
+			`vec!["[line 3] in f()", "[line 5] in script"],`,
+			"vm.stack_trace",
+		}},
+		{"included source", func(opts *loxgen.Options) {
+			opts.StackTraceAccessor = "vm.stack_trace"
+			opts.IncludeSource = true
+		}, []string{
+			"assert_eq!(",
+			`vec!["[line 2] in f()", "[line 4] in script"],`,
+			"vm.stack_trace",
+		}},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			function := testFunction(generate(t, map[string]string{"call/trace.lox": source}, test.configure), "trace_test")
+			if test.expected == nil {
+				if strings.Contains(function, `vec!["[line`) {
+					t.Errorf("expected no stack trace assertion\n%s", function)
+				}
+			} else if !containsLines(function, test.expected...) {
+				t.Errorf("expected\n%s\ngot\n%s", strings.Join(test.expected, "\n"), function)
+			}
+		})
+	}
+
+	// The runner expects the frames on stderr, in order, after the error.
+	runs := []struct {
+		name   string
+		stderr string
+		passes bool
+	}{
+		{"in order", "Only instances have properties.\n[line 2] in f()\n[line 4] in script", true},
+		{"out of order", "Only instances have properties.\n[line 4] in script\n[line 2] in f()", false},
+		{"missing frame", "Only instances have properties.\n[line 2] in f()", false},
+	}
+	for _, run := range runs {
+		t.Run("run "+run.name, func(t *testing.T) {
+			directory := t.TempDir()
+			writeFiles(t, directory, map[string]string{"suite/call/trace.lox": source})
+			rlox := fakeRlox(t, directory, fmt.Sprintf("cat >&2 <<'EOF'\n%s\nEOF\nexit 70\n", run.stderr))
+			output, err := runMain(t, directory, "-input", "suite", "-include", "*", "-rlox", rlox, "run")
+			if run.passes && (err != nil || !containsLines(output, "PASS suite/call/trace.lox")) {
+				t.Errorf("got %v, want the run to pass\n%s", err, output)
+			} else if !run.passes && (err == nil || !strings.Contains(output, "FAIL suite/call/trace.lox: expected the stack trace")) {
+				t.Errorf("got %v, want the stack trace to fail\n%s", err, output)
+			}
+		})
+	}
+}
+
+func TestBench(t *testing.T) {
+	directory := t.TempDir()
+	writeFiles(t, directory, map[string]string{
+		"suite/benchmark/fib.lox":  "print 1;\n",
+		"suite/benchmark/loop.lox": "print 2;\n",
+		"suite/benchmark/new.lox":  "print 3;\n",
+		"suite/string/a.lox":       "print 4; // expect: 4\n",
+	})
+	// Each run of a program adds a line to a file named after it.
+	rlox := fakeRlox(t, directory, `name=$(basename "$1"); echo run >> "$0.${name%%-*}"`+"\n")
+	args := []string{"-input", "suite", "-rlox", rlox, "-bench-runs", "3"}
+
+	output, err := runMain(t, directory, append(args, "-update-baseline", "bench")...)
+	if err != nil {
+		t.Fatalf("%v\n%s", err, output)
+	}
+	for _, program := range []string{"fib", "loop", "new"} {
+		if data, err := os.ReadFile(rlox + "." + program); err != nil || strings.Count(string(data), "run") != 4 {
+			t.Errorf("%s: expected a run to warm up and 3 timed runs, got %q, %v", program, data, err)
+		}
+	}
+	data, err := os.ReadFile(filepath.Join(directory, "bench_baseline.json"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	var baseline map[string]struct {
+		Runs   int     `json:"runs"`
+		Median float64 `json:"median_ms"`
+	}
+	if err := json.Unmarshal(data, &baseline); err != nil {
+		t.Fatal(err)
+	}
+	if len(baseline) != 3 || baseline["benchmark/fib.lox"].Runs != 3 || baseline["benchmark/fib.lox"].Median <= 0 {
+		t.Errorf("unexpected baseline\n%s", data)
+	}
+
+	// Against a baseline no run can be as fast as, fib regresses, and loop does not.
+	writeFiles(t, directory, map[string]string{"bench_baseline.json": `{
+  "benchmark/fib.lox": {"runs": 3, "mean_ms": 0.000001, "median_ms": 0.000001, "stddev_ms": 0},
+  "benchmark/loop.lox": {"runs": 3, "mean_ms": 1000000, "median_ms": 1000000, "stddev_ms": 0}
+}
+`})
+	output, err = runMain(t, directory, append(args, "bench")...)
+	if err == nil {
+		t.Errorf("expected fib to regress\n%s", output)
+	}
+	for _, pattern := range []string{
+		`(?m)^REGRESSED benchmark/fib\.lox: mean \S+ms, median \S+ms, stddev \S+ms over 3 run\(s\), \+\S+% from the baseline median 0\.00ms$`,
+		`(?m)^benchmark/loop\.lox: .*, -\S+% from the baseline median 1000000\.00ms$`,
+		`(?m)^benchmark/new\.lox: .*, not in the baseline$`,
+		`(?m)^3 benchmark\(s\), 1 regressed by more than 10%\.$`,
+	} {
+		if !regexp.MustCompile(pattern).MatchString(output) {
+			t.Errorf("expected a line matching %s in\n%s", pattern, output)
+		}
+	}
+	if strings.Contains(output, "string/a.lox") {
+		t.Errorf("expected only the programs of the benchmark directory to be run\n%s", output)
+	}
+}
+
+func TestCompare(t *testing.T) {
+	directory := t.TempDir()
+	files := map[string]string{}
+	for _, name := range []string{"same", "stdout", "stderr", "exit"} {
+		files["suite/string/"+name+".lox"] = "print 1; // expect: 1\n"
+	}
+	writeFiles(t, directory, files)
+	a := fakeRlox(t, t.TempDir(), `case "$1" in
+*/stderr-*) echo 1; echo oops >&2 ;;
+*) echo 1 ;;
+esac
+`)
+	b := fakeRlox(t, t.TempDir(), `case "$1" in
+*/stdout-*) echo 2 ;;
+*/stderr-*) echo 1; echo 'oops!' >&2 ;;
+*/exit-*) echo 1; exit 70 ;;
+*) echo 1 ;;
+esac
+`)
+	output, err := runMain(t, directory, "-input", "suite", "-include", "*", "-a", a, "-b", b, "compare")
+	if err == nil {
+		t.Errorf("expected the executables to diverge\n%s", output)
+	}
+	for _, lines := range [][]string{
+		{"DIVERGED suite/string/stdout.lox: stdout differs:", "- 1", "+ 2"},
+		{"DIVERGED suite/string/stderr.lox: stderr differs:", "- oops", "+ oops!"},
+		{"DIVERGED suite/string/exit.lox: exit status 0 vs 70"},
+		{fmt.Sprintf("4 file(s) run with %s and %s, 3 diverged.", a, b)},
+	} {
+		if !containsLines(output, lines...) {
+			t.Errorf("expected\n%s\nin\n%s", strings.Join(lines, "\n"), output)
+		}
+	}
+	if strings.Contains(output, "same.lox") {
+		t.Errorf("expected same.lox not to diverge\n%s", output)
+	}
+
+	output, err = runMain(t, directory, "-input", "suite", "-include", "*", "-a", a, "-b", a, "compare")
+	if err != nil || !containsLines(output, fmt.Sprintf("4 file(s) run with %s and %s, 0 diverged.", a, a)) {
+		t.Errorf("got %v, want no divergence\n%s", err, output)
+	}
+}
+
+func TestRecord(t *testing.T) {
+	const notice = "// TODO: the expectations of this file were recorded from the output of rlox, verify them by hand and remove this line."
+	tests := []struct {
+		name   string
+		source string
+		// What the stand-in rlox prints on stdout and stderr, and its exit status.
+		stdout, stderr string
+		exitCode       int
+		recorded       string
+	}{
+		{"values on their prints", "print 1;\nprint 2;\n", "1\n2\n", "", 0,
+			"print 1; // expect: 1\nprint 2; // expect: 2\n"},
+		{"values of a loop", "for (var i = 0; i < 2; i = i + 1) print i;\n", "0\n1\n", "", 0,
+			"for (var i = 0; i < 2; i = i + 1) print i;\n// expect: 0\n// expect: 1\n"},
+		{"compile errors", "var;\n{\n", "", "[line 1] Error at \";\": Expect variable name.\n[line 3] Error at end: Expect '}' after block.\n", 65,
+			"var; // Error at ';': Expect variable name.\n{\n// [line 3] Error at end: Expect '}' after block.\n"},
+		{"runtime error", "fun f() {\n  nil.x;\n}\nf();\n", "", "Only instances have properties.\n[line 2] in f()\n[line 4] in script\n", 70,
+			"fun f() {\n  nil.x; // expect runtime error: Only instances have properties.\n}\nf();\n"},
+		{"no output", "var a = 1;\n", "", "", 0, "var a = 1;\n// no-output\n"},
+		{"other exit status", "var a = 1;\n", "", "", 3, "var a = 1;\n// expect exit: 3\n"},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			directory := t.TempDir()
+			writeFiles(t, directory, map[string]string{
+				"suite/string/new.lox":      test.source,
+				"suite/string/expected.lox": "print 1; // expect: 1\n",
+				"stdout":                    test.stdout,
+				"stderr":                    test.stderr,
+			})
+			rlox := fakeRlox(t, directory, fmt.Sprintf("cd \"$(dirname \"$0\")\"\ncat stdout\ncat stderr >&2\nexit %d\n", test.exitCode))
+			output, err := runMain(t, directory, "-input", "suite", "-include", "*", "-rlox", rlox, "-record")
+			if err != nil {
+				t.Fatalf("%v\n%s", err, output)
+			}
+			data, err := os.ReadFile(filepath.Join(directory, "suite", "string", "new.lox"))
+			if err != nil {
+				t.Fatal(err)
+			}
+			if want := test.recorded + notice + "\n"; string(data) != want {
+				t.Errorf("recorded\n%s\nwant\n%s", data, want)
+			}
+			if data, err := os.ReadFile(filepath.Join(directory, "suite", "string", "expected.lox")); err != nil || string(data) != "print 1; // expect: 1\n" {
+				t.Errorf("expected the file with expectations to be left alone, got %q, %v", data, err)
+			}
+		})
+	}
+}
+
+func TestFix(t *testing.T) {
+	tests := []struct {
+		name   string
+		line   string
+		fixed  string
+		warned bool
+	}{
+		{"missing space", "print 1;// expect: 1", "print 1; // expect: 1", false},
+		{"marker spelling", "print 1; //Expect :1", "print 1; // expect: 1", false},
+		{"error marker", "foo;// [LINE 2]  error: bad", "foo; // [line 2] Error: bad", false},
+		{"trailing whitespace", "var a = 1;   \t", "var a = 1;", false},
+		{"comment", "print 3; // just a note  ", "print 3; // just a note", false},
+		{"whitespace of a value", "print \"a \"; // expect: a ", "print \"a \"; // expect: a ", true},
+		{"carriage return", "print 2;//expect: 2\r", "print 2; // expect: 2\r", false},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			for _, dryRun := range []bool{true, false} {
+				opts := loxgen.DefaultOptions()
+				opts.InputDirectory = t.TempDir()
+				opts.DryRun = dryRun
+				writeFiles(t, opts.InputDirectory, map[string]string{"string/fix.lox": test.line + "\n"})
+				generator, err := loxgen.New(opts)
+				if err != nil {
+					t.Fatal(err)
+				}
+				logged := captureLog(t)
+				if err := generator.Fix(); err != nil {
+					t.Fatal(err)
+				}
+				data, err := os.ReadFile(filepath.Join(opts.InputDirectory, "string", "fix.lox"))
+				if err != nil {
+					t.Fatal(err)
+				}
+				want, count := test.fixed+"\n", "1 file(s) fixed."
+				if dryRun {
+					want, count = test.line+"\n", "1 file(s) to fix."
+				}
+				if test.line == test.fixed {
+					count = strings.Replace(count, "1", "0", 1)
+				}
+				if string(data) != want {
+					t.Errorf("dry run %v: got %q, want %q", dryRun, data, want)
+				}
+				if !strings.Contains(logged.String(), count) {
+					t.Errorf("dry run %v: expected %q, got\n%s", dryRun, count, logged)
+				}
+				if warned := strings.Contains(logged.String(), "fix.lox:1: kept the trailing whitespace"); warned != test.warned {
+					t.Errorf("dry run %v: warned about the trailing whitespace: %v, want %v\n%s", dryRun, warned, test.warned, logged)
+				}
+			}
+		})
+	}
+}
+
+func TestAffected(t *testing.T) {
+	directory := t.TempDir()
+	writeFiles(t, directory, map[string]string{
+		"test/bool/a.lox":     "print true; // expect: true\n",
+		"test/closure/b.lox":  "print 1; // expect: 1\n",
+		"test/function/c.lox": "print 2; // expect: 2\n",
+		"test/string/d.lox":   "print \"d\"; // expect: d\n",
+		"affected.toml":       "\"src/scanner.rs\" = [\"bool\"]\n",
+	})
+	every := "tests::bool_tests:: tests::closure_tests:: tests::function_tests:: tests::string_tests::"
+	tests := []struct {
+		name    string
+		changed string
+		args    []string
+		filters string
+	}{
+		{"mapped source", "src/scanner.rs", nil, "tests::string_tests::"},
+		{"several directories", "src/value/function.rs", nil, "tests::closure_tests:: tests::function_tests::"},
+		{"fixture", "test/bool/a.lox", nil, "tests::bool_tests::"},
+		{"sources together", "src/scanner.rs,test/bool/a.lox", nil, "tests::bool_tests:: tests::string_tests::"},
+		{"mapped to nothing", "src/vm/mod.rs", nil, "loxgen_no_affected_tests"},
+		{"unmapped source", "src/new.rs", nil, every},
+		{"other file", "README.md", nil, "loxgen_no_affected_tests"},
+		{"affected map", "src/scanner.rs", []string{"-affected-map", "affected.toml"}, "tests::bool_tests::"},
+		{"integration", "src/scanner.rs", []string{"-integration"}, "string_tests::"},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			args := append([]string{"-include", "*", "-changed", test.changed}, test.args...)
+			output, err := runMain(t, directory, append(args, "affected")...)
+			if err != nil {
+				t.Fatalf("%v\n%s", err, output)
+			}
+			if !containsLines(output, test.filters) {
+				t.Errorf("expected the filters %q, got\n%s", test.filters, output)
+			}
+		})
+	}
+}
+
+func TestShard(t *testing.T) {
+	files := make(map[string]string)
+	for i := 0; i < 20; i++ {
+		files[fmt.Sprintf("string/s%d.lox", i)] = fmt.Sprintf("print %d; // expect: %d\n", i, i)
+	}
+	// shards returns the shard each test function is generated in.
+	shards := func(files map[string]string) map[string]int {
+		t.Helper()
+		shards := make(map[string]int)
+		for i := 1; i <= 3; i++ {
+			output := generate(t, files, func(opts *loxgen.Options) { opts.Shard = fmt.Sprintf("%d/3", i) })
+			for _, function := range testFunctionName.FindAllStringSubmatch(output, -1) {
+				if previous, ok := shards[function[1]]; ok {
+					t.Errorf("%s is in shards %d and %d", function[1], previous, i)
+				}
+				shards[function[1]] = i
+			}
+		}
+		return shards
+	}
+
+	assigned := shards(files)
+	if len(assigned) != len(files) {
+		t.Fatalf("expected the shards to hold the %d files, got %d", len(files), len(assigned))
+	}
+	counts := make(map[int]int)
+	for _, shard := range assigned {
+		counts[shard]++
+	}
+	if len(counts) != 3 {
+		t.Errorf("expected every shard to have files, got %v", counts)
+	}
+
+	// A file stays in its shard when others are added.
+	files["string/added.lox"] = "print 20; // expect: 20\n"
+	for function, shard := range shards(files) {
+		if previous, ok := assigned[function]; ok && previous != shard {
+			t.Errorf("%s moved from shard %d to %d", function, previous, shard)
+		}
+	}
+
+	for _, shard := range []string{"0/3", "4/3", "1/0", "1", "a/b"} {
+		opts := loxgen.DefaultOptions()
+		opts.Shard = shard
+		want := fmt.Sprintf("invalid -shard %q, expected i/n with 1 <= i <= n, e.g. 2/4", shard)
+		if _, err := loxgen.New(opts); err == nil || err.Error() != want {
+			t.Errorf("%s: got error %v, want %q", shard, err, want)
+		}
+	}
+}
+
+func TestFeatureGates(t *testing.T) {
+	files := map[string]string{
+		"string/a.lox":        "print 1; // expect: 1\n",
+		"closure/b.lox":       "print 2; // expect: 2\n",
+		"class/c.lox":         "print 3; // expect: 3\n",
+		"class/inherit/d.lox": "print 4; // expect: 4\n",
+	}
+	output := generate(t, files, func(opts *loxgen.Options) {
+		opts.FeatureGatesList = "closure=closures,class/inherit=inheritance,class=classes"
+	})
+	for _, lines := range [][]string{
+		{`#[cfg(feature = "classes")]`, "mod class_tests {"},
+		{`#[cfg(feature = "inheritance")]`, "pub(crate) mod inherit_tests {"},
+		{`#[cfg(feature = "closures")]`, "mod closure_tests {"},
+		{"}", "", "mod string_tests {"},
+		// A missing module counts with the number of tests it has, a nested one needs the features of its parents.
+		{
+			`#[cfg(all(feature = "classes", feature = "inheritance"))]`,
+			"class_tests::inherit_tests::TESTS.len(),",
+			`#[cfg(not(all(feature = "classes", feature = "inheritance")))]`,
+			"1,",
+		},
+		{"#[cfg(feature = \"closures\")]", "closure_tests::TESTS.len(),", `#[cfg(not(feature = "closures"))]`, "1,", "string_tests::TESTS.len(),"},
+	} {
+		if !containsLines(output, lines...) {
+			t.Errorf("expected\n%s\nin\n%s", strings.Join(lines, "\n"), output)
+		}
+	}
+
+	for _, gates := range []string{"closure", "=closures", "closure=no features", "[=x"} {
+		opts := loxgen.DefaultOptions()
+		opts.FeatureGatesList = gates
+		if _, err := loxgen.New(opts); err == nil || !strings.HasPrefix(err.Error(), "invalid -feature-gates ") {
+			t.Errorf("%s: got error %v, want an invalid -feature-gates error", gates, err)
+		}
+	}
+}
+
+func TestSuiteConfig(t *testing.T) {
+	files := map[string]string{
+		"string/a.lox":              "print 1; // expect: 1\n",
+		"closure/suite.toml":        "module = \"closures\"\n",
+		"closure/b.lox":             "print 2; // expect: 2\n",
+		"class/suite.toml":          "tags = [classes]\ndialect = \"jlox\"\n",
+		"class/c.lox":               "print 3; // expect: 3\n",
+		"class/inherit/d.lox":       "this; // [java line 1] Error at 'this': Can't use 'this' outside of a class.\n// [c line 1] Error at 'this': Not the jlox message.\n",
+		"upvalue/suite.toml":        "skip = \"upvalues are not implemented yet\"\n",
+		"upvalue/e.lox":             "print 5; // expect: 5\n",
+		"benchmark/suite.toml":      "skip = false\n",
+		"benchmark/f.lox":           "print 6; // expect: 6\n",
+		"benchmark/slow/suite.toml": "timeout = \"10s\"\n",
+	}
+	t.Run("generated", func(t *testing.T) {
+		output := generate(t, files, func(opts *loxgen.Options) { opts.IgnoreExcluded = true })
+		for _, lines := range [][]string{
+			{"mod closures {"},
+			{`#[ignore = "upvalue is skipped by its suite.toml: upvalues are not implemented yet"]`, "fn e_test() -> VMResult {"},
+			// The subdirectory has the dialect of its parent.
+			{`"Can't use 'this' outside of a class.",`},
+		} {
+			if !containsLines(output, lines...) {
+				t.Errorf("expected\n%s\nin\n%s", strings.Join(lines, "\n"), output)
+			}
+		}
+		if strings.Contains(output, "Not the jlox message.\",") {
+			t.Errorf("expected the clox error comment to be left out\n%s", output)
+		}
+	})
+	t.Run("tags", func(t *testing.T) {
+		output := generate(t, files, func(opts *loxgen.Options) { opts.TagsList = "classes" })
+		functions := testFunctionName.FindAllStringSubmatch(output, -1)
+		if len(functions) != 2 || testFunction(output, "c_test") == "" || testFunction(output, "d_test") == "" {
+			t.Errorf("expected the tests of class and its subdirectory\n%s", output)
+		}
+	})
+	t.Run("default include", func(t *testing.T) {
+		opts := loxgen.DefaultOptions()
+		if output := emit(t, testTree(files), opts); testFunction(output, "f_test") == "" {
+			t.Errorf("expected the directory with skip = false to be generated without -include\n%s", output)
+		}
+	})
+
+	invalid := []struct {
+		config string
+		want   string
+	}{
+		{"module = \"not an identifier\"\n", `test/string/suite.toml: module "not an identifier" is not a Rust identifier`},
+		{"timeout = \"soon\"\n", `test/string/suite.toml: invalid timeout "soon", expected a duration such as 5s`},
+		{"dialect = \"pylox\"\n", `test/string/suite.toml: unknown dialect "pylox", expected clox or jlox`},
+		{"name = \"strings\"\n", `test/string/suite.toml: unknown key "name", expected module, tags, timeout, skip or dialect`},
+	}
+	for _, test := range invalid {
+		opts := loxgen.DefaultOptions()
+		opts.IncludePatterns = "*"
+		_, err := loxgen.Parse(testTree(map[string]string{"string/a.lox": "print 1; // expect: 1\n", "string/suite.toml": test.config}), opts)
+		if err == nil || err.Error() != test.want {
+			t.Errorf("got error %v, want %q", err, test.want)
+		}
+	}
+
+	// The runner gives the tests of a directory its timeout.
+	directory := t.TempDir()
+	writeFiles(t, directory, map[string]string{
+		"suite/slow/suite.toml": "timeout = \"100ms\"\n",
+		"suite/slow/loop.lox":   "print 1; // expect: 1\n",
+	})
+	rlox := fakeRlox(t, directory, "sleep 5\n")
+	output, err := runMain(t, directory, "-input", "suite", "-include", "*", "-rlox", rlox, "run")
+	if err == nil || !containsLines(output, "FAIL suite/slow/loop.lox: timed out after 100ms") {
+		t.Errorf("got %v, want the test to time out\n%s", err, output)
+	}
+}
+
+func TestSync(t *testing.T) {
+	data := archive(t, "tar.gz", map[string]string{
+		"craftinginterpreters-master/test/bool/equality.lox": "print true == true; // expect: true\n",
+		"craftinginterpreters-master/README.md":              "# Crafting Interpreters\n",
+	})
+	release := make(chan struct{})
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Path {
+		case "/master.tar.gz":
+			w.Write(data)
+		case "/stalled.tar.gz":
+			// Headers go out, then the body never comes: the timeout must cover reading it.
+			w.WriteHeader(http.StatusOK)
+			w.(http.Flusher).Flush()
+			<-release
+		default:
+			http.NotFound(w, r)
+		}
+	}))
+	defer server.Close()
+	defer close(release)
+
+	sync := func(ref string, timeout time.Duration) (string, error) {
+		captureLog(t)
+		opts := loxgen.DefaultOptions()
+		opts.SyncDirectory = t.TempDir()
+		opts.SyncURL = server.URL + "/%s.tar.gz"
+		opts.SyncRef = ref
+		opts.SyncTimeout = timeout
+		generator, err := loxgen.New(opts)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return opts.SyncDirectory, generator.SyncTests()
+	}
+
+	t.Run("downloaded", func(t *testing.T) {
+		directory, err := sync("master", time.Minute)
+		if err != nil {
+			t.Fatal(err)
+		}
+		content, err := os.ReadFile(filepath.Join(directory, "bool", "equality.lox"))
+		if err != nil || string(content) != "print true == true; // expect: true\n" {
+			t.Errorf("equality.lox = %q, %v", content, err)
+		}
+		if _, err := os.Stat(filepath.Join(directory, "README.md")); err == nil {
+			t.Error("files outside of the test directory were synced")
+		}
+	})
+	t.Run("not found", func(t *testing.T) {
+		_, err := sync("missing", time.Minute)
+		if want := "downloading " + server.URL + "/missing.tar.gz: 404 Not Found"; err == nil || err.Error() != want {
+			t.Errorf("err = %v, want %s", err, want)
+		}
+	})
+	t.Run("timeout", func(t *testing.T) {
+		start := time.Now()
+		_, err := sync("stalled", 100*time.Millisecond)
+		if err == nil {
+			t.Fatal("a stalled download succeeded")
+		}
+		if elapsed := time.Since(start); elapsed > 10*time.Second {
+			t.Errorf("the download gave up after %s", elapsed)
+		}
+	})
+}
+
+func TestLongLine(t *testing.T) {
+	// Longer than the 64 KiB a bufio.Scanner reads by default.
+	long := strings.Repeat("a", 100*1024)
+	files := map[string]string{
+		"string/long.lox":             "print \"" + long + "\"; // expect: " + long + "\nprint 2; // expect: 2\n",
+		"string/short.lox":            "print 3;\n",
+		"string/_defaults.lox.expect": "// expect: 3 " + long + "\n",
+	}
+	output := generate(t, files, nil)
+	body := testFunction(output, "long_test")
+	for _, want := range []string{`"` + long + `",`, `"2",`} {
+		if !strings.Contains(body, want) {
+			t.Errorf("long_test does not expect %.20s...\n%.500s", want, body)
+		}
+	}
+	if !strings.Contains(testFunction(output, "short_test"), `"3 `+long+`",`) {
+		t.Errorf("short_test does not have the expectation of the defaults file")
+	}
+}
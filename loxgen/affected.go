@@ -0,0 +1,173 @@
+package loxgen
+
+import (
+	"errors"
+	"fmt"
+	"io/fs"
+	"log"
+	"os/exec"
+	"path"
+	"path/filepath"
+	"sort"
+	"strings"
+)
+
+// DEFAULT_AFFECTED_MAP tells the affected subcommand which test directories changing a
+// source file of the crate plausibly affects, by glob patterns of both: "*" stands for
+// every test. It can be replaced with -affected-map.
+var DEFAULT_AFFECTED_MAP = map[string][]string{
+	"src/scanner.rs":               {"scanning", "string", "number", "comments", "unexpected_character"},
+	"src/value/value.rs":           {"bool", "nil", "number", "string", "operator", "logical_operator", "equality"},
+	"src/value/function.rs":        {"function", "call", "closure", "return", "limit"},
+	"src/value/native_function.rs": {"function", "call"},
+	"src/vm/call_frame.rs":         {"function", "call", "closure", "return", "limit"},
+	"src/chunk.rs":                 {"*"},
+	"src/compiler.rs":              {"*"},
+	"src/parser.rs":                {"*"},
+	"src/main.rs":                  {"*"},
+	"src/lib.rs":                   {"*"},
+	"src/vm/vm.rs":                 {"*"},
+	"src/*/mod.rs":                 {},
+	"Cargo.toml":                   {"*"},
+	"Cargo.lock":                   {"*"},
+	"generate_tests.go":            {"*"},
+}
+
+// loadAffectedMap returns the -affected-map file, or DEFAULT_AFFECTED_MAP without one. The
+// file is a config file (see ReadConfigFile) whose keys are glob patterns of source files
+// and whose values are lists of patterns of test directories, e.g. `"src/scanner.rs" =
+// ["scanning", "string"]`.
+func (g *Generator) loadAffectedMap() (map[string][]string, error) {
+	if len(g.AffectedMapPath) == 0 {
+		return DEFAULT_AFFECTED_MAP, nil
+	}
+	config, err := ReadConfigFile(g.AffectedMapPath)
+	if err != nil {
+		return nil, err
+	}
+	mapping := make(map[string][]string)
+	for key, directories := range config {
+		pattern := unquote(key)
+		if _, err := path.Match(pattern, ""); err != nil {
+			return nil, fmt.Errorf("%s: bad pattern %q: %v", g.AffectedMapPath, pattern, err)
+		}
+		mapping[pattern] = directories
+	}
+	return mapping, nil
+}
+
+// changedSources lists the files changed since -since, relative to the working directory:
+// those git diff reports, along with the untracked ones. -changed replaces them.
+func (g *Generator) changedSources() ([]string, error) {
+	if len(g.ChangedFiles) > 0 {
+		names := make([]string, 0)
+		for name := range parseList(g.ChangedFiles) {
+			names = append(names, filepath.ToSlash(filepath.Clean(name)))
+		}
+		sort.Strings(names)
+		return names, nil
+	}
+	names := make([]string, 0)
+	for _, args := range [][]string{
+		{"diff", "--name-only", "--relative", g.AffectedSince, "--"},
+		{"ls-files", "--others", "--exclude-standard"},
+	} {
+		output, err := exec.Command("git", args...).Output()
+		if err != nil {
+			var exitError *exec.ExitError
+			if errors.As(err, &exitError) {
+				return nil, fmt.Errorf("git %s: %s", strings.Join(args, " "), strings.TrimSpace(string(exitError.Stderr)))
+			}
+			return nil, err
+		}
+		for _, line := range strings.Split(string(output), "\n") {
+			if line = strings.TrimSpace(line); len(line) > 0 {
+				names = append(names, line)
+			}
+		}
+	}
+	sort.Strings(names)
+	return names, nil
+}
+
+// affectedPatterns returns the patterns of the test directories a changed file affects, and
+// why. A fixture affects its own directory, a source file of the crate what the map gives
+// for it, or every test if the map has nothing on it. Other files affect no test.
+func (g *Generator) affectedPatterns(name string, mapping map[string][]string) ([]string, string) {
+	input := filepath.ToSlash(filepath.Clean(g.InputDirectory))
+	if relative := strings.TrimPrefix(name, input+"/"); relative != name {
+		if directory := strings.SplitN(relative, "/", 2); len(directory) == 2 {
+			return []string{directory[0]}, "test file " + name
+		}
+		return nil, ""
+	}
+	keys := make([]string, 0, len(mapping))
+	for key := range mapping {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	for _, key := range keys {
+		if matched, _ := path.Match(key, name); key == name || matched {
+			return mapping[key], name
+		}
+	}
+	if strings.HasPrefix(name, "src/") && strings.HasSuffix(name, ".rs") {
+		return []string{"*"}, name + ", which -affected-map does not map"
+	}
+	return nil, ""
+}
+
+// NO_TESTS_FILTER is a cargo test filter matching none of the generated tests.
+const NO_TESTS_FILTER = "loxgen_no_affected_tests"
+
+// printAffected prints the cargo test filters of the test modules plausibly affected by the
+// changes since -since, separated by spaces, to be passed on: `cargo test -- $(go run
+// generate_tests.go affected)`. The reason each module is selected for is logged. If no
+// module is affected, it prints NO_TESTS_FILTER, so that cargo runs none of them.
+func (g *Generator) printAffected(files []fs.FileInfo) error {
+	mapping, err := g.loadAffectedMap()
+	if err != nil {
+		return err
+	}
+	changed, err := g.changedSources()
+	if err != nil {
+		return err
+	}
+
+	directories := make([]string, 0)
+	for _, name := range g.moduleDirectories(files) {
+		if _, ok := g.ignoredDirectories[name]; !ok {
+			directories = append(directories, name)
+		}
+	}
+	reasons := make(map[string]string)
+	for _, name := range changed {
+		patterns, reason := g.affectedPatterns(name, mapping)
+		for _, directory := range directories {
+			if _, ok := reasons[directory]; !ok && matchesAny(strings.Join(patterns, ","), directory) {
+				reasons[directory] = reason
+			}
+		}
+	}
+
+	prefix := "tests::"
+	if g.Integration {
+		// The modules of an integration test are at the top of its crate.
+		prefix = ""
+	}
+	filters := make([]string, 0)
+	for _, directory := range directories {
+		if reason, ok := reasons[directory]; ok {
+			log.Printf("%s: changed %s", directory, reason)
+			filters = append(filters, prefix+g.directoryModule(directory)+"::")
+		}
+	}
+	if len(filters) == 0 {
+		log.Printf("%d changed file(s) since %s, no test module affected", len(changed), g.AffectedSince)
+		fmt.Println(NO_TESTS_FILTER)
+		return nil
+	}
+	log.Printf("%d of %d test module(s) affected by %d changed file(s)", len(filters), len(directories), len(changed))
+	fmt.Println(strings.Join(filters, " "))
+	return nil
+}
@@ -0,0 +1,239 @@
+package loxgen
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/fs"
+	"io/ioutil"
+	"log"
+	"math"
+	"os"
+	"os/exec"
+	"path"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+)
+
+// benchPrograms returns the paths of the .lox programs of -bench-directory, in the order
+// of the directory, those of its subdirectories after its own.
+func (g *Generator) benchPrograms() []string {
+	programs := make([]string, 0)
+	var visit func(directory string)
+	visit = func(directory string) {
+		files, subdirectories, err := g.listModule(directory)
+		if err != nil {
+			g.reportError(err)
+			return
+		}
+		for _, file := range files {
+			if strings.HasSuffix(file.Name(), ".lox") {
+				programs = append(programs, path.Join(directory, file.Name()))
+			}
+		}
+		for _, subdirectory := range subdirectories {
+			visit(subdirectory)
+		}
+	}
+	visit(g.BenchDirectory)
+	return programs
+}
+
+// writeBenchmarks writes a criterion benchmark interpreting each program of -bench-directory.
+func (g *Generator) writeBenchmarks() error {
+	names := make([]string, 0)
+	taken := make(map[string]bool)
+	var f outputBuffer
+	writeLine(&f, "use criterion::{criterion_group, criterion_main, Criterion};", 0)
+	writeLine(&f, fmt.Sprintf("use %s;", g.BenchImport), 0)
+
+	for _, program := range g.benchPrograms() {
+		data, err := fs.ReadFile(g.inputFS, program)
+		if err != nil {
+			g.reportError(err)
+			continue
+		}
+		name := identifier(uniqueName(strings.TrimSuffix(program, ".lox"), taken))
+		if name != identifier(strings.TrimSuffix(program, ".lox")) {
+			log.Printf("Warning: %s has the same identifier as another benchmark, it is generated as %s.", g.displayPath(path.Dir(program), path.Base(program)), name)
+		}
+		names = append(names, name)
+		f.WriteString("\n")
+		writeLine(&f, fmt.Sprintf("fn %s(c: &mut Criterion) {", name), 0)
+		lines := strings.Split(strings.TrimSuffix(string(normalizeSource(data)), "\n"), "\n")
+		hashes := rawStringHashes(lines)
+		writeLine(&f, "let source = r"+hashes+"\"", 1)
+		f.WriteString(strings.Join(lines, "\n") + "\n")
+		writeLine(&f, "\""+hashes+";", 0)
+		writeLine(&f, fmt.Sprintf("c.bench_function(%s, |b| {", rustString(strings.TrimSuffix(program, ".lox"))), 1)
+		writeLine(&f, "b.iter(|| {", 2)
+		writeLine(&f, "let mut vm = "+g.VmConstructor+";", 3)
+		writeLine(&f, "#[allow(unused_must_use)]", 3)
+		writeLine(&f, "{ "+g.interpret("source.to_string()")+"; }", 3)
+		writeLine(&f, "})", 2)
+		writeLine(&f, "});", 1)
+		writeLine(&f, "}", 0)
+	}
+
+	f.WriteString("\n")
+	writeLine(&f, fmt.Sprintf("criterion_group!(benches, %s);", strings.Join(names, ", ")), 0)
+	writeLine(&f, "criterion_main!(benches);", 0)
+
+	if len(g.generationErrors) > 0 {
+		return g.notWritten(g.BenchesPath)
+	}
+	if len(names) == 0 {
+		return fmt.Errorf("no .lox programs in %s, %s was not written.", g.displayPath(g.BenchDirectory, ""), g.BenchesPath)
+	}
+	if !g.DryRun && !g.Check {
+		if err := os.MkdirAll(filepath.Dir(g.BenchesPath), 0755); err != nil {
+			return err
+		}
+	}
+	return g.writeOutput(g.BenchesPath, f.Bytes())
+}
+
+// DEFAULT_BENCH_BASELINE is the file the bench subcommand compares the timings with.
+const DEFAULT_BENCH_BASELINE = "bench_baseline.json"
+
+// benchStats are the timings of a program over the runs of the bench subcommand, in milliseconds.
+type benchStats struct {
+	Runs   int     `json:"runs"`
+	Mean   float64 `json:"mean_ms"`
+	Median float64 `json:"median_ms"`
+	StdDev float64 `json:"stddev_ms"`
+}
+
+// newBenchStats computes the statistics of the durations of some runs. The standard
+// deviation is that of a sample.
+func newBenchStats(durations []time.Duration) benchStats {
+	values := make([]float64, 0, len(durations))
+	sum := 0.0
+	for _, duration := range durations {
+		ms := float64(duration) / float64(time.Millisecond)
+		values = append(values, ms)
+		sum += ms
+	}
+	sort.Float64s(values)
+	stats := benchStats{Runs: len(values), Mean: sum / float64(len(values))}
+	if middle := len(values) / 2; len(values)%2 == 1 {
+		stats.Median = values[middle]
+	} else {
+		stats.Median = (values[middle-1] + values[middle]) / 2
+	}
+	if len(values) > 1 {
+		squares := 0.0
+		for _, value := range values {
+			squares += (value - stats.Mean) * (value - stats.Mean)
+		}
+		stats.StdDev = math.Sqrt(squares / float64(len(values)-1))
+	}
+	return stats
+}
+
+// timeProgram runs a program with the rlox executable once to warm up, then -bench-runs
+// times, and returns how long each of those runs took. The program has to run without errors.
+func (g *Generator) timeProgram(program string) ([]time.Duration, error) {
+	data, err := fs.ReadFile(g.inputFS, program)
+	if err != nil {
+		return nil, err
+	}
+	// Copied to a file of its own, since the input may be an archive.
+	file, err := os.CreateTemp("", strings.TrimSuffix(path.Base(program), ".lox")+"-*.lox")
+	if err != nil {
+		return nil, err
+	}
+	defer os.Remove(file.Name())
+	_, err = file.Write(normalizeSource(data))
+	if closeErr := file.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	durations := make([]time.Duration, 0, g.BenchRuns)
+	for run := 0; run <= g.BenchRuns; run++ {
+		var stderr bytes.Buffer
+		command := exec.Command(g.RloxBinary, file.Name())
+		command.Stderr = &stderr
+		start := time.Now()
+		err := command.Run()
+		duration := time.Since(start)
+		if err != nil {
+			return nil, fmt.Errorf("%s: %v: %s", g.displayPath(program, ""), err, strings.TrimSpace(stderr.String()))
+		}
+		if run > 0 {
+			durations = append(durations, duration)
+		}
+	}
+	return durations, nil
+}
+
+// runBenchmarks times every program of -bench-directory and compares its median with the
+// one in -bench-baseline, if the file has it. It returns ErrFailed if a program is slower
+// than its baseline by more than -bench-threshold percent, or with -update-baseline writes
+// the timings to the baseline file instead.
+func (g *Generator) runBenchmarks() error {
+	baseline := make(map[string]benchStats)
+	if data, err := ioutil.ReadFile(g.BenchBaselinePath); err == nil {
+		if err := json.Unmarshal(data, &baseline); err != nil {
+			return fmt.Errorf("%s: %v", g.BenchBaselinePath, err)
+		}
+	} else if !errors.Is(err, fs.ErrNotExist) {
+		return err
+	}
+
+	results := make(map[string]benchStats)
+	regressed := 0
+	for _, program := range g.benchPrograms() {
+		durations, err := g.timeProgram(program)
+		if err != nil {
+			g.reportError(err)
+			continue
+		}
+		stats := newBenchStats(durations)
+		results[program] = stats
+		line := fmt.Sprintf("%s: mean %.2fms, median %.2fms, stddev %.2fms over %d run(s)", program, stats.Mean, stats.Median, stats.StdDev, stats.Runs)
+		if previous, ok := baseline[program]; ok && previous.Median > 0 && !g.UpdateBaseline {
+			change := (stats.Median - previous.Median) / previous.Median * 100
+			line += fmt.Sprintf(", %+.1f%% from the baseline median %.2fms", change, previous.Median)
+			if change > g.BenchThreshold {
+				regressed++
+				line = "REGRESSED " + line
+			}
+		} else if !g.UpdateBaseline {
+			line += ", not in the baseline"
+		}
+		fmt.Println(line)
+	}
+	for _, err := range g.generationErrors {
+		log.Print(err)
+	}
+	if len(results) == 0 && len(g.generationErrors) == 0 {
+		return fmt.Errorf("no .lox programs in %s.", g.displayPath(g.BenchDirectory, ""))
+	}
+
+	if g.UpdateBaseline {
+		if len(g.generationErrors) > 0 {
+			return fmt.Errorf("%d error(s), %s was not written.", len(g.generationErrors), g.BenchBaselinePath)
+		}
+		data, err := json.MarshalIndent(results, "", "  ")
+		if err != nil {
+			return err
+		}
+		if err := writeFileAtomically(g.BenchBaselinePath, append(data, '\n')); err != nil {
+			return err
+		}
+		log.Printf("Wrote the timings of %d program(s) to %s.", len(results), g.BenchBaselinePath)
+		return nil
+	}
+	fmt.Printf("%d benchmark(s), %d regressed by more than %g%%.\n", len(results), regressed, g.BenchThreshold)
+	if regressed > 0 || len(g.generationErrors) > 0 {
+		return ErrFailed
+	}
+	return nil
+}
@@ -0,0 +1,113 @@
+package loxgen
+
+import (
+	"crypto/sha256"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"io/ioutil"
+	"log"
+	"os"
+	"sort"
+)
+
+// cacheEntry is what -cache keeps of a generated module file: the hash of what it was generated from,
+// and what mod.rs and -map-out need to know about it.
+type cacheEntry struct {
+	Hash      string          `json:"hash"`
+	TestCount int             `json:"test_count"`
+	Modules   []string        `json:"modules"`
+	TestMap   []testMapEntry  `json:"test_map"`
+	Summaries []moduleSummary `json:"summaries"`
+	Skipped   []string        `json:"skipped"`
+	// Hash of the inputs in the header of the file, see setInputHash.
+	InputHash string `json:"input_hash,omitempty"`
+	// The modules gated behind features, by module path, see gatedModules.
+	Gates map[string]gatedModule `json:"gates,omitempty"`
+}
+
+// readCache reads the -cache file. A missing or unreadable cache only means every module is regenerated.
+func (g *Generator) readCache() map[string]cacheEntry {
+	cache := make(map[string]cacheEntry)
+	if len(g.CachePath) == 0 {
+		return cache
+	}
+	data, err := ioutil.ReadFile(g.CachePath)
+	if err != nil {
+		return cache
+	}
+	if err := json.Unmarshal(data, &cache); err != nil {
+		log.Printf("Warning: ignoring the invalid cache %s: %v", g.CachePath, err)
+		return make(map[string]cacheEntry)
+	}
+	return cache
+}
+
+// cacheUsable reports whether modules can be skipped at all. The summary test, the manifest and the
+// insta snapshots need every parsed test, and -check and -dry-run compare every file with the one on disk.
+func (g *Generator) cacheUsable() bool {
+	return !g.SummaryTest && len(g.ManifestPath) == 0 && !g.Insta && !g.Check && !g.DryRun
+}
+
+// moduleHash hashes everything the file of a top level module is generated from: the generator
+// itself, its options, the templates, every file under the directory and its -reference-dir outputs.
+func (g *Generator) moduleHash(moduleName string) string {
+	hash := sha256.New()
+	fmt.Fprintf(hash, "%s\n", g.generatorHash())
+	if err := hashFiles(hash, g.inputFS, moduleName); err != nil {
+		// Unhashable inputs are always regenerated.
+		return ""
+	}
+	if len(g.ReferenceDirectory) > 0 {
+		// A directory without reference outputs has none to hash.
+		if err := hashFiles(hash, os.DirFS(g.ReferenceDirectory), moduleName); err != nil && !errors.Is(err, fs.ErrNotExist) {
+			return ""
+		}
+	}
+	return fmt.Sprintf("%x", hash.Sum(nil))
+}
+
+// generatorHash returns the hash of what every module is generated with: the generator executable,
+// the options, the known failures and the templates. It is only computed once, on the first call.
+func (g *Generator) generatorHash() string {
+	if len(g.generatorDigest) > 0 {
+		return g.generatorDigest
+	}
+	hash := sha256.New()
+	if executable, err := os.Executable(); err == nil {
+		if data, err := ioutil.ReadFile(executable); err == nil {
+			hash.Write(data)
+		}
+	}
+	if options, err := json.Marshal(g.Options); err == nil {
+		fmt.Fprintf(hash, "%s\n", options)
+	}
+	fmt.Fprintf(hash, "known failures: %q\n", g.knownFailures)
+	loaded := g.templates.Templates()
+	sort.Slice(loaded, func(i, j int) bool { return loaded[i].Name() < loaded[j].Name() })
+	for _, t := range loaded {
+		if t.Tree != nil {
+			fmt.Fprintf(hash, "%s\n%s\n", t.Name(), t.Tree.Root.String())
+		}
+	}
+	g.generatorDigest = fmt.Sprintf("%x", hash.Sum(nil))
+	return g.generatorDigest
+}
+
+// hashFiles writes the path, size and content of every file under a directory of files to hash.
+func hashFiles(hash io.Writer, files fs.FS, directory string) error {
+	return fs.WalkDir(files, directory, func(name string, entry fs.DirEntry, err error) error {
+		if err != nil || entry.IsDir() {
+			return err
+		}
+		data, err := fs.ReadFile(files, name)
+		if err != nil {
+			return err
+		}
+		fmt.Fprintf(hash, "%s %d\n", name, len(data))
+		hash.Write(data)
+		return nil
+	})
+}
@@ -0,0 +1,85 @@
+package loxgen
+
+import (
+	"fmt"
+	"io/fs"
+	"log"
+	"strings"
+	"sync"
+)
+
+// compareRun is how a file ran with one of the executables of the compare subcommand.
+type compareRun struct {
+	stdout, stderr []string
+	exitCode       int
+	err            error
+}
+
+// divergence describes how two runs of a file differ, or returns an empty string
+// if they printed the same lines and exited the same way.
+func divergence(a compareRun, b compareRun) string {
+	var problems []string
+	switch {
+	case a.err != nil || b.err != nil:
+		if fmt.Sprint(a.err) != fmt.Sprint(b.err) {
+			problems = append(problems, fmt.Sprintf("failed to run: %v vs %v", a.err, b.err))
+		}
+	case a.exitCode != b.exitCode:
+		problems = append(problems, fmt.Sprintf("exit status %d vs %d", a.exitCode, b.exitCode))
+	}
+	if strings.Join(a.stdout, "\n") != strings.Join(b.stdout, "\n") {
+		problems = append(problems, "stdout differs:\n"+strings.TrimSuffix(outputDiff(a.stdout, b.stdout), "\n"))
+	}
+	if strings.Join(a.stderr, "\n") != strings.Join(b.stderr, "\n") {
+		problems = append(problems, "stderr differs:\n"+strings.TrimSuffix(outputDiff(a.stderr, b.stderr), "\n"))
+	}
+	return strings.Join(problems, "\n")
+}
+
+// compareBinaries runs every selected test with -a and -b, and prints the files on which
+// the two executables diverge, with a diff of the output of -a ("- ") and -b ("+ ").
+// It returns ErrFailed if any file diverged.
+func (g *Generator) compareBinaries(files []fs.FileInfo) error {
+	tests, err := g.selectedTests(files)
+	if err != nil {
+		return err
+	}
+
+	runs := make([][2]compareRun, len(tests))
+	indices := make(chan int)
+	var workers sync.WaitGroup
+	for worker := 0; worker < g.Jobs; worker++ {
+		workers.Add(1)
+		go func() {
+			defer workers.Done()
+			for i := range indices {
+				for j, binary := range []string{g.CompareBinaryA, g.CompareBinaryB} {
+					var run compareRun
+					run.stdout, run.stderr, run.exitCode, run.err = g.execute(binary, tests[i])
+					runs[i][j] = run
+				}
+			}
+		}()
+	}
+	for i := range tests {
+		indices <- i
+	}
+	close(indices)
+	workers.Wait()
+
+	diverged := 0
+	for i, test := range tests {
+		if problem := divergence(runs[i][0], runs[i][1]); len(problem) > 0 {
+			diverged++
+			fmt.Printf("DIVERGED %s: %s\n", test.path, problem)
+		}
+	}
+	for _, err := range g.generationErrors {
+		log.Print(err)
+	}
+	fmt.Printf("%d file(s) run with %s and %s, %d diverged.\n", len(tests), g.CompareBinaryA, g.CompareBinaryB, diverged)
+	if diverged > 0 || len(g.generationErrors) > 0 {
+		return ErrFailed
+	}
+	return nil
+}
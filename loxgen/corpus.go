@@ -0,0 +1,80 @@
+package loxgen
+
+import (
+	"crypto/sha1"
+	"fmt"
+	"io/fs"
+	"io/ioutil"
+	"log"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// DEFAULT_CORPUS_DIRECTORY is the corpus of a cargo-fuzz target named interpret.
+const DEFAULT_CORPUS_DIRECTORY = "fuzz/corpus/interpret"
+
+// exportCorpus writes the program of every test to -corpus-directory, stripped of its comments
+// and blank lines, which only slow the fuzzer down. Files are named after the SHA-1 of their
+// content, as libFuzzer names the inputs it adds, so that programs already in the corpus,
+// or appearing in several tests, are only written once.
+func (g *Generator) exportCorpus(files []fs.FileInfo) error {
+	tests, err := g.selectedTests(files)
+	if err != nil {
+		return err
+	}
+	if err := os.MkdirAll(g.CorpusDirectory, 0755); err != nil {
+		return err
+	}
+
+	written, duplicates := 0, 0
+	for _, test := range tests {
+		program := strings.Join(stripComments(test.source), "\n")
+		if len(program) == 0 {
+			continue
+		}
+		program += "\n"
+		target := filepath.Join(g.CorpusDirectory, fmt.Sprintf("%x", sha1.Sum([]byte(program))))
+		if _, err := os.Stat(target); err == nil {
+			duplicates++
+			continue
+		}
+		if err := ioutil.WriteFile(target, []byte(program), 0644); err != nil {
+			g.reportError(err)
+			continue
+		}
+		written++
+	}
+	for _, err := range g.generationErrors {
+		log.Print(err)
+	}
+	log.Printf("Wrote %d program(s) to %s, %d already there.", written, g.CorpusDirectory, duplicates)
+	if len(g.generationErrors) > 0 {
+		return ErrFailed
+	}
+	return nil
+}
+
+// stripComments returns the lines of a Lox source without their comments, trailing spaces
+// and the lines left empty. Strings may span lines, their content is kept as it is.
+func stripComments(source []string) []string {
+	lines := make([]string, 0, len(source))
+	inString := false
+	for _, line := range source {
+		end := len(line)
+		for i := 0; i < len(line); i++ {
+			if line[i] == '"' {
+				inString = !inString
+			} else if !inString && strings.HasPrefix(line[i:], "//") {
+				end = i
+				break
+			}
+		}
+		if inString {
+			lines = append(lines, line)
+		} else if code := strings.TrimRight(line[:end], " \t"); len(code) > 0 {
+			lines = append(lines, code)
+		}
+	}
+	return lines
+}
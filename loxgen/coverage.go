@@ -0,0 +1,157 @@
+package loxgen
+
+import (
+	"fmt"
+	"io/fs"
+	"path"
+	"sort"
+	"strings"
+)
+
+// upstreamTests returns the paths of the upstream test files, relative to the test directory,
+// read from -upstream or downloaded.
+func (g *Generator) upstreamTests() ([]string, error) {
+	var names []string
+	if len(g.UpstreamInput) == 0 {
+		err := g.fetchUpstream(func(name string, data []byte) error {
+			names = append(names, name)
+			return nil
+		})
+		sort.Strings(names)
+		return names, err
+	}
+	upstream, closer, err := openInput(g.UpstreamInput)
+	if err != nil {
+		return nil, err
+	}
+	defer closer.Close()
+	return loxFiles(upstream)
+}
+
+// loxFiles returns the paths of the .lox files of a file system, sorted.
+func loxFiles(files fs.FS) ([]string, error) {
+	var names []string
+	err := fs.WalkDir(files, ".", func(name string, entry fs.DirEntry, err error) error {
+		if err == nil && !entry.IsDir() && strings.HasSuffix(name, ".lox") {
+			names = append(names, name)
+		}
+		return err
+	})
+	sort.Strings(names)
+	return names, err
+}
+
+// coverageArea is how much of a top-level directory of the upstream suite is covered.
+type coverageArea struct {
+	name      string
+	upstream  int
+	generated int
+	missing   int
+	leftOut   int
+}
+
+// printCoverage compares the test files with those of the upstream suite. For each of its
+// top-level directories, it prints how many of the upstream files are generated as tests.
+// Then it lists the files missing from the input, and those found but left out, with why.
+func (g *Generator) printCoverage(files []fs.FileInfo) error {
+	upstream, err := g.upstreamTests()
+	if err != nil {
+		return err
+	}
+	local, err := loxFiles(g.inputFS)
+	if err != nil {
+		return err
+	}
+	tests, err := g.selectedTests(files)
+	if err != nil {
+		return err
+	}
+	generated := make(map[string]bool)
+	for _, test := range tests {
+		generated[sourcePath(test.moduleName, test.fileName)] = true
+	}
+
+	var areas []*coverageArea
+	var missing, leftOut []string
+	covered := 0
+	for _, name := range upstream {
+		areaName := "(top level)"
+		if directory, _, ok := strings.Cut(name, "/"); ok {
+			areaName = directory
+		}
+		if len(areas) == 0 || areas[len(areas)-1].name != areaName {
+			areas = append(areas, &coverageArea{name: areaName})
+		}
+		area := areas[len(areas)-1]
+		area.upstream++
+		switch {
+		case generated[name]:
+			area.generated++
+			covered++
+		case !containsString(local, name):
+			area.missing++
+			missing = append(missing, name)
+		default:
+			area.leftOut++
+			leftOut = append(leftOut, name+": "+g.leftOutReason(name))
+		}
+	}
+
+	fmt.Printf("%d of %d upstream test file(s) generated (%s).\n", covered, len(upstream), percentage(covered, len(upstream)))
+	width := 0
+	for _, area := range areas {
+		if len(area.name) > width {
+			width = len(area.name)
+		}
+	}
+	for _, area := range areas {
+		fmt.Printf("  %-*s %4d/%-4d %7s (%d missing, %d left out)\n",
+			width, area.name, area.generated, area.upstream, percentage(area.generated, area.upstream), area.missing, area.leftOut)
+	}
+	if len(missing) > 0 {
+		fmt.Printf("Missing from %s:\n", g.InputDirectory)
+		for _, name := range missing {
+			fmt.Printf("  %s\n", name)
+		}
+	}
+	if len(leftOut) > 0 {
+		fmt.Println("Left out of the generated tests:")
+		for _, name := range leftOut {
+			fmt.Printf("  %s\n", name)
+		}
+	}
+	return nil
+}
+
+// leftOutReason returns why a test file of the input is not generated.
+func (g *Generator) leftOutReason(name string) string {
+	if !strings.Contains(name, "/") {
+		return "files outside of a directory are not generated"
+	}
+	for directory := path.Dir(name); directory != "."; directory = path.Dir(directory) {
+		if reason, ok := g.ignoredDirectories[directory]; ok {
+			return directory + " " + reason
+		}
+		if suite, _ := g.loadSuite(directory); suite.skipped && g.excludedDirectories[directory] {
+			return directory + " " + suite.skipReason()
+		}
+		if g.excludedDirectories[directory] {
+			return directory + " left out by -include, -exclude or -chapter"
+		}
+	}
+	prefix := g.displayPath(path.Dir(name), path.Base(name)) + ": "
+	for _, skipped := range g.skippedFiles {
+		if reason, ok := strings.CutPrefix(skipped, prefix); ok {
+			return reason
+		}
+	}
+	return "filtered out or invalid"
+}
+
+// percentage formats part of total as a percentage, with one decimal.
+func percentage(part int, total int) string {
+	if total == 0 {
+		return "-"
+	}
+	return fmt.Sprintf("%.1f%%", 100*float64(part)/float64(total))
+}
@@ -0,0 +1,172 @@
+package loxgen
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+)
+
+// diffSplit splits text into lines, keeping a missing final newline visible to the diff.
+func diffSplit(text string) []string {
+	if len(text) == 0 {
+		return nil
+	}
+	lines := strings.SplitAfter(text, "\n")
+	if lines[len(lines)-1] == "" {
+		lines = lines[:len(lines)-1]
+	}
+	return lines
+}
+
+// DIFF_CONTEXT is the number of unchanged lines shown around each change, as diff -u does.
+const DIFF_CONTEXT = 3
+
+// diffEdit is a line of a diff: ' ' for a line of both files, '-' for a removed line and '+' for an added one.
+type diffEdit struct {
+	kind byte
+	line string
+}
+
+// diffLines finds the shortest edit script turning a into b with Myers' algorithm.
+func diffLines(a []string, b []string) []diffEdit {
+	n, m := len(a), len(b)
+	offset := n + m
+	v := make([]int, 2*offset+2)
+	var trace [][]int
+	done := n == 0 && m == 0
+	for d := 0; d <= n+m && !done; d++ {
+		trace = append(trace, append([]int(nil), v...))
+		for k := -d; k <= d; k += 2 {
+			var x int
+			if k == -d || (k != d && v[offset+k-1] < v[offset+k+1]) {
+				x = v[offset+k+1]
+			} else {
+				x = v[offset+k-1] + 1
+			}
+			y := x - k
+			for x < n && y < m && a[x] == b[y] {
+				x++
+				y++
+			}
+			v[offset+k] = x
+			if x >= n && y >= m {
+				done = true
+				break
+			}
+		}
+	}
+
+	// Walk the trace back from the end, collecting the edits in reverse.
+	var edits []diffEdit
+	x, y := n, m
+	for d := len(trace) - 1; d >= 0; d-- {
+		v := trace[d]
+		k := x - y
+		var previousK int
+		if k == -d || (k != d && v[offset+k-1] < v[offset+k+1]) {
+			previousK = k + 1
+		} else {
+			previousK = k - 1
+		}
+		previousX := v[offset+previousK]
+		previousY := previousX - previousK
+		if d == 0 {
+			previousX, previousY = 0, 0
+		}
+		for x > previousX && y > previousY {
+			edits = append(edits, diffEdit{' ', a[x-1]})
+			x--
+			y--
+		}
+		if d == 0 {
+			break
+		}
+		if x == previousX {
+			edits = append(edits, diffEdit{'+', b[y-1]})
+			y--
+		} else {
+			edits = append(edits, diffEdit{'-', a[x-1]})
+			x--
+		}
+	}
+	for i, j := 0, len(edits)-1; i < j; i, j = i+1, j-1 {
+		edits[i], edits[j] = edits[j], edits[i]
+	}
+	return edits
+}
+
+// unifiedDiff formats the differences between a and b like diff -u, or returns "" when there are none.
+func unifiedDiff(oldName string, newName string, a []string, b []string) string {
+	edits := diffLines(a, b)
+	var diff strings.Builder
+	for start := 0; start < len(edits); {
+		// Find the next change and the end of the hunk around it, joining changes closer than twice the context.
+		first := start
+		for first < len(edits) && edits[first].kind == ' ' {
+			first++
+		}
+		if first == len(edits) {
+			break
+		}
+		last := first
+		for i := first; i < len(edits); i++ {
+			if edits[i].kind != ' ' {
+				last = i
+			} else if i-last > 2*DIFF_CONTEXT {
+				break
+			}
+		}
+		hunkStart := first - DIFF_CONTEXT
+		if hunkStart < start {
+			hunkStart = start
+		}
+		hunkEnd := last + DIFF_CONTEXT + 1
+		if hunkEnd > len(edits) {
+			hunkEnd = len(edits)
+		}
+
+		// Line numbers of the hunk start in each file.
+		oldLine, newLine := 1, 1
+		for _, edit := range edits[:hunkStart] {
+			if edit.kind != '+' {
+				oldLine++
+			}
+			if edit.kind != '-' {
+				newLine++
+			}
+		}
+		var hunk strings.Builder
+		oldCount, newCount := 0, 0
+		for _, edit := range edits[hunkStart:hunkEnd] {
+			if edit.kind != '+' {
+				oldCount++
+			}
+			if edit.kind != '-' {
+				newCount++
+			}
+			hunk.WriteByte(edit.kind)
+			hunk.WriteString(edit.line)
+			if !strings.HasSuffix(edit.line, "\n") {
+				hunk.WriteString("\n\\ No newline at end of file\n")
+			}
+		}
+		if diff.Len() == 0 {
+			fmt.Fprintf(&diff, "--- %s\n+++ %s\n", oldName, newName)
+		}
+		fmt.Fprintf(&diff, "@@ -%s +%s @@\n%s", hunkRange(oldLine, oldCount), hunkRange(newLine, newCount), hunk.String())
+		start = hunkEnd
+	}
+	return diff.String()
+}
+
+// hunkRange formats the start and length of a hunk in one of the files, which start before
+// the first line when the hunk has no lines in it.
+func hunkRange(line int, count int) string {
+	if count == 0 {
+		line--
+	}
+	if count == 1 {
+		return strconv.Itoa(line)
+	}
+	return fmt.Sprintf("%d,%d", line, count)
+}
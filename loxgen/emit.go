@@ -0,0 +1,1142 @@
+package loxgen
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"io/ioutil"
+	"log"
+	"path"
+	"path/filepath"
+	"regexp"
+	"strconv"
+	"strings"
+	"text/template"
+	"time"
+)
+
+func writeLine(outputFile io.StringWriter, text string, indentationLevel int) {
+	outputFile.WriteString(fmt.Sprintf("%s%s\n", strings.Repeat("    ", indentationLevel), text))
+}
+
+// rawStringHashPattern matches a quote followed by hashes, which would end a raw string
+// literal delimited by as many of them.
+var rawStringHashPattern = regexp.MustCompile(`"#+`)
+
+// rawStringHashes returns the hashes delimiting a raw string literal of the given lines:
+// one more than the longest run of hashes following a quote, so that no `"#` in the
+// source ends the literal early.
+func rawStringHashes(lines []string) string {
+	longest := 0
+	for _, line := range lines {
+		for _, match := range rawStringHashPattern.FindAllString(line, -1) {
+			if len(match)-1 > longest {
+				longest = len(match) - 1
+			}
+		}
+	}
+	return strings.Repeat("#", longest+1)
+}
+
+// rustString returns text as a quoted Rust string literal.
+func rustString(text string) string {
+	replacer := strings.NewReplacer("\\", "\\\\", "\"", "\\\"", "\n", "\\n", "\r", "\\r", "\t", "\\t")
+	return "\"" + replacer.Replace(text) + "\""
+}
+
+// invalidIdentifierCharacters matches the characters a Rust identifier cannot have.
+var invalidIdentifierCharacters = regexp.MustCompile("[^A-Za-z0-9_]")
+
+// identifier turns a file or directory name into a valid Rust identifier.
+// Invalid characters are replaced with underscores, a leading digit or a lone underscore
+// is prefixed with an underscore and keywords get a trailing underscore.
+func identifier(name string) string {
+	id := invalidIdentifierCharacters.ReplaceAllString(name, "_")
+	if len(id) == 0 {
+		id = "_"
+	}
+	if id == "_" || (id[0] >= '0' && id[0] <= '9') {
+		id = "_" + id
+	}
+	if rustKeywords[id] {
+		id += "_"
+	}
+	return id
+}
+
+// assertMessagePlaceholder matches a {placeholder} of an -assert-message template.
+var assertMessagePlaceholder = regexp.MustCompile(`\{([^}]*)\}`)
+
+// validateAssertMessage checks that the template only uses known placeholders.
+func validateAssertMessage(template string) error {
+	for _, match := range assertMessagePlaceholder.FindAllStringSubmatch(template, -1) {
+		if !assertMessagePlaceholders[match[1]] {
+			return fmt.Errorf("unknown placeholder {%s} in -assert-message, expected one of {file}, {line}, {index}", match[1])
+		}
+	}
+	return nil
+}
+
+// assertMessageArguments returns the optional message arguments for an assert_eq!,
+// or an empty string when no -assert-message template is set.
+func (g *Generator) assertMessageArguments(path string, line int, index int) string {
+	if len(g.AssertMessage) == 0 {
+		return ""
+	}
+	message := strings.NewReplacer(
+		"{file}", path,
+		"{line}", fmt.Sprint(line),
+		"{index}", fmt.Sprint(index),
+	).Replace(g.AssertMessage)
+	// Pass the message as an argument, so braces in it are not taken as format specifiers.
+	return fmt.Sprintf("\"{}\", %s", rustString(message))
+}
+
+// printedValue returns the expression for the i-th printed value as a string.
+func (g *Generator) printedValue(i int) string {
+	if g.SnapshotOutput {
+		return fmt.Sprintf("printed[%d]", i)
+	}
+	return strings.ReplaceAll(g.OutputAccessor, "{i}", fmt.Sprint(i)) + ".to_string()"
+}
+
+// writeSnapshot copies the printed values once the program has run, so that assertions
+// are made against that copy and the VM's buffer is left untouched.
+func (g *Generator) writeSnapshot(outputFile io.StringWriter, indentationLevel int) {
+	if g.SnapshotOutput {
+		writeLine(outputFile, fmt.Sprintf("let printed: Vec<String> = %s.iter().map(|v| v.to_string()).collect();", g.PrintedValues), indentationLevel)
+	}
+}
+
+// isFloatValue reports whether an expected value is a number with a fractional part or an exponent,
+// e.g. 0.3 or 1e-7, which -float-epsilon compares as a number.
+func isFloatValue(value string) bool {
+	_, err := strconv.ParseFloat(value, 64)
+	return err == nil && strings.ContainsAny(value, ".eE")
+}
+
+// writeValueAssertion writes the assertion of an expected value against a printed one: a match
+// of the regular expression of an `// expect-regex: ` value, a comparison within -float-epsilon
+// for a fractional number if it is set, else of the text.
+func (g *Generator) writeValueAssertion(outputFile io.StringWriter, expected string, pattern bool, actual string, message string, indentationLevel int) {
+	if pattern {
+		regex := "^(?:" + expected + ")$"
+		hashes := rawStringHashes([]string{regex})
+		writeLine(outputFile, "{", indentationLevel)
+		writeLine(outputFile, fmt.Sprintf("let value = &%s;", actual), indentationLevel+1)
+		writeLine(outputFile, "assert!(", indentationLevel+1)
+		writeLine(outputFile, fmt.Sprintf("regex::Regex::new(r%s\"%s\"%s).unwrap().is_match(value),", hashes, regex, hashes), indentationLevel+2)
+		if len(message) > 0 {
+			writeLine(outputFile, message, indentationLevel+2)
+		} else {
+			writeLine(outputFile, fmt.Sprintf("\"expected a match of {}, got {:?}\", r%s\"%s\"%s, value", hashes, expected, hashes), indentationLevel+2)
+		}
+		writeLine(outputFile, ");", indentationLevel+1)
+		writeLine(outputFile, "}", indentationLevel)
+		return
+	}
+	if g.FloatEpsilon <= 0 || !isFloatValue(expected) {
+		writeAssertEq(outputFile, rustString(expected), actual, message, indentationLevel)
+		return
+	}
+	value, _ := strconv.ParseFloat(expected, 64)
+	epsilon := strconv.FormatFloat(g.FloatEpsilon, 'g', -1, 64) + "_f64"
+	// In a block of its own, so that the names do not clash with those of the next assertion.
+	writeLine(outputFile, "{", indentationLevel)
+	writeLine(outputFile, fmt.Sprintf("let value = &%s;", actual), indentationLevel+1)
+	writeLine(outputFile, "let number: f64 = value.parse().unwrap_or(f64::NAN);", indentationLevel+1)
+	writeLine(outputFile, "assert!(", indentationLevel+1)
+	writeLine(outputFile, fmt.Sprintf("(number - %s_f64).abs() <= %s,", strconv.FormatFloat(value, 'g', -1, 64), epsilon), indentationLevel+2)
+	if len(message) > 0 {
+		writeLine(outputFile, message, indentationLevel+2)
+	} else {
+		writeLine(outputFile, fmt.Sprintf("\"expected a number within {} of {}, got {:?}\", %s, %s, value", epsilon, rustString(expected)), indentationLevel+2)
+	}
+	writeLine(outputFile, ");", indentationLevel+1)
+	writeLine(outputFile, "}", indentationLevel)
+}
+
+// writeAssertEq writes an assert_eq! for the given expected and actual expressions.
+func writeAssertEq(outputFile io.StringWriter, expected string, actual string, message string, indentationLevel int) {
+	writeLine(outputFile, "assert_eq!(", indentationLevel)
+	writeLine(outputFile, expected+",", indentationLevel+1)
+	if len(message) > 0 {
+		writeLine(outputFile, actual+",", indentationLevel+1)
+		writeLine(outputFile, message, indentationLevel+1)
+	} else {
+		writeLine(outputFile, actual, indentationLevel+1)
+	}
+	writeLine(outputFile, ");", indentationLevel)
+}
+
+// DEFAULT_TEMPLATES are the text/template templates of the generated Rust, which -template-dir
+// can replace one by one. Each of them gets the data of its *TemplateData struct, and writes
+// the text generated in between, such as the tests of a module, with {{.Body}}.
+var DEFAULT_TEMPLATES = map[string]string{
+	"file.tmpl": `{{if .Doctest}}/// Lox examples checked by ` + "`cargo test --doc`" + `.
+pub mod doctests {
+{{else if .Integration}}//! Lox tests run against the public API of the library.
+use {{.Import}};
+{{else}}#[cfg(test)]
+mod tests {
+    use super::*;
+{{end}}{{.Body}}{{if not .Integration}}}
+{{end}}`,
+	"module.tmpl": `{{range .Attributes}}{{$.Indent}}{{.}}
+{{end}}{{.Indent}}{{with .Visibility}}{{.}} {{end}}mod {{.Name}} {
+{{if not .Doctest}}{{.Indent}}    use super::*;
+{{end}}{{.Body}}{{.Indent}}}
+`,
+	"test.tmpl": `{{.Indent}}#[test]
+{{range .Attributes}}{{$.Indent}}{{.}}
+{{end}}{{.Indent}}{{with .Visibility}}{{.}} {{end}}fn {{.Name}}(){{if not .ShouldPanic}} -> {{.ResultType}}{{end}} {
+{{if .IncludePath}}{{.Indent}}    let source = include_str!({{.IncludePath}}).to_string();
+{{else}}{{.Indent}}    let source = r{{.Hashes}}"
+{{range .Source}}{{.}}
+{{end}}"{{.Hashes}}
+{{.Indent}}    .to_string();
+{{end}}{{.Indent}}    let mut vm = {{.Constructor}};
+{{range .Setup}}{{$.Indent}}    {{.}}
+{{end}}{{.Body}}{{if not .ShouldPanic}}{{.Indent}}    Ok(())
+{{end}}{{.Indent}}}
+`,
+}
+
+// fileTemplateData is the data of file.tmpl, the top level module of the generated file.
+type fileTemplateData struct {
+	// Set with -doctest.
+	Doctest bool
+	// Set with -integration, along with the use path of -integration-import.
+	Integration bool
+	Import      string
+	Body        string
+}
+
+// moduleTemplateData is the data of module.tmpl, the module of a test directory or of a part of one.
+type moduleTemplateData struct {
+	Indent string
+	// Lines such as #[cfg(feature = "closures")], written before the module.
+	Attributes []string
+	// Empty, pub or pub(crate).
+	Visibility string
+	Name       string
+	Doctest    bool
+	Body       string
+}
+
+// testTemplateData is the data of test.tmpl, a test function. Its Body holds the assertions.
+type testTemplateData struct {
+	Indent string
+	// Attributes after #[test], e.g. #[ignore = "..."].
+	Attributes []string
+	// Empty, or pub(super) for the per-file modules of -per-file-module.
+	Visibility string
+	Name       string
+	// Lines of the Lox program.
+	Source []string
+	// Hashes delimiting the raw string of the source, see rawStringHashes.
+	Hashes string
+	// With -include-source, the path of the .lox file relative to the generated file, as a string literal.
+	IncludePath string
+	// Statements run on the VM before interpreting, e.g. for `// gc: stress`.
+	Setup []string
+	// The -vm-constructor expression and the -result-type of the test functions.
+	Constructor string
+	ResultType  string
+	// Set for a #[should_panic] test, which returns nothing.
+	ShouldPanic bool
+	Body        string
+}
+
+// TEMPLATE_BODY stands for the body while a template is executed, see writeTemplate.
+const TEMPLATE_BODY = "\x00body\x00"
+
+// loadTemplates parses the default templates, replaced by those in -template-dir.
+func (g *Generator) loadTemplates() error {
+	g.templates = template.New("templates")
+	for name, text := range DEFAULT_TEMPLATES {
+		if len(g.TemplateDirectory) > 0 {
+			data, err := ioutil.ReadFile(filepath.Join(g.TemplateDirectory, name))
+			if err == nil {
+				text = string(data)
+			} else if !errors.Is(err, fs.ErrNotExist) {
+				return err
+			}
+		}
+		if _, err := g.templates.New(name).Parse(text); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// writeTemplate executes a template, whose data has TEMPLATE_BODY as its Body.
+// writeBody writes the body where the template has it, straight to the output,
+// so the line numbers of -map-out stay right.
+func (g *Generator) writeTemplate(outputFile io.StringWriter, name string, data interface{}, writeBody func()) {
+	var text strings.Builder
+	if err := g.templates.ExecuteTemplate(&text, name, data); err != nil {
+		g.reportError(err)
+		return
+	}
+	before, after, found := strings.Cut(text.String(), TEMPLATE_BODY)
+	outputFile.WriteString(before)
+	if found {
+		writeBody()
+	}
+	outputFile.WriteString(after)
+}
+
+// emitter writes the tests parsed from the .lox files in the language of a backend.
+// Reading, selecting and naming the tests is the same for every backend.
+type emitter interface {
+	// writeFile writes the output file, calling writeModules with their level where the modules
+	// of the top level directories go.
+	writeFile(outputFile io.StringWriter, writeModules func(indentationLevel int))
+	// writeModule writes the module of an input directory and its tests. parentPath is the path of the
+	// enclosing module, as returned by the backend, and is empty for top level directories.
+	// writeSubmodules writes the modules of the subdirectories, given the path and the level of this one.
+	writeModule(outputFile io.StringWriter, moduleName string, parentPath string, tests []testFile, indentationLevel int,
+		writeSubmodules func(modulePath string, indentationLevel int))
+	// writeTest writes the test of a .lox file.
+	writeTest(outputFile io.StringWriter, test testFile, indentationLevel int)
+}
+
+// rustEmitter writes Rust tests calling the VM of this crate, in a tests module of the crate.
+type rustEmitter struct {
+	*Generator
+}
+
+func (g rustEmitter) writeFile(outputFile io.StringWriter, writeModules func(indentationLevel int)) {
+	// Write the top level tests module.
+	// Doctests are compiled without cfg(test), as users of the library.
+	// An integration test is a crate of its own, whose modules are at the top level.
+	g.writeHeader(outputFile, ".")
+	data := fileTemplateData{Doctest: g.Doctest, Integration: g.Integration, Import: g.IntegrationImport, Body: TEMPLATE_BODY}
+	indentationLevel := 1
+	if g.Integration {
+		indentationLevel = 0
+	}
+	g.writeTemplate(outputFile, "file.tmpl", data, func() {
+		writeModules(indentationLevel)
+
+		if !g.Doctest {
+			if g.SummaryTest {
+				g.writeSummaryTest(outputFile, indentationLevel)
+			}
+			g.writeTestCount(outputFile, indentationLevel)
+		}
+	})
+}
+
+func (g rustEmitter) writeModule(outputFile io.StringWriter, moduleName string, parentPath string, tests []testFile, indentationLevel int,
+	writeSubmodules func(modulePath string, indentationLevel int)) {
+	outputFile.WriteString("\n")
+	moduleIdentifier := g.directoryModule(moduleName)
+	modulePath := moduleIdentifier
+	data := moduleTemplateData{
+		Indent:  strings.Repeat("    ", indentationLevel),
+		Name:    moduleIdentifier,
+		Doctest: g.Doctest,
+		Body:    TEMPLATE_BODY,
+	}
+	if feature := g.moduleFeature(moduleName); len(feature) > 0 {
+		data.Attributes = append(data.Attributes, featureAttribute(feature))
+	}
+	if g.Doctest {
+		data.Visibility = "pub"
+	} else if len(parentPath) > 0 {
+		// Nested modules are listed in the test count from the top level module.
+		modulePath = parentPath + "::" + moduleIdentifier
+		data.Visibility = "pub(crate)"
+	}
+	g.writeTemplate(outputFile, "module.tmpl", data, func() {
+		g.writeModuleBody(outputFile, modulePath, tests, indentationLevel, writeSubmodules)
+	})
+}
+
+func (g rustEmitter) writeTest(outputFile io.StringWriter, test testFile, indentationLevel int) {
+	if g.Doctest {
+		outputFile.WriteString("\n")
+		g.writeDoctest(outputFile, test, indentationLevel)
+		return
+	}
+
+	outputFile.WriteString("\n")
+	if g.PerFileModule {
+		// Wrap the test in its own module, so it can be selected with `cargo test <module>::<file>::`.
+		writeLine(outputFile, fmt.Sprintf("mod %s {", identifier(test.uniqueName)), indentationLevel)
+		writeLine(outputFile, "use super::*;", indentationLevel+1)
+		outputFile.WriteString("\n")
+		indentationLevel++
+	}
+
+	if _, ok := g.panicExpectation(test); ok {
+		// The test only passes if interpreting panics, nothing is asserted after it.
+		testName := identifier(test.uniqueName + "_test")
+		if g.PerFileModule {
+			testName = "run"
+		}
+		g.writeTestFunction(outputFile, test, testName, indentationLevel, func(indentationLevel int) {
+			writeLine(outputFile, "let _ = "+g.interpret("source")+";", indentationLevel)
+		})
+	} else if g.ExplodeExpectations && len(test.expectedValues) > 0 && len(g.ReferenceDirectory) == 0 {
+		// One test for each expected value. Each of them runs the whole program again,
+		// so this is slower, but shows exactly which expectations fail.
+		for i, expected := range test.expectedValues {
+			testName := identifier(fmt.Sprintf("%s_expect_%d", test.uniqueName, i))
+			if g.PerFileModule {
+				testName = fmt.Sprintf("expect_%d", i)
+			}
+			if i > 0 {
+				outputFile.WriteString("\n")
+			}
+			g.writeTestFunction(outputFile, test, testName, indentationLevel, func(indentationLevel int) {
+				writeLine(outputFile, g.interpret("source")+"?;", indentationLevel)
+				g.writeSnapshot(outputFile, indentationLevel)
+				g.writeValueAssertion(outputFile, expected.value, test.regexValues[i], g.printedValue(i),
+					g.assertMessageArguments(test.path, expected.line, i), indentationLevel)
+			})
+		}
+	} else {
+		testName := identifier(test.uniqueName + "_test")
+		if g.PerFileModule {
+			testName = "run"
+		}
+		g.writeTestFunction(outputFile, test, testName, indentationLevel, func(indentationLevel int) {
+			g.writeAssertions(outputFile, test, indentationLevel)
+			g.writeDirectiveAssertions(outputFile, test, indentationLevel)
+		})
+	}
+
+	if g.PerFileModule {
+		// Closing bracket for the file's module.
+		writeLine(outputFile, "}", indentationLevel-1)
+	}
+}
+
+// interpret returns the -interpret-call expression interpreting source, a Rust expression.
+func (g *Generator) interpret(source string) string {
+	return strings.ReplaceAll(g.InterpretCall, "{source}", source)
+}
+
+// writeVM writes the creation of the VM, followed by the test's setup statements.
+func (g *Generator) writeVM(outputFile io.StringWriter, test testFile, indentationLevel int) {
+	writeLine(outputFile, "let mut vm = "+g.VmConstructor+";", indentationLevel)
+	for _, statement := range g.setupStatements(test) {
+		writeLine(outputFile, statement, indentationLevel)
+	}
+}
+
+// testTimeout returns how long a test may run for, 0 if there is no limit.
+func (g *Generator) testTimeout(test testFile) time.Duration {
+	if len(test.timeout.value) == 0 {
+		return g.DefaultTimeout
+	}
+	// Checked by parseModule.
+	duration, _ := time.ParseDuration(test.timeout.value)
+	return duration
+}
+
+// setupStatements returns the statements configuring the VM of a test: enabling GC stress,
+// then giving it the lines of its `// input: ` comments.
+func (g *Generator) setupStatements(test testFile) []string {
+	var statements []string
+	if test.gcStress {
+		statements = append(statements, g.GcStressSetup)
+	}
+	if len(test.input) > 0 {
+		input := rustString(stdinText(test))
+		statements = append(statements, strings.ReplaceAll(g.StdinSetup, "{input}", input))
+	}
+	return statements
+}
+
+// missingHook returns an error if the test needs a part of the VM API whose option is not set.
+// rlox has none of them, so they have no defaults.
+func (g *Generator) missingHook(test testFile) error {
+	switch {
+	case test.gcStress && len(g.GcStressSetup) == 0:
+		return fmt.Errorf("%s: // gc: stress needs -gc-stress-setup, the statement enabling GC stress on the VM, e.g. vm.set_gc_stress(true);", test.path)
+	case len(test.input) > 0 && len(g.StdinSetup) == 0:
+		return fmt.Errorf("%s: // input: needs -stdin-setup, the statement giving the VM its standard input, e.g. vm.set_input({input});", test.path)
+	case len(test.expectedCompileError.value) > 0 && len(g.CompileEntryPoint) == 0:
+		return fmt.Errorf("%s:%d: // expect compile error: needs -compile-entry, the expression compiling the source without running it, e.g. vm.compile(source)",
+			test.path, test.expectedCompileError.line)
+	case len(test.expectedStreams) > 0 && len(g.MergedOutputAccessor) == 0:
+		return fmt.Errorf("%s:%d: // expect out: and // expect err: need -merged-output-accessor, the expression for the VM's merged output, e.g. vm.output_log",
+			test.path, test.expectedStreams[0].line)
+	}
+	return nil
+}
+
+// stdinText returns what a test reads from its standard input, each `// input: ` line ending with a newline.
+func stdinText(test testFile) string {
+	if len(test.input) == 0 {
+		return ""
+	}
+	return strings.Join(test.input, "\n") + "\n"
+}
+
+// writeTestFunction writes a test function that interprets the test's source,
+// with writeBody writing the assertions about the result.
+func (g *Generator) writeTestFunction(outputFile io.StringWriter, test testFile, testName string, indentationLevel int, writeBody func(indentationLevel int)) {
+	if output, ok := outputFile.(*outputBuffer); ok {
+		name := testName
+		if g.PerFileModule {
+			name = identifier(test.uniqueName) + "::" + name
+		}
+		name = "tests::" + g.currentModulePath + "::" + name
+		entry := testMapEntry{Name: name, Source: test.path, Line: output.lines + 1}
+		if len(g.SplitOutput) > 0 {
+			entry.File = filepath.ToSlash(g.currentOutputFile)
+		}
+		g.testMap = append(g.testMap, entry)
+	}
+	data := testTemplateData{
+		Indent: strings.Repeat("    ", indentationLevel),
+		Name:   testName,
+		Source: test.source,
+		Hashes: rawStringHashes(test.source),
+		Setup:  g.setupStatements(test),
+		Body:   TEMPLATE_BODY,
+
+		Constructor: g.VmConstructor,
+		ResultType:  g.ResultType,
+	}
+	if g.IncludeSource {
+		includePath, err := g.sourceIncludePath(test)
+		if err != nil {
+			g.reportError(err)
+		}
+		data.IncludePath = rustString(includePath)
+	}
+	if len(g.ignoreReason) > 0 {
+		data.Attributes = append(data.Attributes, fmt.Sprintf("#[ignore = %s]", rustString(g.ignoreReason)))
+	} else if test.knownFailure {
+		data.Attributes = append(data.Attributes, fmt.Sprintf("#[ignore = %s]", rustString(KNOWN_FAILURE_REASON)))
+	}
+	if message, ok := g.panicExpectation(test); ok {
+		data.ShouldPanic = true
+		if len(message) > 0 {
+			data.Attributes = append(data.Attributes, fmt.Sprintf("#[should_panic(expected = %s)]", rustString(message)))
+		} else {
+			data.Attributes = append(data.Attributes, "#[should_panic]")
+		}
+	}
+	if timeout := g.testTimeout(test); timeout > 0 {
+		data.Attributes = append(data.Attributes, strings.ReplaceAll(g.TimeoutAttribute, "{ms}", strconv.FormatInt(timeout.Milliseconds(), 10)))
+	}
+	if len(test.tags) > 0 {
+		// Shown by rustdoc and IDEs, and kept in the source for grep.
+		data.Attributes = append(data.Attributes, fmt.Sprintf("#[doc = %s]", rustString("Tags: "+strings.Join(test.tags, ", "))))
+		if len(g.TagAttribute) > 0 {
+			for _, tag := range test.tags {
+				data.Attributes = append(data.Attributes, strings.ReplaceAll(g.TagAttribute, "{tag}", tag))
+			}
+		}
+	}
+	if g.PerFileModule {
+		// Visible to the parent module, which lists all of its tests.
+		data.Visibility = "pub(super)"
+	}
+	if data.ShouldPanic {
+		// Not a fn() -> ResultType, it cannot be listed in TESTS.
+	} else if g.PerFileModule {
+		g.moduleTests = append(g.moduleTests, identifier(test.uniqueName)+"::"+testName)
+	} else {
+		g.moduleTests = append(g.moduleTests, testName)
+	}
+	g.writeTemplate(outputFile, "test.tmpl", data, func() {
+		writeBody(indentationLevel + 1)
+	})
+}
+
+// sourceIncludePath returns the path of a test's source relative to the directory of the generated file,
+// which is where include_str! resolves it from.
+func (g *Generator) sourceIncludePath(test testFile) (string, error) {
+	source, err := filepath.Abs(filepath.Join(g.InputDirectory, filepath.FromSlash(sourcePath(test.moduleName, test.fileName))))
+	if err != nil {
+		return "", err
+	}
+	output, err := filepath.Abs(filepath.Dir(g.currentOutputFile))
+	if err != nil {
+		return "", err
+	}
+	relative, err := filepath.Rel(output, source)
+	if err != nil {
+		return "", err
+	}
+	return filepath.ToSlash(relative), nil
+}
+
+// writeDoctest writes the test as a rustdoc example on an empty function, to be run by
+// `cargo test --doc`. Rustdoc only runs examples of library crates, so the VM has to be
+// reachable through -doctest-import.
+func (g *Generator) writeDoctest(outputFile io.StringWriter, test testFile, indentationLevel int) {
+	var example bytes.Buffer
+	writeLine(&example, fmt.Sprintf("# use %s;", g.DoctestImport), 0)
+	hashes := rawStringHashes(test.source)
+	writeLine(&example, "let source = r"+hashes+"\"", 0)
+	for _, line := range test.source {
+		// Rustdoc hides lines starting with #, unless it is doubled.
+		if strings.HasPrefix(strings.TrimLeft(line, " \t"), "#") {
+			line = strings.Replace(line, "#", "##", 1)
+		}
+		writeLine(&example, line, 0)
+	}
+	writeLine(&example, "\""+hashes, 0)
+	writeLine(&example, ".to_string();", 0)
+	g.writeVM(&example, test, 0)
+	_, panics := g.panicExpectation(test)
+	if panics {
+		// Rustdoc does not check the message of a should_panic example.
+		writeLine(&example, "let _ = "+g.interpret("source")+";", 0)
+	} else {
+		g.writeAssertions(&example, test, 0)
+		g.writeDirectiveAssertions(&example, test, 0)
+		writeLine(&example, "# Ok::<(), "+g.ErrorType+">(())", 0)
+	}
+
+	// The fence has to be longer than any run of backticks in the source.
+	fence := "```"
+	for strings.Contains(example.String(), fence) {
+		fence += "`"
+	}
+
+	writeLine(outputFile, fmt.Sprintf("/// Example generated from %s.", test.path), indentationLevel)
+	writeLine(outputFile, "///", indentationLevel)
+	if len(g.ignoreReason) > 0 || test.knownFailure {
+		writeLine(outputFile, "/// "+fence+"rust,ignore", indentationLevel)
+	} else if panics {
+		writeLine(outputFile, "/// "+fence+"rust,should_panic", indentationLevel)
+	} else {
+		writeLine(outputFile, "/// "+fence+"rust", indentationLevel)
+	}
+	for _, line := range strings.Split(strings.TrimSuffix(example.String(), "\n"), "\n") {
+		writeLine(outputFile, strings.TrimRight("/// "+line, " "), indentationLevel)
+	}
+	writeLine(outputFile, "/// "+fence, indentationLevel)
+	writeLine(outputFile, fmt.Sprintf("pub fn %s() {}", identifier(test.uniqueName+"_test")), indentationLevel)
+}
+
+func (g *Generator) writeAssertions(outputFile io.StringWriter, test testFile, indentationLevel int) {
+	if len(g.ReferenceDirectory) > 0 {
+		// This test compares everything printed with the output of the reference interpreter.
+		reference, err := ioutil.ReadFile(g.referencePath(test.moduleName, test.fileName))
+		if err != nil {
+			g.reportError(err)
+			return
+		}
+		writeLine(outputFile, "#[allow(unused_must_use)]", indentationLevel)
+		writeLine(outputFile, "{ "+g.interpret("source")+"; }", indentationLevel)
+		writeLine(outputFile, "let output: Vec<String> = "+g.PrintedValues+".iter().map(|v| v.to_string()).collect();", indentationLevel)
+		writeAssertEq(outputFile, rustString(strings.TrimSuffix(string(reference), "\n")), "output.join(\"\\n\")",
+			g.assertMessageArguments(test.path, 0, 0), indentationLevel)
+
+	} else if test.empty {
+		// An empty program only has to run without errors.
+		writeLine(outputFile, g.interpret("source")+"?;", indentationLevel)
+
+	} else if len(test.expectedCompileError.value) > 0 {
+		// This test only compiles the source, which has to fail with the expected error.
+		writeLine(outputFile, fmt.Sprintf("let result = %s;", g.CompileEntryPoint), indentationLevel)
+		writeLine(outputFile, "assert!(result.is_err(), \"expected a compile error\");", indentationLevel)
+		writeAssertEq(outputFile, rustString(test.expectedCompileError.value), g.ErrorMessageAccessor,
+			g.assertMessageArguments(test.path, test.expectedCompileError.line, 0), indentationLevel)
+
+	} else if len(test.expectedStreams) > 0 {
+		// This test expects lines on stdout and stderr in a specific order, compared to the merged output of the VM.
+		values := make([]string, 0, len(test.expectedStreams))
+		for _, expected := range test.expectedStreams {
+			values = append(values, rustString(expected.value))
+		}
+		g.writeInterpret(outputFile, test.mustNotError, indentationLevel)
+		writeLine(outputFile, fmt.Sprintf("let log: Vec<String> = %s.iter().map(|(stream, line)| format!(\"{}: {}\", stream, line)).collect();", g.MergedOutputAccessor), indentationLevel)
+		writeAssertEq(outputFile, fmt.Sprintf("vec![%s]", strings.Join(values, ", ")), "log",
+			g.assertMessageArguments(test.path, test.expectedStreams[0].line, 0), indentationLevel)
+
+	} else if len(test.expectedValues) > 0 {
+		// This test expects certain values to be printed, and maybe an error after them.
+		expectsError := len(test.expectedError.value) > 0
+		if expectsError || len(test.expectedExit.value) > 0 && len(test.expectedErrorKind) > 0 {
+			g.writeFailingInterpret(outputFile, test.expectedErrorKind, indentationLevel)
+		} else {
+			writeLine(outputFile, g.interpret("source")+"?;", indentationLevel)
+		}
+		if g.Insta && len(test.regexValues) == 0 {
+			writeLine(outputFile, fmt.Sprintf("let printed: Vec<String> = %s.iter().map(|v| v.to_string()).collect();", g.PrintedValues), indentationLevel)
+			writeLine(outputFile, fmt.Sprintf("insta::assert_snapshot!(%s, printed.join(\"\\n\"));", rustString(identifier(test.uniqueName))), indentationLevel)
+			g.addInstaSnapshot(test)
+		} else if g.WholeOutput && len(test.regexValues) == 0 {
+			values := make([]string, 0, len(test.expectedValues))
+			for _, expected := range test.expectedValues {
+				values = append(values, rustString(expected.value))
+			}
+			writeLine(outputFile, fmt.Sprintf("let printed: Vec<String> = %s.iter().map(|v| v.to_string()).collect();", g.PrintedValues), indentationLevel)
+			writeAssertEq(outputFile, fmt.Sprintf("vec![%s]", strings.Join(values, ", ")), "printed",
+				g.assertMessageArguments(test.path, test.expectedValues[0].line, 0), indentationLevel)
+		} else {
+			g.writeSnapshot(outputFile, indentationLevel)
+
+			// Write one assertion for each expected value, in the order they are printed.
+			for i, expected := range test.expectedValues {
+				g.writeValueAssertion(outputFile, expected.value, test.regexValues[i], g.printedValue(i),
+					g.assertMessageArguments(test.path, expected.line, i), indentationLevel)
+			}
+		}
+		if expectsError {
+			g.writeErrorAssertions(outputFile, test, indentationLevel)
+		}
+
+	} else if len(test.expectedError.value) > 0 {
+		// This test expects a specific error, of the kind the comment says if it does.
+		g.writeFailingInterpret(outputFile, test.expectedErrorKind, indentationLevel)
+		g.writeErrorAssertions(outputFile, test, indentationLevel)
+
+	} else if len(test.expectedErrorKind) > 0 {
+		// This test only has to fail with the kind of error its `// expect exit: ` status stands for.
+		g.writeErrorKindAssertion(outputFile, test.expectedErrorKind, indentationLevel)
+
+	} else if test.noOutput {
+		// This test has to run without printing anything.
+		writeLine(outputFile, g.interpret("source")+"?;", indentationLevel)
+		writeAssertEq(outputFile, "0", g.PrintedValues+".len()", g.assertMessageArguments(test.path, 0, 0), indentationLevel)
+
+	} else if test.mustNotError {
+		// This test only has to run without errors.
+		writeLine(outputFile, g.interpret("source")+"?;", indentationLevel)
+	}
+}
+
+// writeFailingInterpret interprets the source of a test expecting an error, and asserts the
+// error's kind if the test tells it.
+func (g *Generator) writeFailingInterpret(outputFile io.StringWriter, kind string, indentationLevel int) {
+	if len(kind) > 0 {
+		g.writeErrorKindAssertion(outputFile, kind, indentationLevel)
+		return
+	}
+	writeLine(outputFile, "#[allow(unused_must_use)]", indentationLevel)
+	writeLine(outputFile, "{ "+g.interpret("source")+"; }", indentationLevel)
+}
+
+// writeErrorAssertions asserts the error messages of a test, and the line and stack trace of
+// the error when the VM has accessors for them.
+func (g *Generator) writeErrorAssertions(outputFile io.StringWriter, test testFile, indentationLevel int) {
+	if (len(test.expectedErrors) > 1 || g.ExactErrors) && len(g.ErrorMessagesAccessor) > 0 {
+		// Every error of the file is reported, in order.
+		messages := make([]string, 0, len(test.expectedErrors))
+		for _, expected := range test.expectedErrors {
+			messages = append(messages, rustString(expected.value))
+		}
+		if g.ExactErrors {
+			// And no other: the count is checked first for a clearer failure.
+			writeAssertEq(outputFile, strconv.Itoa(len(messages)), g.ErrorMessagesAccessor+".len()",
+				g.assertMessageArguments(test.path, test.expectedError.line, 0), indentationLevel)
+		}
+		writeAssertEq(outputFile, fmt.Sprintf("vec![%s]", strings.Join(messages, ", ")), g.ErrorMessagesAccessor,
+			g.assertMessageArguments(test.path, test.expectedError.line, 0), indentationLevel)
+	} else {
+		// The VM only keeps its latest error, the last one the file expects.
+		latest := latestError(test)
+		writeAssertEq(outputFile, rustString(latest.value), g.ErrorMessageAccessor,
+			g.assertMessageArguments(test.path, latest.line, 0), indentationLevel)
+	}
+	// The line is that of the first error, the VM's latest is only the same one if there are no others.
+	if len(g.ErrorLineAccessor) > 0 && test.expectedErrorLine > 0 && len(test.expectedErrors) == 1 {
+		actual := g.ErrorLineAccessor
+		if !g.IncludeSource {
+			actual = fmt.Sprintf("%s - %d", g.ErrorLineAccessor, SOURCE_LINE_OFFSET)
+		}
+		writeAssertEq(outputFile, strconv.Itoa(test.expectedErrorLine), actual,
+			g.assertMessageArguments(test.path, test.expectedError.line, 0), indentationLevel)
+	}
+	if len(g.StackTraceAccessor) > 0 && len(test.expectedTrace) > 0 {
+		// The VM counts the lines of the generated source, which has one more at the top.
+		offset := SOURCE_LINE_OFFSET
+		if g.IncludeSource {
+			offset = 0
+		}
+		frames := make([]string, 0, len(test.expectedTrace))
+		for _, line := range traceLines(test, offset) {
+			frames = append(frames, rustString(line))
+		}
+		writeAssertEq(outputFile, fmt.Sprintf("vec![%s]", strings.Join(frames, ", ")), g.StackTraceAccessor,
+			g.assertMessageArguments(test.path, test.expectedError.line, 0), indentationLevel)
+	}
+}
+
+// latestError returns the last error a test expects, the one the VM reports last.
+func latestError(test testFile) expectation {
+	if len(test.expectedErrors) == 0 {
+		return test.expectedError
+	}
+	return test.expectedErrors[len(test.expectedErrors)-1]
+}
+
+// writeErrorKindAssertion interprets the source and asserts it fails with the given kind of error.
+func (g *Generator) writeErrorKindAssertion(outputFile io.StringWriter, kind string, indentationLevel int) {
+	writeLine(outputFile, "let result = "+g.interpret("source")+";", indentationLevel)
+	writeLine(outputFile, fmt.Sprintf("assert!(matches!(result, Err(%s::%s)), \"expected a %s, got {:?}\", result);",
+		g.ErrorType, kind, errorDescription(kind)), indentationLevel)
+}
+
+// errorDescription returns how an error kind is described in assertion messages.
+func errorDescription(kind string) string {
+	if kind == RUNTIME_ERROR {
+		return "runtime error"
+	}
+	return "compile error"
+}
+
+// addInstaSnapshot records the snapshot of a test's expected values, named the way insta
+// names the snapshot of an assert_snapshot! in the test's module.
+func (g *Generator) addInstaSnapshot(test testFile) {
+	modulePath := g.InstaCrate + "::tests::" + g.currentModulePath
+	if g.Integration {
+		// The crate of an integration test is named after its file.
+		modulePath = strings.TrimSuffix(filepath.Base(g.OutputFilePath), ".rs") + "::" + g.currentModulePath
+	}
+	if g.PerFileModule {
+		modulePath += "::" + identifier(test.uniqueName)
+	}
+	fileName := strings.ReplaceAll(modulePath, "::", "__") + "__" + identifier(test.uniqueName) + ".snap"
+	g.instaSnapshots[fileName] = fmt.Sprintf("---\nsource: %s\nexpression: \"printed.join(\\\"\\\\n\\\")\"\n---\n%s\n",
+		filepath.ToSlash(g.currentOutputFile), strings.Join(expectedOutput(test), "\n"))
+}
+
+// writeInterpret writes the interpretation of the source, returning early from the test
+// on errors if checkResult is true and ignoring the result otherwise.
+func (g *Generator) writeInterpret(outputFile io.StringWriter, checkResult bool, indentationLevel int) {
+	if checkResult {
+		writeLine(outputFile, g.interpret("source")+"?;", indentationLevel)
+	} else {
+		writeLine(outputFile, "#[allow(unused_must_use)]", indentationLevel)
+		writeLine(outputFile, "{ "+g.interpret("source")+"; }", indentationLevel)
+	}
+}
+
+// writeModule writes the tests of an input directory as a module, with a nested module
+// for each of its subdirectories. parentPath is the path of the enclosing module,
+// relative to the top level tests module, and is empty for top level directories.
+func (g *Generator) writeModule(outputFile io.StringWriter, moduleName string, parentPath string, indentationLevel int) {
+	if g.stopped() {
+		return
+	}
+	tests, subdirectories, err := g.readModule(moduleName)
+	if err != nil {
+		g.reportError(err)
+		return
+	}
+	defer g.enterModule(moduleName)()
+	g.recordModule(moduleName, tests)
+
+	g.backend.writeModule(outputFile, moduleName, parentPath, tests, indentationLevel, func(modulePath string, indentationLevel int) {
+		for _, subdirectory := range subdirectories {
+			g.writeModule(outputFile, subdirectory, modulePath, indentationLevel)
+		}
+	})
+}
+
+// readModule returns the tests of an input directory, with their unique names, and its subdirectories.
+// While Emit writes a suite, they are those Parse read.
+func (g *Generator) readModule(moduleName string) ([]testFile, []string, error) {
+	if g.emittedSuite != nil {
+		if module, ok := g.emittedSuite.modules[moduleName]; ok {
+			return append([]testFile(nil), module.tests...), module.subdirectories, nil
+		}
+	}
+	modFilesInfo, subdirectories, err := g.listModule(moduleName)
+	if err != nil {
+		return nil, nil, err
+	}
+	tests := g.parseModule(moduleName, modFilesInfo)
+	g.disambiguate(tests, subdirectories)
+	return tests, subdirectories, nil
+}
+
+// recordModule adds the tests of the module being written to the summary test and the generation summary.
+func (g *Generator) recordModule(moduleName string, tests []testFile) {
+	if len(g.ignoreReason) == 0 {
+		for _, test := range tests {
+			test.featureCfg = g.featureCfg()
+			g.summaryTests = append(g.summaryTests, test)
+		}
+	}
+	g.moduleSummaries = append(g.moduleSummaries, g.summarizeModule(moduleName, tests))
+	g.recordInputs(moduleName, tests)
+}
+
+// disambiguate sets the unique names of the tests of a module. Names whose identifier is already
+// taken, by another test or by the module of a subdirectory, get a numbered suffix.
+func (g *Generator) disambiguate(tests []testFile, subdirectories []string) {
+	taken := make(map[string]bool)
+	for _, subdirectory := range subdirectories {
+		taken[g.directoryModule(subdirectory)] = true
+	}
+	for i := range tests {
+		name := uniqueName(tests[i].name, taken)
+		if name != tests[i].name {
+			log.Printf("Warning: %s has the same identifier as another test, it is generated as %s.", tests[i].path, identifier(name))
+		}
+		tests[i].uniqueName = name
+	}
+}
+
+// uniqueName returns name, with a numbered suffix if its identifier is already taken, and
+// marks the identifier of the result as taken.
+func uniqueName(name string, taken map[string]bool) string {
+	unique := name
+	for suffix := 2; taken[identifier(unique)]; suffix++ {
+		unique = fmt.Sprintf("%s_%d", name, suffix)
+	}
+	taken[identifier(unique)] = true
+	return unique
+}
+
+// enterModule sets the reason the tests of a directory about to be written are ignored for,
+// and returns the function restoring the one of the enclosing directory.
+func (g *Generator) enterModule(moduleName string) func() {
+	previousReason, previousFeatures := g.ignoreReason, g.moduleFeatures
+	if reason, ok := g.ignoredDirectories[moduleName]; ok {
+		// The subdirectories of an ignored directory are ignored as well.
+		g.ignoreReason = fmt.Sprintf("%s is %s", moduleName, reason)
+	}
+	if feature := g.moduleFeature(moduleName); len(feature) > 0 && !containsString(g.moduleFeatures, feature) {
+		// Those of a gated directory are only compiled along with it.
+		g.moduleFeatures = append(append([]string{}, g.moduleFeatures...), feature)
+	}
+	return func() {
+		g.ignoreReason, g.moduleFeatures = previousReason, previousFeatures
+	}
+}
+
+// parseFeatureGates parses -feature-gates, comma separated pattern=feature pairs, e.g.
+// closure=closures,class/*=classes.
+func parseFeatureGates(list string) ([][2]string, error) {
+	gates := make([][2]string, 0)
+	for _, entry := range strings.Split(list, ",") {
+		if entry = strings.TrimSpace(entry); len(entry) == 0 {
+			continue
+		}
+		parts := strings.SplitN(entry, "=", 2)
+		if len(parts) != 2 || len(strings.TrimSpace(parts[0])) == 0 || !CARGO_FEATURE.MatchString(strings.TrimSpace(parts[1])) {
+			return nil, fmt.Errorf("invalid -feature-gates entry %q, expected directory=feature", entry)
+		}
+		pattern := strings.TrimSpace(parts[0])
+		if _, err := path.Match(pattern, ""); err != nil {
+			return nil, fmt.Errorf("invalid -feature-gates pattern %q: %v", pattern, err)
+		}
+		gates = append(gates, [2]string{pattern, strings.TrimSpace(parts[1])})
+	}
+	return gates, nil
+}
+
+// CARGO_FEATURE matches the names Cargo accepts for features.
+var CARGO_FEATURE = regexp.MustCompile(`^[A-Za-z0-9_][A-Za-z0-9_+.-]*$`)
+
+// moduleFeature returns the feature gating the module of a directory, by its path in the input,
+// or an empty string if -feature-gates has none for it.
+func (g *Generator) moduleFeature(moduleName string) string {
+	for _, gate := range g.featureGates {
+		if matched, _ := path.Match(gate[0], moduleName); matched {
+			return gate[1]
+		}
+	}
+	return ""
+}
+
+// featureAttribute returns the attribute gating a module behind a feature, e.g.
+// #[cfg(feature = "closures")].
+func featureAttribute(feature string) string {
+	return fmt.Sprintf("#[cfg(feature = %s)]", rustString(feature))
+}
+
+// featureCfg returns the cfg predicate of the features the module being written needs, or an
+// empty string if it needs none.
+func (g *Generator) featureCfg() string {
+	predicates := make([]string, 0, len(g.moduleFeatures))
+	for _, feature := range g.moduleFeatures {
+		predicates = append(predicates, "feature = "+rustString(feature))
+	}
+	if len(predicates) == 1 {
+		return predicates[0]
+	}
+	if len(predicates) > 1 {
+		return "all(" + strings.Join(predicates, ", ") + ")"
+	}
+	return ""
+}
+
+// writeModuleBody writes the tests of a directory's module, followed by the modules of its subdirectories.
+func (g *Generator) writeModuleBody(outputFile io.StringWriter, modulePath string, tests []testFile, indentationLevel int,
+	writeSubmodules func(modulePath string, indentationLevel int)) {
+	if g.GroupSize > 0 && len(tests) > g.GroupSize {
+		// Split the tests into numbered submodules of at most groupSize tests each.
+		for part := 1; (part-1)*g.GroupSize < len(tests); part++ {
+			end := part * g.GroupSize
+			if end > len(tests) {
+				end = len(tests)
+			}
+			outputFile.WriteString("\n")
+			data := moduleTemplateData{
+				Indent:     strings.Repeat("    ", indentationLevel+1),
+				Visibility: "pub(crate)",
+				Name:       fmt.Sprintf("part%d", part),
+				Doctest:    g.Doctest,
+				Body:       TEMPLATE_BODY,
+			}
+			if g.Doctest {
+				data.Visibility = "pub"
+			}
+			partTests := tests[(part-1)*g.GroupSize : end]
+			g.writeTemplate(outputFile, "module.tmpl", data, func() {
+				g.writeTests(outputFile, fmt.Sprintf("%s::part%d", modulePath, part), partTests, indentationLevel+2)
+			})
+		}
+	} else {
+		g.writeTests(outputFile, modulePath, tests, indentationLevel+1)
+	}
+
+	writeSubmodules(modulePath, indentationLevel+1)
+}
+
+// writeTests writes the tests of the module at modulePath, relative to the top level tests module,
+// followed by the list of those tests.
+func (g *Generator) writeTests(outputFile io.StringWriter, modulePath string, tests []testFile, indentationLevel int) {
+	g.currentModulePath = modulePath
+	for _, test := range tests {
+		if err := g.missingHook(test); err != nil {
+			g.reportError(err)
+			continue
+		}
+		g.backend.writeTest(outputFile, test, indentationLevel)
+	}
+	if !g.Doctest {
+		count := len(g.moduleTests)
+		g.writeModuleTests(outputFile, indentationLevel)
+		g.generatedModules = append(g.generatedModules, modulePath)
+		if cfg := g.featureCfg(); len(cfg) > 0 {
+			g.gatedModules[modulePath] = gatedModule{Cfg: cfg, Tests: count}
+		}
+	}
+}
+
+// writeModuleTests writes an array of every test in the current module. Its length is part of
+// the type, so a list that does not match the tests written fails to compile.
+func (g *Generator) writeModuleTests(outputFile io.StringWriter, indentationLevel int) {
+	outputFile.WriteString("\n")
+	writeLine(outputFile, fmt.Sprintf("pub(crate) const TESTS: [fn() -> %s; %d] = [", g.ResultType, len(g.moduleTests)), indentationLevel)
+	for _, testPath := range g.moduleTests {
+		writeLine(outputFile, testPath+",", indentationLevel+1)
+	}
+	writeLine(outputFile, "];", indentationLevel)
+	g.generatedTestCount += len(g.moduleTests)
+	g.moduleTests = nil
+}
+
+// writeSummaryTest writes a test running every source, which reports the result for each file
+// and only fails at the end, so a single run shows the whole conformance picture.
+func (g *Generator) writeSummaryTest(outputFile io.StringWriter, indentationLevel int) {
+	outputFile.WriteString("\n")
+	writeLine(outputFile, "#[test]", indentationLevel)
+	writeLine(outputFile, "fn conformance_summary() {", indentationLevel)
+	writeLine(outputFile, "// File, source, expected values and expected error.", indentationLevel+1)
+	writeLine(outputFile, "let cases: &[(&str, &str, &[&str], &str)] = &[", indentationLevel+1)
+	for _, test := range g.summaryTests {
+		if !g.summarized(test) {
+			// These are left to their own tests.
+			continue
+		}
+		values := make([]string, 0, len(test.expectedValues))
+		for _, expected := range test.expectedValues {
+			values = append(values, rustString(expected.value))
+		}
+		if len(test.featureCfg) > 0 {
+			writeLine(outputFile, "#[cfg("+test.featureCfg+")]", indentationLevel+2)
+		}
+		writeLine(outputFile, "(", indentationLevel+2)
+		writeLine(outputFile, rustString(test.path)+",", indentationLevel+3)
+		hashes := rawStringHashes(test.source)
+		writeLine(outputFile, "r"+hashes+"\"", indentationLevel+3)
+		for _, line := range test.source {
+			writeLine(outputFile, line, 0)
+		}
+		writeLine(outputFile, "\""+hashes+",", 0)
+		writeLine(outputFile, fmt.Sprintf("&[%s],", strings.Join(values, ", ")), indentationLevel+3)
+		writeLine(outputFile, rustString(latestError(test).value)+",", indentationLevel+3)
+		writeLine(outputFile, "),", indentationLevel+2)
+	}
+	writeLine(outputFile, "];", indentationLevel+1)
+	writeLine(outputFile, "let mut failures = 0;", indentationLevel+1)
+	writeLine(outputFile, "for &(file, source, expected_values, expected_error) in cases {", indentationLevel+1)
+	writeLine(outputFile, "let mut vm = "+g.VmConstructor+";", indentationLevel+2)
+	writeLine(outputFile, "let result = "+g.interpret("source.to_string()")+";", indentationLevel+2)
+	writeLine(outputFile, "let output: Vec<String> = "+g.PrintedValues+".iter().map(|v| v.to_string()).collect();", indentationLevel+2)
+	writeLine(outputFile, "let passed = if expected_error.is_empty() {", indentationLevel+2)
+	writeLine(outputFile, "result.is_ok() && output.as_slice() == expected_values", indentationLevel+3)
+	writeLine(outputFile, "} else {", indentationLevel+2)
+	writeLine(outputFile, g.ErrorMessageAccessor+" == expected_error", indentationLevel+3)
+	writeLine(outputFile, "};", indentationLevel+2)
+	writeLine(outputFile, "if !passed {", indentationLevel+2)
+	writeLine(outputFile, "failures += 1;", indentationLevel+3)
+	writeLine(outputFile, "}", indentationLevel+2)
+	writeLine(outputFile, "println!(\"{} {}\", if passed { \"PASS\" } else { \"FAIL\" }, file);", indentationLevel+2)
+	writeLine(outputFile, "}", indentationLevel+1)
+	writeLine(outputFile, "println!(\"{} passed, {} failed\", cases.len() - failures, failures);", indentationLevel+1)
+	writeLine(outputFile, "assert_eq!(0, failures);", indentationLevel+1)
+	writeLine(outputFile, "}", indentationLevel)
+}
+
+// summarized reports whether the summary test checks a test. It only runs the source on a VM
+// without any setup, and compares the printed values as text, or the latest error message.
+func (g *Generator) summarized(test testFile) bool {
+	// A panic would stop the summary test.
+	if _, ok := g.panicExpectation(test); ok || len(test.regexValues) > 0 {
+		return false
+	}
+	// Compiling only, the exit status and the merged output need assertions of their own.
+	if len(test.expectedCompileError.value) > 0 || len(test.expectedExit.value) > 0 || len(test.expectedStreams) > 0 {
+		return false
+	}
+	return !test.gcStress && len(test.input) == 0
+}
+
+// writeTestCount writes the total number of generated tests, along with a test comparing it to
+// the tests listed by each module. If the generator drops a test, the count changes and has to be reviewed.
+func (g *Generator) writeTestCount(outputFile io.StringWriter, indentationLevel int) {
+	outputFile.WriteString("\n")
+	writeLine(outputFile, fmt.Sprintf("const GENERATED_TEST_COUNT: usize = %d;", g.generatedTestCount), indentationLevel)
+	outputFile.WriteString("\n")
+	writeLine(outputFile, "#[test]", indentationLevel)
+	writeLine(outputFile, "fn generated_test_count() {", indentationLevel)
+	if len(g.gatedModules) > 0 {
+		// A gated module missing from the build still counts, with the number of tests it has.
+		writeLine(outputFile, "let counts: &[usize] = &[", indentationLevel+1)
+		for _, module := range g.generatedModules {
+			if gate, ok := g.gatedModules[module]; ok {
+				writeLine(outputFile, "#[cfg("+gate.Cfg+")]", indentationLevel+2)
+				writeLine(outputFile, module+"::TESTS.len(),", indentationLevel+2)
+				writeLine(outputFile, "#[cfg(not("+gate.Cfg+"))]", indentationLevel+2)
+				writeLine(outputFile, fmt.Sprintf("%d,", gate.Tests), indentationLevel+2)
+			} else {
+				writeLine(outputFile, module+"::TESTS.len(),", indentationLevel+2)
+			}
+		}
+		writeLine(outputFile, "];", indentationLevel+1)
+		writeLine(outputFile, "assert_eq!(GENERATED_TEST_COUNT, counts.iter().sum::<usize>());", indentationLevel+1)
+		writeLine(outputFile, "}", indentationLevel)
+		return
+	}
+	counts := make([]string, 0, len(g.generatedModules))
+	for _, module := range g.generatedModules {
+		counts = append(counts, module+"::TESTS.len()")
+	}
+	if len(counts) == 0 {
+		counts = append(counts, "0")
+	}
+	writeLine(outputFile, fmt.Sprintf("assert_eq!(GENERATED_TEST_COUNT, %s);", strings.Join(counts, " + ")), indentationLevel+1)
+	writeLine(outputFile, "}", indentationLevel)
+}
@@ -0,0 +1,254 @@
+package loxgen
+
+import (
+	"errors"
+	"fmt"
+	"io/fs"
+	"io/ioutil"
+	"log"
+	"os"
+	"path"
+	"path/filepath"
+	"regexp"
+	"strings"
+)
+
+// Recognized spellings of the expectation markers, and their canonical form.
+var markerForms = []struct {
+	pattern   *regexp.Regexp
+	canonical string
+}{
+	{regexp.MustCompile(`(?i)^//\s*expect\s+runtime\s+error\s*: ?`), "// expect runtime error: "},
+	{regexp.MustCompile(`(?i)^//\s*expect\s+compile\s+error\s*: ?`), "// expect compile error: "},
+	{regexp.MustCompile(`(?i)^//\s*expect\s+out\s*: ?`), "// expect out: "},
+	{regexp.MustCompile(`(?i)^//\s*expect\s+err\s*: ?`), "// expect err: "},
+	{regexp.MustCompile(`(?i)^//\s*expect\s+exit\s*: ?`), "// expect exit: "},
+	{regexp.MustCompile(`(?i)^//\s*expect\s+no\s+error\b`), "// expect no error"},
+	{regexp.MustCompile(`(?i)^//\s*expect\s*: ?`), "// expect: "},
+	{regexp.MustCompile(`(?i)^//\s*no[-_ ]?output\b`), "// no-output"},
+	{regexp.MustCompile(`^//\s*\[\s*(c|java)\s+(?i:line)\s+(\d+)\s*\]\s*(?i:error)\b`), "// [$1 line $2] Error"},
+	{regexp.MustCompile(`(?i)^//\s*\[\s*line\s+(\d+)\s*\]\s*error\b`), "// [line $1] Error"},
+	{regexp.MustCompile(`(?i)^//\s*error\s+at\s+`), "// Error at "},
+	{regexp.MustCompile(`(?i)^//\s*error\s*: ?`), "// Error: "},
+}
+
+// looksLikeMarker matches the comments -strict expects to be one of the knownMarkers.
+var looksLikeMarker = regexp.MustCompile(`(?i)^//\s*(expect|error\b|\[\s*((c|java)\s+)?line\b|no[-_ ]?output\b|gc\s*:|tags?\s*:)`)
+
+// knownMarkers are the exact spellings of the markers parseLines reads.
+var knownMarkers = []*regexp.Regexp{
+	regexp.MustCompile(`^// expect: `),
+	regexp.MustCompile(`^// expect (runtime error|compile error|out|err|exit): `),
+	regexp.MustCompile(`^// expect no error\b`),
+	regexp.MustCompile(`^// expect-regex: `),
+	regexp.MustCompile(`^// expect panic(: |$)`),
+	regexp.MustCompile(`^// no-output\b`),
+	regexp.MustCompile(`^// gc: `),
+	regexp.MustCompile(`^// input: `),
+	regexp.MustCompile(`^// timeout: `),
+	regexp.MustCompile(`^// flaky\b`),
+	regexp.MustCompile(`^// nontest\b`),
+	regexp.MustCompile(`^// tags: `),
+	regexp.MustCompile(`^// \[((c|java) )?line \d+\] Error( at [^:]+)?: `),
+	regexp.MustCompile(`^// \[line \d+\] in \S`),
+	regexp.MustCompile(`^// Error( at [^:]+)?: `),
+}
+
+// lintComments returns an error, with its file and line, for each comment of a test that looks
+// like an expectation marker but is spelled in a way parseLines ignores, which would otherwise
+// leave the test passing without checking what the comment says.
+func (g *Generator) lintComments(test testFile) []error {
+	var problems []error
+	for i, line := range test.source {
+		start := commentStart(line)
+		if start < 0 || !looksLikeMarker.MatchString(line[start:]) {
+			continue
+		}
+		match := customDirectivePattern.FindStringSubmatch(line[start:])
+		known := match != nil && strings.HasPrefix(line[start:], match[0]) && g.directiveHooks[match[1]] != nil
+		for _, marker := range knownMarkers {
+			if marker.MatchString(line[start:]) {
+				known = true
+				break
+			}
+		}
+		if !known {
+			problems = append(problems, fmt.Errorf("%s:%d: unrecognized expectation comment %q",
+				test.path, i+1, line[start:]))
+		}
+	}
+	return problems
+}
+
+// commentStart returns the index of the // starting a comment in a line of Lox, or -1.
+// Lox strings have no escapes, so a quote always starts or ends one.
+func commentStart(line string) int {
+	inString := false
+	for i := 0; i < len(line); i++ {
+		switch {
+		case line[i] == '"':
+			inString = !inString
+		case !inString && strings.HasPrefix(line[i:], "//"):
+			return i
+		}
+	}
+	return -1
+}
+
+// canonicalizeLine rewrites the expectation marker of a line, if it has one, to its
+// canonical form. Code and the expected value itself are left as they are.
+func canonicalizeLine(line string) string {
+	start := commentStart(line)
+	if start < 0 {
+		return line
+	}
+	comment := line[start:]
+	for _, form := range markerForms {
+		if match := form.pattern.FindStringSubmatchIndex(comment); match != nil {
+			marker := string(form.pattern.ExpandString(nil, form.canonical, comment, match))
+			return line[:start] + marker + comment[match[1]:]
+		}
+	}
+	return line
+}
+
+// Canonicalize rewrites the markers of every .lox file under the input directory in place.
+func (g *Generator) Canonicalize() error {
+	_, err := g.rewriteTestFiles("Canonicalized", func(path string, lineNumber int, line string) string {
+		return canonicalizeLine(line)
+	})
+	return err
+}
+
+// Fix normalizes the expectation comments of every .lox file under the input directory in
+// place, see fixLine. With -dry-run, it only lists the files it would change.
+func (g *Generator) Fix() error {
+	changed, err := g.rewriteTestFiles("Fixed", func(path string, lineNumber int, line string) string {
+		fixed, kept := g.fixLine(line)
+		if kept {
+			log.Printf("%s:%d: kept the trailing whitespace of the expected value, remove it by hand if it is not part of it", path, lineNumber)
+		}
+		return fixed
+	})
+	if err != nil {
+		return err
+	}
+	if g.DryRun {
+		log.Printf("%d file(s) to fix.", changed)
+	} else {
+		log.Printf("%d file(s) fixed.", changed)
+	}
+	return nil
+}
+
+// fixLine normalizes a line of a test file: its marker as canonicalizeLine does, a space
+// between the code and the marker, and no trailing whitespace. The whitespace ending the value
+// of a marker is kept, as it may be printed, and kept reports whether there was some.
+func (g *Generator) fixLine(line string) (fixed string, kept bool) {
+	ending := ""
+	if strings.HasSuffix(line, "\r") {
+		line, ending = strings.TrimSuffix(line, "\r"), "\r"
+	}
+	line = canonicalizeLine(line)
+	start := commentStart(line)
+	if start < 0 || !g.isMarker(line[start:]) {
+		return strings.TrimRight(line, " \t") + ending, false
+	}
+	if start > 0 && !strings.ContainsAny(line[start-1:start], " \t") {
+		line = line[:start] + " " + line[start:]
+		start++
+	}
+	if colon := strings.Index(line[start:], ": "); colon >= 0 {
+		value := line[start+colon+2:]
+		return line + ending, strings.TrimRight(value, " \t") != value
+	}
+	return strings.TrimRight(line, " \t") + ending, false
+}
+
+// isMarker reports whether a comment is one of the knownMarkers or a registered directive.
+func (g *Generator) isMarker(comment string) bool {
+	if match := customDirectivePattern.FindStringSubmatch(comment); match != nil && strings.HasPrefix(comment, match[0]) {
+		return g.directiveHooks[match[1]] != nil
+	}
+	for _, marker := range knownMarkers {
+		if marker.MatchString(comment) {
+			return true
+		}
+	}
+	return false
+}
+
+// rewriteTestFiles rewrites each line of every .lox file under the input directory with
+// rewriteLine, and writes back the files that changed, logging done and their path, unless
+// -dry-run is set. It returns how many files changed. The files of an archive cannot be
+// rewritten, so -input must be a directory.
+func (g *Generator) rewriteTestFiles(done string, rewriteLine func(path string, lineNumber int, line string) string) (int, error) {
+	if info, err := os.Stat(g.InputDirectory); err == nil && !info.IsDir() {
+		return 0, errors.New("canonicalize and fix rewrite the test files in place, they need an input directory, not an archive")
+	}
+	changed := 0
+	err := filepath.WalkDir(g.InputDirectory, func(path string, entry fs.DirEntry, err error) error {
+		if err != nil || entry.IsDir() || !strings.HasSuffix(path, ".lox") {
+			return err
+		}
+		data, err := ioutil.ReadFile(path)
+		if err != nil {
+			return err
+		}
+		lines := strings.Split(string(data), "\n")
+		for i, line := range lines {
+			lines[i] = rewriteLine(path, i+1, line)
+		}
+		rewritten := strings.Join(lines, "\n")
+		if rewritten == string(data) {
+			return nil
+		}
+		changed++
+		if g.DryRun {
+			fmt.Println(path)
+			return nil
+		}
+		info, err := entry.Info()
+		if err != nil {
+			return err
+		}
+		log.Printf("%s %s.", done, path)
+		return ioutil.WriteFile(path, []byte(rewritten), info.Mode())
+	})
+	return changed, err
+}
+
+// NEW_TEST_TEMPLATE is the content of the files the new subcommand creates: a program
+// whose test passes as it is, to be replaced with the case to check.
+const NEW_TEST_TEMPLATE = `// TODO: describe what this file tests, then replace the program.
+// Values the program prints are expected in order, one comment for each of them.
+print "replace me"; // expect: replace me
+`
+
+// NewTestFile creates the test file of name, a path under the input directory without
+// the .lox extension, from NEW_TEST_TEMPLATE. Existing files are never overwritten.
+func (g *Generator) NewTestFile(name string) error {
+	if len(name) == 0 {
+		return errors.New("the new subcommand expects the path of the test to create, e.g. new string/unicode_escape")
+	}
+	name = path.Clean(strings.TrimSuffix(filepath.ToSlash(name), ".lox"))
+	if path.IsAbs(name) || name == ".." || strings.HasPrefix(name, "../") {
+		return fmt.Errorf("%s is not inside the input directory", name)
+	}
+	if info, err := os.Stat(g.InputDirectory); err == nil && !info.IsDir() {
+		return fmt.Errorf("cannot create a test in %s, it is not a directory", g.InputDirectory)
+	}
+
+	target := filepath.Join(g.InputDirectory, filepath.FromSlash(name)+".lox")
+	if _, err := os.Stat(target); err == nil {
+		return fmt.Errorf("%s already exists", target)
+	}
+	if err := os.MkdirAll(filepath.Dir(target), 0755); err != nil {
+		return err
+	}
+	if err := ioutil.WriteFile(target, []byte(NEW_TEST_TEMPLATE), 0644); err != nil {
+		return err
+	}
+	log.Printf("Created %s.", target)
+	return nil
+}
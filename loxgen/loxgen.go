@@ -0,0 +1,675 @@
+// Package loxgen generates the Rust tests of rlox from the .lox files of a test directory,
+// laid out like the test suite of craftinginterpreters. Parse reads the tests of a test tree
+// into a Suite, which Emit writes as Rust with a set of Options. A Generator runs the whole
+// generation, or the other subcommands of generate_tests.go, with the options it was created with.
+package loxgen
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"io/fs"
+	"io/ioutil"
+	"log"
+	"os"
+	"path"
+	"path/filepath"
+	"regexp"
+	"strconv"
+	"strings"
+	"text/template"
+	"time"
+)
+
+// Default configuration, see DefaultOptions.
+const DEFAULT_OUTPUT_FILE = "./tests.rs"
+
+// DEFAULT_INTEGRATION_OUTPUT_FILE is the default -output with -integration, which Cargo
+// builds as an integration test named lox.
+const DEFAULT_INTEGRATION_OUTPUT_FILE = "./tests/lox.rs"
+
+const DEFAULT_INPUT_DIRECTORY = "./test/"
+
+const DEFAULT_INCLUDE = "function"
+
+// DEFAULT_KNOWN_FAILURES_FILE is read for -known-failures if it exists.
+const DEFAULT_KNOWN_FAILURES_FILE = "known_failures.txt"
+
+// KNOWN_FAILURE_REASON is what the generated tests of the known failures are ignored with.
+const KNOWN_FAILURE_REASON = "known failure"
+
+// Generator generates the tests of a test tree with a set of Options. It holds what a
+// generation gathers along the way, so each generation needs a Generator of its own.
+type Generator struct {
+	Options
+
+	// Path of the file being generated, OutputFilePath unless -split-output is set.
+	currentOutputFile string
+	// File system the test files are read from: the input directory, or the contents of an archive.
+	inputFS fs.FS
+	// Whether -include was left to its default, which also selects the directories whose
+	// suite.toml sets skip = false.
+	defaultInclude bool
+	// With -ignore-excluded, the reason each directory -include and -exclude leave out is
+	// ignored for, by path.
+	ignoredDirectories map[string]string
+	// Reason the tests being written are ignored for, empty unless they are in an ignored directory.
+	ignoreReason string
+	// Cargo features gating the modules of the directories matching their patterns, from
+	// -feature-gates, in order: the first pattern matching a directory gives its feature.
+	featureGates [][2]string
+	// Features the module being written needs to be compiled, from its directory and those around it.
+	moduleFeatures []string
+	// Cfg predicate and test count of each module of the test count that is gated behind features,
+	// by module path.
+	gatedModules map[string]gatedModule
+	// Patterns of the test files the VM is known not to pass yet, from -known-failures. They are
+	// paths under the input directory, e.g. function/too_many_args.lox, or globs such as closure/*.
+	knownFailures []string
+	// The compiled -run and -filter-expect, and the tags of -tags and -skip-tags.
+	runFilter    *regexp.Regexp
+	filterExpect *regexp.Regexp
+	selectedTags []string
+	skippedTags  []string
+	// With -shard i/n, only the test files of shard shardIndex out of shardCount are generated or run.
+	shardIndex int
+	shardCount int
+	// staleFiles are the generated files -check found out of date.
+	staleFiles []string
+	// Time spent in each phase of the generation, reported with -profile.
+	phaseTimes map[string]time.Duration
+	// Contents of the -insta snapshot files, by file name.
+	instaSnapshots map[string]string
+	// Every test function written, for -map-out.
+	testMap []testMapEntry
+	// Problems found in the test files. Unless -fail-fast is set, generation continues
+	// after an error so that all of them can be reported at once.
+	generationErrors []error
+	// Every test written, for the conformance summary.
+	summaryTests []testFile
+	// Paths, relative to the current module, of the test functions written in it,
+	// except the #[should_panic] tests, which return nothing.
+	moduleTests []string
+	// Path, relative to the top level tests module, of the module being written.
+	currentModulePath string
+	// Generated modules listing their tests, and the total number of tests, used for the generated test count.
+	generatedModules   []string
+	generatedTestCount int
+	// What was generated from each directory, what was skipped and which directories were
+	// left out, for the summary printed after generation.
+	moduleSummaries     []moduleSummary
+	skippedFiles        []string
+	excludedDirectories map[string]bool
+	// directiveHooks are the custom directives, by name: the built-in ones and those of the options.
+	directiveHooks map[string]directiveHook
+	// The templates of the generated file, from DEFAULT_TEMPLATES and -template-dir.
+	templates *template.Template
+	// backend is the emitter the output is written with.
+	backend emitter
+	// recordedInputs are the files the generated tests were made from, in the order they were
+	// written: each test file, along with the defaults and suite.toml of its directory, as its
+	// path followed by its contents. Files the filters left out are not among them.
+	recordedInputs []string
+	// emittedSuite is the suite Emit writes, nil when the tests are read from the input.
+	emittedSuite *Suite
+	// generatorDigest is the hash of what every module is generated with, see generatorHash.
+	generatorDigest string
+}
+
+// New returns a Generator with the options, once they are checked.
+func New(opts Options) (*Generator, error) {
+	g := &Generator{
+		Options:             opts,
+		ignoredDirectories:  make(map[string]string),
+		gatedModules:        make(map[string]gatedModule),
+		phaseTimes:          make(map[string]time.Duration),
+		instaSnapshots:      make(map[string]string),
+		excludedDirectories: make(map[string]bool),
+	}
+	g.backend = rustEmitter{g}
+	g.registerDirectives()
+
+	var err error
+	if len(g.RunPattern) > 0 {
+		if g.runFilter, err = regexp.Compile(g.RunPattern); err != nil {
+			return nil, fmt.Errorf("invalid -run: %v", err)
+		}
+	}
+	if len(g.Shard) > 0 {
+		if g.shardIndex, g.shardCount, err = parseShard(g.Shard); err != nil {
+			return nil, err
+		}
+	}
+	if len(g.FeatureGatesList) > 0 {
+		if g.featureGates, err = parseFeatureGates(g.FeatureGatesList); err != nil {
+			return nil, err
+		}
+	}
+	if len(g.FilterExpectPattern) > 0 {
+		if g.filterExpect, err = regexp.Compile(g.FilterExpectPattern); err != nil {
+			return nil, fmt.Errorf("invalid -filter-expect: %v", err)
+		}
+	}
+	g.selectedTags = tagList(g.TagsList)
+	g.skippedTags = tagList(g.SkipTagsList)
+	if len(g.KnownFailuresPath) > 0 {
+		g.knownFailures, err = loadKnownFailures(g.KnownFailuresPath, true)
+	} else {
+		g.knownFailures, err = loadKnownFailures(DEFAULT_KNOWN_FAILURES_FILE, false)
+	}
+	if err != nil {
+		return nil, err
+	}
+	if len(g.Chapter) > 0 && chapterIndex(g.Chapter) < 0 {
+		return nil, fmt.Errorf("unknown -chapter %q, expected one of %s", g.Chapter, strings.Join(CHAPTERS, ", "))
+	}
+	if len(g.IncludePatterns) == 0 {
+		g.defaultInclude = true
+		g.IncludePatterns = DEFAULT_INCLUDE
+		if len(g.Chapter) > 0 {
+			g.IncludePatterns = "*"
+		}
+	}
+	for _, patterns := range []string{g.IncludePatterns, g.ExcludePatterns} {
+		if err := validatePatterns(patterns); err != nil {
+			return nil, err
+		}
+	}
+	if !strings.Contains(g.TimeoutAttribute, "{ms}") {
+		return nil, errors.New("-timeout-attribute must contain the {ms} placeholder")
+	}
+	if len(g.StdinSetup) > 0 && !strings.Contains(g.StdinSetup, "{input}") {
+		return nil, errors.New("-stdin-setup must contain the {input} placeholder")
+	}
+	if !strings.Contains(g.OutputAccessor, "{i}") {
+		return nil, errors.New("-output-accessor must contain the {i} placeholder")
+	}
+	if err := validateAssertMessage(g.AssertMessage); err != nil {
+		return nil, err
+	}
+	if g.RunFormat != "text" && g.RunFormat != "tap" && g.RunFormat != "github" {
+		return nil, fmt.Errorf("unknown -format %q, expected text, tap or github", g.RunFormat)
+	}
+	if g.IncludeSource {
+		if g.Doctest || g.Lossy {
+			return nil, errors.New("-include-source cannot be used with -doctest or -lossy")
+		}
+		if info, err := os.Stat(g.InputDirectory); err == nil && !info.IsDir() {
+			return nil, errors.New("-include-source needs an input directory, not an archive")
+		}
+	}
+	if g.Record {
+		if info, err := os.Stat(g.InputDirectory); err == nil && !info.IsDir() {
+			return nil, errors.New("-record needs an input directory, not an archive")
+		}
+	}
+	if (g.DryRun || g.Check) && g.Verify {
+		return nil, errors.New("-verify cannot be used with -dry-run or -check, nothing is written to verify")
+	}
+	if g.Integration && (g.Doctest || len(g.SplitOutput) > 0) {
+		return nil, errors.New("-integration cannot be used with -doctest or -split-output")
+	}
+	if len(g.OutputFilePath) == 0 {
+		g.OutputFilePath = DEFAULT_OUTPUT_FILE
+		if g.Integration {
+			g.OutputFilePath = DEFAULT_INTEGRATION_OUTPUT_FILE
+		}
+	}
+	if len(g.CachePath) > 0 && len(g.SplitOutput) == 0 {
+		return nil, errors.New("-cache needs -split-output")
+	}
+	if err := g.loadTemplates(); err != nil {
+		return nil, err
+	}
+	if g.Jobs < 1 {
+		return nil, errors.New("-j must be at least 1")
+	}
+	if g.BenchRuns < 1 {
+		return nil, errors.New("-bench-runs must be at least 1")
+	}
+	if _, ok := DIALECT_MARKERS[g.Dialect]; !ok {
+		return nil, fmt.Errorf("unknown -dialect %q, expected clox or jlox", g.Dialect)
+	}
+	return g, nil
+}
+
+// checkErrorAssertions returns an error if the options ask for assertions the VM has no
+// accessor for.
+func (g *Generator) checkErrorAssertions() error {
+	if g.ExactErrors && len(g.ErrorMessagesAccessor) == 0 {
+		return errors.New("-exact-errors needs -error-messages-accessor to generate tests, VM has no list of its errors")
+	}
+	return nil
+}
+
+// gatedModule is a module compiled only with some Cargo features, whose tests the test count
+// leaves out without them.
+type gatedModule struct {
+	Cfg   string `json:"cfg"`
+	Tests int    `json:"tests"`
+}
+
+// Phases of the generation, whose time is reported with -profile.
+var phases = []string{"discovery", "reading", "parsing", "writing"}
+
+// testMapEntry locates a generated test function, for tooling going from a failure to its fixture.
+type testMapEntry struct {
+	Name   string `json:"name"`
+	Source string `json:"source"`
+	// File the test is written to, only set with -split-output.
+	File string `json:"file,omitempty"`
+	Line int    `json:"line"`
+}
+
+// manifestEntry describes a test file and what it expects, for -manifest.
+type manifestEntry struct {
+	Path           string          `json:"path"`
+	Module         string          `json:"module"`
+	Name           string          `json:"name"`
+	ExpectedOutput []string        `json:"expected_output"`
+	ExpectedErrors []manifestError `json:"expected_errors"`
+	// Expected stdout and stderr lines, e.g. "out: 1".
+	ExpectedStreams []string `json:"expected_streams,omitempty"`
+	// Indices of the expected output values that are regular expressions, from `// expect-regex: `.
+	OutputPatterns []int    `json:"output_patterns,omitempty"`
+	Tags           []string `json:"tags"`
+}
+
+type manifestError struct {
+	Message string `json:"message"`
+	// "CompileError" or "RuntimeError", if the comment says.
+	Kind string `json:"kind,omitempty"`
+	Line int    `json:"line,omitempty"`
+	// "end" or the quoted lexeme the error is reported at, if the comment says.
+	Location string `json:"location,omitempty"`
+	// Lines of the stack trace of a runtime error, innermost call first.
+	StackTrace []string `json:"stack_trace,omitempty"`
+}
+
+// moduleSummary counts the tests generated from one input directory.
+type moduleSummary struct {
+	Module              string `json:"module"`
+	Tests               int    `json:"tests"`
+	WithOutput          int    `json:"with_output"`
+	WithErrors          int    `json:"with_errors"`
+	WithoutExpectations int    `json:"without_expectations"`
+	Ignored             bool   `json:"ignored,omitempty"`
+}
+
+// generationSummary is the summary of a generation, as written by -summary-json.
+type generationSummary struct {
+	Modules             []moduleSummary `json:"modules"`
+	Tests               int             `json:"tests"`
+	WithOutput          int             `json:"with_output"`
+	WithErrors          int             `json:"with_errors"`
+	WithoutExpectations int             `json:"without_expectations"`
+	SkippedFiles        []string        `json:"skipped_files"`
+	ExcludedDirectories []string        `json:"excluded_directories"`
+}
+
+// Placeholders that can be used in the -assert-message template.
+var assertMessagePlaceholders = map[string]bool{"file": true, "line": true, "index": true}
+
+// Rust keywords, and the words reserved for future use, that cannot be used as plain identifiers.
+var rustKeywords = map[string]bool{
+	"as": true, "async": true, "await": true, "break": true, "const": true, "continue": true,
+	"crate": true, "dyn": true, "else": true, "enum": true, "extern": true, "false": true,
+	"fn": true, "for": true, "if": true, "impl": true, "in": true, "let": true, "loop": true,
+	"match": true, "mod": true, "move": true, "mut": true, "pub": true, "ref": true,
+	"return": true, "self": true, "Self": true, "static": true, "struct": true, "super": true,
+	"trait": true, "true": true, "type": true, "unsafe": true, "use": true, "where": true,
+	"while": true, "abstract": true, "become": true, "box": true, "do": true, "final": true,
+	"gen": true, "macro": true, "override": true, "priv": true, "try": true, "typeof": true,
+	"unsized": true, "virtual": true, "yield": true,
+}
+
+// parseList splits a comma separated list into a set, ignoring blank entries.
+func parseList(list string) map[string]bool {
+	set := make(map[string]bool)
+	for _, entry := range strings.Split(list, ",") {
+		entry = strings.TrimSpace(entry)
+		if len(entry) > 0 {
+			set[entry] = true
+		}
+	}
+	return set
+}
+
+// loadKnownFailures reads the patterns of a known failures file: one path or glob under the
+// input directory per line, with blank lines and `#` comments skipped. A missing file is only
+// an error if required.
+func loadKnownFailures(name string, required bool) ([]string, error) {
+	data, err := ioutil.ReadFile(name)
+	if errors.Is(err, fs.ErrNotExist) && !required {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	patterns := make([]string, 0)
+	for i, line := range strings.Split(string(normalizeSource(data)), "\n") {
+		if index := strings.Index(line, "#"); index >= 0 {
+			line = line[:index]
+		}
+		line = strings.TrimSpace(line)
+		if len(line) == 0 {
+			continue
+		}
+		if _, err := path.Match(line, ""); err != nil {
+			return nil, fmt.Errorf("%s:%d: invalid pattern %q: %v", name, i+1, line, err)
+		}
+		patterns = append(patterns, path.Clean(filepath.ToSlash(line)))
+	}
+	return patterns, nil
+}
+
+// isKnownFailure reports whether the test file at name, a path under the input directory,
+// matches one of the known failures.
+func (g *Generator) isKnownFailure(name string) bool {
+	for _, pattern := range g.knownFailures {
+		if matched, _ := path.Match(pattern, name); matched {
+			return true
+		}
+	}
+	return false
+}
+
+// stripComment removes a # comment, unless the # is inside a quoted string.
+func stripComment(line string) string {
+	quote := byte(0)
+	for i := 0; i < len(line); i++ {
+		switch {
+		case quote != 0 && line[i] == quote:
+			quote = 0
+		case quote == 0 && (line[i] == '"' || line[i] == '\''):
+			quote = line[i]
+		case quote == 0 && line[i] == '#':
+			return line[:i]
+		}
+	}
+	return line
+}
+
+// unquote removes the quotes around a config value, processing escapes in double quoted strings.
+func unquote(value string) string {
+	value = strings.TrimSpace(value)
+	if len(value) >= 2 && value[0] == '"' && value[len(value)-1] == '"' {
+		if unquoted, err := strconv.Unquote(value); err == nil {
+			return unquoted
+		}
+	}
+	if len(value) >= 2 && value[0] == '\'' && value[len(value)-1] == '\'' {
+		return value[1 : len(value)-1]
+	}
+	return value
+}
+
+// ReadConfigFile parses the small subset of TOML and YAML needed for the generator options:
+// one `key = value` (TOML) or `key: value` (YAML) pair per line, where the value is a string,
+// boolean or number, or a list of those written `[a, b]` or, in YAML, as `- a` lines
+// following the key. Keys are the names of the command line flags, and `modules` is
+// accepted as another name for `include`.
+func ReadConfigFile(path string) (map[string][]string, error) {
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	return parseConfig(path, data)
+}
+
+// parseConfig parses the contents of a config file, see ReadConfigFile. The path is the one
+// shown in errors, and its extension tells TOML from YAML.
+func parseConfig(path string, data []byte) (map[string][]string, error) {
+	separator := ":"
+	if strings.HasSuffix(path, ".toml") {
+		separator = "="
+	}
+
+	config := make(map[string][]string)
+	key := ""
+	for i, line := range strings.Split(string(data), "\n") {
+		line = strings.TrimSpace(stripComment(line))
+		if len(line) == 0 || line == "---" {
+			continue
+		}
+		if separator == ":" && strings.HasPrefix(line, "- ") && len(key) > 0 {
+			// An item of the YAML list started by the previous key.
+			config[key] = append(config[key], unquote(line[2:]))
+			continue
+		}
+		index := strings.Index(line, separator)
+		if index < 0 {
+			return nil, fmt.Errorf("%s:%d: expected key %s value", path, i+1, separator)
+		}
+		key = strings.TrimSpace(line[:index])
+		value := strings.TrimSpace(line[index+1:])
+		if strings.HasPrefix(value, "[") && strings.HasSuffix(value, "]") {
+			config[key] = []string{}
+			for _, item := range strings.Split(value[1:len(value)-1], ",") {
+				if item = unquote(item); len(item) > 0 {
+					config[key] = append(config[key], item)
+				}
+			}
+		} else if len(value) > 0 {
+			config[key] = []string{unquote(value)}
+		} else {
+			config[key] = []string{}
+		}
+	}
+	return config, nil
+}
+
+// outputBuffer holds the generated file, keeping track of the number of lines written.
+type outputBuffer struct {
+	bytes.Buffer
+	lines int
+}
+
+func (b *outputBuffer) WriteString(text string) (int, error) {
+	b.lines += strings.Count(text, "\n")
+	return b.Buffer.WriteString(text)
+}
+
+// timePhase adds the time elapsed since start to the given phase.
+func (g *Generator) timePhase(phase string, start time.Time) {
+	g.phaseTimes[phase] += time.Since(start)
+}
+
+// phaseTotal returns the time spent in all phases so far.
+func (g *Generator) phaseTotal() time.Duration {
+	var total time.Duration
+	for _, phase := range phases {
+		total += g.phaseTimes[phase]
+	}
+	return total
+}
+
+func (g *Generator) printProfile() {
+	fmt.Fprintln(os.Stderr, "Profile:")
+	for _, phase := range phases {
+		fmt.Fprintf(os.Stderr, "  %-10s %v\n", phase, g.phaseTimes[phase])
+	}
+	fmt.Fprintf(os.Stderr, "  %-10s %v\n", "total", g.phaseTotal())
+}
+
+// reportError records a problem with a test file. The output is only written if there
+// were no errors, and with -fail-fast the first one stops the generation, see stopped.
+func (g *Generator) reportError(err error) {
+	g.generationErrors = append(g.generationErrors, err)
+}
+
+// stopped reports whether -fail-fast stops the generation, as a problem was recorded already.
+// The loops over directories and test files check it to leave the rest of them unread.
+func (g *Generator) stopped() bool {
+	return g.FailFast && len(g.generationErrors) > 0
+}
+
+// ErrFailed is the error of the subcommands whose tests, programs or files failed. Each
+// failure was reported already, so there is nothing more to say than that it failed.
+var ErrFailed = errors.New("failed")
+
+// notWritten logs the problems reportError recorded and returns the error of the output
+// they kept from being written. With -fail-fast, it returns the first and only problem.
+func (g *Generator) notWritten(output string) error {
+	if g.FailFast {
+		return g.generationErrors[0]
+	}
+	for _, err := range g.generationErrors {
+		log.Print(err)
+	}
+	return fmt.Errorf("%d error(s), %s was not written.", len(g.generationErrors), output)
+}
+
+// Suite is the parsed model of a test tree, as Parse returns it for Emit.
+type Suite struct {
+	// The top level directories, in the order their modules are written.
+	Directories []string
+	// Every test, described as in the -manifest file.
+	Tests []manifestEntry
+
+	input   fs.FS
+	modules map[string]suiteModule
+	// Why the tests of directories are ignored with -ignore-excluded, see ignoredDirectories.
+	ignored map[string]string
+}
+
+// suiteModule holds the parsed tests and the subdirectories of a directory of a Suite.
+type suiteModule struct {
+	tests          []testFile
+	subdirectories []string
+}
+
+// Parse reads the test tree of fsys with the options choosing the tests, such as -include or
+// -tags. The tests are those the generator would write: filtered, with their defaults applied
+// and their unique names. The problems found in the test files are returned together.
+func Parse(fsys fs.FS, opts Options) (*Suite, error) {
+	g, err := New(opts)
+	if err != nil {
+		return nil, err
+	}
+	g.inputFS = fsys
+	files, err := g.readDir(".")
+	if err != nil {
+		return nil, err
+	}
+	suite := &Suite{Directories: g.moduleDirectories(files), input: fsys, modules: make(map[string]suiteModule)}
+	var tests []testFile
+	var parse func(moduleName string)
+	parse = func(moduleName string) {
+		if g.stopped() {
+			return
+		}
+		moduleTests, subdirectories, err := g.readModule(moduleName)
+		if err != nil {
+			g.reportError(err)
+			return
+		}
+		suite.modules[moduleName] = suiteModule{moduleTests, subdirectories}
+		tests = append(tests, moduleTests...)
+		for _, subdirectory := range subdirectories {
+			parse(subdirectory)
+		}
+	}
+	for _, name := range suite.Directories {
+		parse(name)
+	}
+	suite.Tests = g.manifest(tests)
+	suite.ignored = g.ignoredDirectories
+	if len(g.generationErrors) > 0 {
+		return nil, errors.Join(g.generationErrors...)
+	}
+	return suite, nil
+}
+
+// Emit returns the generated file of a suite, written with the options. It writes a single
+// file, without -split-output, and nothing to disk.
+func Emit(suite *Suite, opts Options) ([]byte, error) {
+	if len(opts.SplitOutput) > 0 {
+		return nil, errors.New("Emit writes a single file, -split-output cannot be used")
+	}
+	g, err := New(opts)
+	if err != nil {
+		return nil, err
+	}
+	if err := g.checkErrorAssertions(); err != nil {
+		return nil, err
+	}
+	g.inputFS = suite.input
+	g.emittedSuite = suite
+	for name, reason := range suite.ignored {
+		g.ignoredDirectories[name] = reason
+	}
+	g.validateSources(suite.Directories)
+	f := g.emitOutput(suite.Directories)
+	if len(g.generationErrors) > 0 {
+		return nil, errors.Join(g.generationErrors...)
+	}
+	return f.Bytes(), nil
+}
+
+// Generate generates the tests of a test tree, or checks them with the rlox executable for
+// the run and mutate subcommands, or runs another of the subcommands of the command line on
+// it. The tree can be any file system: the directory or the archive OpenInput opens, an
+// embed.FS or a fstest.MapFS all work the same way, since discovery and reading only go
+// through it. Only -include-source refers to the files on disk, by their path under -input.
+// Subcommands whose tests or programs fail report each failure and return ErrFailed.
+func (g *Generator) Generate(input fs.FS, subcommand string) error {
+	if subcommand != "run" {
+		if err := g.checkErrorAssertions(); err != nil {
+			return err
+		}
+	}
+	if subcommand == "compare" && (len(g.CompareBinaryA) == 0 || len(g.CompareBinaryB) == 0) {
+		return errors.New("the compare subcommand needs the two executables to run, with -a and -b")
+	}
+	g.inputFS = input
+	files, err := g.readDir(".")
+	if err != nil {
+		return err
+	}
+	if g.Record {
+		// Write the expectations of the files lacking them instead of generating tests.
+		return g.recordExpectations(files)
+	}
+	switch subcommand {
+	case "run":
+		// Check the tests with the rlox executable instead of generating them.
+		return g.runTests(files)
+	case "coverage":
+		// Compare the tests with the upstream suite instead of generating them.
+		return g.printCoverage(files)
+	case "corpus":
+		// Seed fuzzing with the programs instead of generating tests.
+		return g.exportCorpus(files)
+	case "compare":
+		// Run the tests with two executables and compare them with each other.
+		return g.compareBinaries(files)
+	case "bench":
+		// Time the benchmark programs with the rlox executable instead of generating tests.
+		return g.runBenchmarks()
+	case "affected":
+		// Select the tests changes of the crate affect instead of generating them.
+		return g.printAffected(files)
+	case "mutate":
+		// Check that the tests fail on changed sources, with the rlox executable too.
+		return g.mutateTests(files)
+	}
+	if err := g.writeToFile(files); err != nil {
+		return err
+	}
+	if len(g.BenchesPath) > 0 {
+		if err := g.writeBenchmarks(); err != nil {
+			return err
+		}
+	}
+	if g.Profile {
+		g.printProfile()
+	}
+	if len(g.staleFiles) > 0 {
+		for _, path := range g.staleFiles {
+			fmt.Println(path)
+		}
+		return fmt.Errorf("%d generated file(s) out of date, run go run generate_tests.go without -check to regenerate them.", len(g.staleFiles))
+	}
+	return nil
+}
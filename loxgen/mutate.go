@@ -0,0 +1,146 @@
+package loxgen
+
+import (
+	"fmt"
+	"io/fs"
+	"log"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// mutant is a variant of a test with one change to its source. Its expectations are the
+// test's own, so the test should fail on it.
+type mutant struct {
+	test testFile
+	// Line of the source that was changed.
+	line        int
+	description string
+}
+
+// MUTATED_OPERATORS are the operators mutants swap, and what they swap them with.
+var MUTATED_OPERATORS = map[string]string{
+	"+": "-", "-": "+", "*": "/", "/": "*",
+	"<": ">", ">": "<", "<=": ">=", ">=": "<=",
+	"==": "!=", "!=": "==",
+	"and": "or", "or": "and", "true": "false", "false": "true",
+}
+
+// mutatedToken matches the tokens of a line of Lox code that mutants change, or skip:
+// strings, numbers, words and operators. Strings are matched whole so that their
+// content is never taken for code.
+var mutatedToken = regexp.MustCompile(`"[^"]*"|[0-9]+(\.[0-9]+)?|[A-Za-z_][A-Za-z0-9_]*|[<>=!]=|[-+*/<>]`)
+
+// mutants returns the variants of a test the mutate subcommand runs, each with one of:
+// an operator or a boolean swapped, a number or a string literal changed, or a statement
+// deleted. Only code is changed, the comments holding the expectations are kept.
+// A string spanning several lines is not recognized as such.
+func mutants(test testFile) []mutant {
+	var mutants []mutant
+	add := func(line int, code string, description string) {
+		source := append([]string(nil), test.source...)
+		source[line] = code + source[line][len(codeOf(source[line])):]
+		mutated := test
+		mutated.source = source
+		// A mutant has to pass to survive, whether or not the test fails or passes by chance.
+		mutated.knownFailure, mutated.flaky = false, false
+		mutants = append(mutants, mutant{mutated, line + 1, description})
+	}
+	for i, line := range test.source {
+		code := codeOf(line)
+		for _, match := range mutatedToken.FindAllStringIndex(code, -1) {
+			token := code[match[0]:match[1]]
+			replacement, description := "", ""
+			if swapped, ok := MUTATED_OPERATORS[token]; ok {
+				replacement, description = swapped, fmt.Sprintf("replaced %s with %s", token, swapped)
+			} else if number, err := strconv.ParseFloat(token, 64); err == nil {
+				replacement = strconv.FormatFloat(number+1, 'f', -1, 64)
+				description = fmt.Sprintf("replaced %s with %s", token, replacement)
+			} else if strings.HasPrefix(token, "\"") {
+				replacement = strings.TrimSuffix(token, "\"") + "x\""
+				description = fmt.Sprintf("replaced %s with %s", token, replacement)
+			} else {
+				continue
+			}
+			add(i, code[:match[0]]+replacement+code[match[1]:], description)
+		}
+		if statement := strings.TrimSpace(code); strings.HasSuffix(statement, ";") {
+			add(i, "", "deleted "+statement)
+		}
+	}
+	return mutants
+}
+
+// codeOf returns the part of a line of Lox before its comment.
+func codeOf(line string) string {
+	if start := commentStart(line); start >= 0 {
+		return line[:start]
+	}
+	return line
+}
+
+// MUTANT_TIMEOUT_FACTOR is how many times as long as its test a mutant may run for, unless
+// -timeout or the file sets a timeout, since a swapped operator easily makes a loop endless.
+// It is at least MIN_MUTANT_TIMEOUT, so that the mutants of quick tests are not killed by chance.
+const MUTANT_TIMEOUT_FACTOR = 10
+
+// MIN_MUTANT_TIMEOUT is the shortest time a mutant may run for, see MUTANT_TIMEOUT_FACTOR.
+const MIN_MUTANT_TIMEOUT = time.Second
+
+// mutateTests runs the mutants of every test passing as it is, and reports those the test
+// still passes on: the expectations of the test do not notice the change. A mutant running
+// for longer than its timeout is killed.
+func (g *Generator) mutateTests(files []fs.FileInfo) error {
+	tests, err := g.selectedTests(files)
+	if err != nil {
+		return err
+	}
+
+	var candidates []mutant
+	passing := 0
+	for _, result := range g.runAll(tests) {
+		if len(result.problem) > 0 {
+			log.Printf("Warning: skipping %s, it fails without mutations: %s", result.test.path, result.problem)
+			continue
+		}
+		if len(result.expectedFailure) > 0 {
+			log.Printf("Warning: skipping %s, it is a known failure.", result.test.path)
+			continue
+		}
+		passing++
+		timeout := MUTANT_TIMEOUT_FACTOR * result.duration
+		if timeout < MIN_MUTANT_TIMEOUT {
+			timeout = MIN_MUTANT_TIMEOUT
+		}
+		for _, candidate := range mutants(result.test) {
+			if g.testTimeout(candidate.test) == 0 {
+				candidate.test.timeout.value = timeout.String()
+			}
+			candidates = append(candidates, candidate)
+		}
+	}
+	mutatedTests := make([]testFile, 0, len(candidates))
+	for _, candidate := range candidates {
+		mutatedTests = append(mutatedTests, candidate.test)
+	}
+
+	survived, timedOut := 0, 0
+	for i, result := range g.runAll(mutatedTests) {
+		if len(result.problem) == 0 {
+			survived++
+			fmt.Printf("SURVIVED %s:%d: %s\n", candidates[i].test.path, candidates[i].line, candidates[i].description)
+		} else if strings.HasPrefix(result.problem, "timed out") {
+			timedOut++
+		}
+	}
+	for _, err := range g.generationErrors {
+		log.Print(err)
+	}
+	fmt.Printf("%d mutant(s) of %d test(s): %d killed (%d timed out), %d survived.\n",
+		len(candidates), passing, len(candidates)-survived, timedOut, survived)
+	if survived > 0 || len(g.generationErrors) > 0 {
+		return ErrFailed
+	}
+	return nil
+}
@@ -0,0 +1,275 @@
+package loxgen
+
+import (
+	"runtime"
+	"time"
+)
+
+// Options are the options of a Generator, one for each command line flag.
+type Options struct {
+	// -input: directory, or .zip/.tar/.tar.gz archive, containing the .lox test files
+	InputDirectory string
+	// -output: path of the generated Rust file, DEFAULT_OUTPUT_FILE when empty, or
+	// DEFAULT_INTEGRATION_OUTPUT_FILE with -integration
+	OutputFilePath string
+	// -split-output: write each top level module to a file of its own in this directory instead of -output,
+	// e.g. tests/string.rs, along with a tests/mod.rs declaring them, to include with `#[cfg(test)] mod tests;`.
+	// The generated files of directories that are gone are removed.
+	SplitOutput string
+	// -include: comma separated glob patterns of the test directories to generate; when empty,
+	// DEFAULT_INCLUDE and the directories whose suite.toml sets skip = false, or * with -chapter
+	IncludePatterns string
+	// -exclude: comma separated glob patterns of test directories to leave out, e.g. benchmark,regression;
+	// nested directories are matched by their path, e.g. class/inheritance
+	ExcludePatterns string
+	// -ignore-excluded: generate the directories -include and -exclude leave out as well, with their tests marked #[ignore],
+	// so `cargo test -- --ignored` shows which parts of the suite are not passing yet
+	IgnoreExcluded bool
+	// -allow-empty-source: emit zero-byte .lox files as tests that only check the empty program runs
+	AllowEmptySource bool
+	// -reference-dir: directory of <module>/<file>.lox.ref files holding jlox output to compare against
+	ReferenceDirectory string
+	// -per-file-module: wrap each test in a module named after its file, containing a single `run` test
+	PerFileModule bool
+	// -assert-message: failure message template for generated assertions, may use {file}, {line} and {index}
+	AssertMessage string
+	// -should-panic: generate the tests expecting a runtime error as #[should_panic(expected = "<message>")] tests,
+	// for a VM that still panics instead of reporting the error, like the files with `// expect panic: ` comments
+	ShouldPanic bool
+	// -explode-expectations: write one test per `// expect:` line (each one runs the whole program again)
+	ExplodeExpectations bool
+	// -lossy: replace invalid UTF-8 in test files with the replacement character instead of failing
+	Lossy bool
+	// -summary-test: also write a conformance_summary test that runs every source and reports all failures at once
+	SummaryTest bool
+	// -snapshot-output: assert against a copy of -printed-values taken after the program ran, instead of -output-accessor
+	SnapshotOutput bool
+	// -include-source: read the sources with include_str! from the input directory instead of inlining them,
+	// so editing a .lox file needs no regeneration (not for -doctest nor archives)
+	IncludeSource bool
+	// -whole-output: assert the expected values against everything printed with a single assert_eq! on a Vec,
+	// which also fails on extra output and shows the whole expected and actual output on failure
+	WholeOutput bool
+	// -insta: check the printed values with insta::assert_snapshot! and write the expected output as .snap files,
+	// to be reviewed with `cargo insta review` (needs insta in the dev-dependencies)
+	Insta bool
+	// -insta-snapshots: directory the -insta snapshots are written to, next to the file including the generated tests
+	InstaSnapshotDirectory string
+	// -insta-crate: name of the crate the generated tests are compiled in, which starts the name of the -insta snapshots
+	InstaCrate string
+	// -printed-values: expression for the collection of printed values, copied with -snapshot-output
+	PrintedValues string
+	// -output-accessor: expression returning the {i}-th printed value, used by the generated assertions with -snapshot-output=false
+	OutputAccessor string
+	// -float-epsilon: when above 0, compare the expected values that are fractional numbers, e.g. `// expect: 0.3`, with the printed
+	// number within this tolerance instead of as text, in the generated assertions and the run subcommand
+	FloatEpsilon float64
+	// -vm-constructor: expression creating the VM each generated test runs its source on, bound to vm
+	VmConstructor string
+	// -interpret-call: expression interpreting the source with the VM, {source} standing for the String of the source;
+	// it has to return a Result whose error is -error-type
+	InterpretCall string
+	// -error-message-accessor: expression for the message of the latest error the VM reported
+	ErrorMessageAccessor string
+	// -result-type: type returned by the generated test functions, a Result the VM's errors convert into with ?
+	ResultType string
+	// -error-type: enum of the VM's errors, with CompileError and RuntimeError variants
+	ErrorType string
+	// -fail-fast: stop at the first invalid test file instead of reporting all of them
+	FailFast bool
+	// -doctest: write the tests as rustdoc examples, run by `cargo test --doc` on a library crate
+	Doctest bool
+	// -integration: write a Cargo integration test, by default ./tests/lox.rs, using the public API of the library
+	// instead of a #[cfg(test)] module of the crate; the crate needs a library target exporting the VM
+	Integration bool
+	// -integration-import: use path bringing VM, VMError and VMResult into scope in the -integration test
+	IntegrationImport string
+	// -doctest-import: use path bringing VM and VMError into scope in the generated doctests
+	DoctestImport string
+	// -run: only generate or run the test files whose path in the input, without .lox, matches this regular expression,
+	// e.g. 'string/.*escape'
+	RunPattern string
+	// -feature-gates: comma separated directory=feature pairs gating the modules of the matching test directories behind Cargo
+	// features, e.g. closure=closures,class*=classes, so that only the suites of implemented features are compiled
+	FeatureGatesList string
+	// -shard: only generate or run shard i of n of the test files, written i/n, e.g. 2/4 on the second of four CI machines;
+	// files are assigned to shards by a hash of their path, and stay in theirs as the suite grows
+	Shard string
+	// -filter-expect: only write tests with an expected value or error matching this regular expression
+	FilterExpectPattern string
+	// -stdin-setup: statement giving `vm` the lines of the `// input: ` comments as its standard input, {input} standing for them
+	// as a string, e.g. vm.set_input({input}); the tests of files with `// input: ` comments need it
+	StdinSetup string
+	// -timeout: time a test may run for, unless it has a `// timeout: ` comment of its own, e.g. 10s (default: no limit)
+	DefaultTimeout time.Duration
+	// -tags: only generate or run the test files with one of these comma separated `// tags: ` tags
+	TagsList string
+	// -skip-tags: leave out the test files with one of these comma separated `// tags: ` tags
+	SkipTagsList string
+	// -tag-attribute: attribute written on the tests for each of their tags, {tag} standing for the tag,
+	// e.g. '#[cfg_attr(not(feature = "{tag}"), ignore)]'
+	TagAttribute string
+	// -timeout-attribute: attribute failing a generated test that runs for longer than its timeout, {ms} standing for it in milliseconds;
+	// the default needs ntest as a dev-dependency
+	TimeoutAttribute string
+	// -gc-stress-setup: statement enabling GC stress on `vm`, e.g. vm.set_gc_stress(true); the tests marked `// gc: stress` need it
+	GcStressSetup string
+	// -benches: also write criterion benchmarks of the -bench-directory programs to this file, e.g. benches/lox_benchmarks.rs
+	// (needs criterion in the dev-dependencies and a [[bench]] with harness = false)
+	BenchesPath string
+	// -bench-directory: test directory holding the programs -benches benchmarks, whether or not it is included
+	BenchDirectory string
+	// -bench-import: use path bringing VM into scope in the -benches file
+	BenchImport string
+	// -a: with the compare subcommand, path of the first rlox executable, e.g. the build before a change
+	CompareBinaryA string
+	// -b: with the compare subcommand, path of the rlox executable compared with -a
+	CompareBinaryB string
+	// -bench-runs: with the bench subcommand, number of times each program is timed, after a first run to warm up
+	BenchRuns int
+	// -bench-baseline: with the bench subcommand, JSON file of the timings the programs are compared with
+	BenchBaselinePath string
+	// -bench-threshold: with the bench subcommand, percentage by which the median of a program may exceed its baseline
+	BenchThreshold float64
+	// -update-baseline: with the bench subcommand, write the timings to -bench-baseline instead of comparing with it
+	UpdateBaseline bool
+	// -since: with the affected subcommand, git revision the changed files are taken from
+	AffectedSince string
+	// -changed: with the affected subcommand, comma separated files to consider changed instead of asking git
+	ChangedFiles string
+	// -affected-map: with the affected subcommand, TOML or YAML file mapping glob patterns of source files to lists of
+	// test directory patterns, replacing the built-in mapping of the rlox sources
+	AffectedMapPath string
+	// -cache: with -split-output, keep the content hashes of each module's inputs in this file and only regenerate
+	// the modules whose inputs or options changed (every module is regenerated with -summary-test, -manifest or -insta)
+	CachePath string
+	// -dry-run: print a unified diff of the generated files against the files on disk instead of writing them
+	DryRun bool
+	// -check: write nothing, list the generated files that are out of date and exit with status 1 if there are any
+	Check bool
+	// -verify: check the generated files parse with rustfmt, then that the crate compiles with cargo check --tests
+	Verify bool
+	// -verify-crate: directory of the crate -verify runs cargo check in
+	VerifyCrate string
+	// -template-dir: directory with file.tmpl, module.tmpl or test.tmpl text/template files replacing the built-in
+	// templates of the generated file, of its modules and of each test function (see DEFAULT_TEMPLATES)
+	TemplateDirectory string
+	// -manifest: also write a JSON description of every test file: its path, module, expected output, expected errors and tags
+	ManifestPath string
+	// -map-out: also write a JSON file mapping each generated test to its source file and the line of its #[test] in the output
+	MapOut string
+	// -summary-json: also write the summary printed after generation, of the tests generated per module, the skipped files
+	// and the directories left out, as JSON to this file
+	SummaryJSON string
+	// -compile-entry: expression compiling `source` without running it, returning a Result, e.g. vm.compile(source);
+	// the `// expect compile error:` tests need it
+	CompileEntryPoint string
+	// -group-size: split modules with more than this many test files into part1, part2, ... submodules (0 to disable)
+	GroupSize int
+	// -merged-output-accessor: expression for the VM's merged output, whose iter() yields (stream, line) pairs with stream "out" or "err",
+	// e.g. vm.output_log; the `// expect out:` and `// expect err:` tests need it
+	MergedOutputAccessor string
+	// -rlox: path of the rlox executable the run subcommand checks the tests with,
+	// built without the debug output features (cargo build --no-default-features)
+	RloxBinary string
+	// -j: number of tests the run subcommand runs at the same time
+	Jobs int
+	// -retries: number of times the run subcommand runs a failing test again before reporting it, at least 2 for `// flaky` tests
+	Retries int
+	// -format: how the run subcommand prints its results: text, tap for the Test Anything Protocol,
+	// or github for GitHub Actions annotations on the lines of the failing files
+	RunFormat string
+	// -html: also write the results of the run subcommand to this file as an HTML report with diffs
+	HtmlReportPath string
+	// -report-md: also write the results of the run subcommand to this file as a Markdown summary,
+	// with a table per directory and the diff of each failure, e.g. for a pull request comment
+	MarkdownReportPath string
+	// -known-failures: file listing the tests the VM does not pass yet, one path or glob under the input directory per line:
+	// their generated tests are marked #[ignore = "known failure"], and the run subcommand expects them to fail;
+	// when empty, DEFAULT_KNOWN_FAILURES_FILE if it exists
+	KnownFailuresPath string
+	// -junit: also write the results of the run subcommand to this file as JUnit XML
+	JunitPath string
+	// -dialect: implementation the expectations are read for, clox or jlox: `[c line N]` comments only apply to clox
+	// and `[java line N]` comments only to jlox
+	Dialect string
+	// -error-messages-accessor: expression for every error message the VM reported, in order, e.g. vm.error_messages;
+	// when set, the files expecting several errors assert all of them instead of the latest one
+	ErrorMessagesAccessor string
+	// -exact-errors: assert the count and the messages of every error the VM reported against -error-messages-accessor,
+	// also for files expecting a single error, so that errors no comment expects fail the test
+	ExactErrors bool
+	// -stack-trace-accessor: expression for the lines of the stack trace of the VM's latest runtime error, e.g. vm.stack_trace;
+	// when set, the files with `// [line N] in function()` comments assert them, e.g. "[line 3] in inner()"
+	StackTraceAccessor string
+	// -error-line-accessor: expression for the line the VM reported its latest error on, e.g. vm.latest_error_line;
+	// when set, the tests of files expecting a single error also assert the line of `[line N]` and `// expect runtime error:` comments
+	ErrorLineAccessor string
+	// -profile: print how long discovering, reading, parsing and writing took
+	Profile bool
+	// -require-marker: fail if a test file has no expectation, no error marker and no `// no-output` directive
+	RequireMarker bool
+	// -strict: fail if a comment looks like an expectation but is none of the known markers, e.g. `// expects: 1`
+	Strict bool
+	// -chapter: only generate the tests of the upstream suite the clox test harness runs for this chapter, e.g. chap25_closures;
+	// directories outside the upstream suite are left out, and -include defaults to * unless set
+	Chapter string
+	// -ref: with the sync subcommand, branch, tag or commit of the craftinginterpreters repository to fetch the tests of
+	SyncRef string
+	// -sync-url: with the sync subcommand, URL of the .tar.gz archive of the repository, %s standing for -ref
+	SyncURL string
+	// -sync-timeout: how long downloading the archive of -sync-url may take
+	SyncTimeout time.Duration
+	// -record: instead of generating tests, run the test files without expectations with -rlox and write comments
+	// expecting what it printed into them, to be verified by hand
+	Record bool
+	// -sync-directory: with the sync subcommand, directory to write the tests to (default: -input)
+	SyncDirectory string
+	// -upstream: with the coverage subcommand, directory or archive of the upstream test directory to compare with
+	// (default: downloaded from -sync-url at -ref)
+	UpstreamInput string
+	// -corpus-directory: with the corpus subcommand, cargo-fuzz corpus directory to copy the programs to
+	CorpusDirectory string
+
+	// Command holds the options the generated files are written with, e.g. -include=string,
+	// which their header shows as the command regenerating them.
+	Command []string
+
+	// Custom directives, see RegisterDirective.
+	directives map[string]DirectiveHook
+}
+
+// DefaultOptions returns the default options, which the command line flags default to.
+func DefaultOptions() Options {
+	return Options{
+		InputDirectory:         DEFAULT_INPUT_DIRECTORY,
+		SnapshotOutput:         true,
+		InstaSnapshotDirectory: "src/snapshots",
+		InstaCrate:             "rlox",
+		PrintedValues:          "vm.printed_values",
+		OutputAccessor:         "vm.printed_values[{i}]",
+		VmConstructor:          "VM::new()",
+		InterpretCall:          "vm.interpret({source})",
+		ErrorMessageAccessor:   "vm.latest_error_message",
+		ResultType:             "VMResult",
+		ErrorType:              "VMError",
+		IntegrationImport:      "rlox::vm::vm::*",
+		DoctestImport:          "rlox::vm::vm::*",
+		TimeoutAttribute:       "#[ntest::timeout({ms})]",
+		BenchDirectory:         "benchmark",
+		BenchImport:            "rlox::vm::vm::*",
+		BenchRuns:              10,
+		BenchBaselinePath:      DEFAULT_BENCH_BASELINE,
+		BenchThreshold:         10,
+		AffectedSince:          "HEAD",
+		VerifyCrate:            ".",
+		RloxBinary:             "./target/debug/rlox",
+		Jobs:                   runtime.NumCPU(),
+		RunFormat:              "text",
+		Dialect:                "clox",
+		SyncRef:                "master",
+		SyncURL:                DEFAULT_SYNC_URL,
+		SyncTimeout:            DEFAULT_SYNC_TIMEOUT,
+		CorpusDirectory:        DEFAULT_CORPUS_DIRECTORY,
+	}
+}
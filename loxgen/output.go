@@ -0,0 +1,520 @@
+package loxgen
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"path"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strings"
+	"time"
+)
+
+// writeModuleFile writes the module of a top level directory as a file of its own, for -split-output.
+// The file holds the body of the module, which mod.rs declares.
+func (g *Generator) writeModuleFile(outputFile io.StringWriter, moduleName string) {
+	if g.stopped() {
+		return
+	}
+	g.writeHeader(outputFile, moduleName)
+	tests, subdirectories, err := g.readModule(moduleName)
+	if err != nil {
+		g.reportError(err)
+		return
+	}
+	defer g.enterModule(moduleName)()
+	g.recordModule(moduleName, tests)
+
+	if !g.Doctest {
+		writeLine(outputFile, "use super::*;", 0)
+	}
+	// The module body is written one level up, at the top of the file.
+	g.writeModuleBody(outputFile, g.directoryModule(moduleName), tests, -1, func(modulePath string, indentationLevel int) {
+		for _, subdirectory := range subdirectories {
+			g.writeModule(outputFile, subdirectory, modulePath, indentationLevel)
+		}
+	})
+}
+
+// writeSplitOutput writes each top level module to a file of its own in the -split-output directory,
+// along with a mod.rs declaring them, to be included with `#[cfg(test)] mod tests;`.
+// Cargo then only recompiles the modules whose sources changed. It returns the paths of the files written.
+func (g *Generator) writeSplitOutput(directories []string) ([]string, error) {
+	cache := g.readCache()
+	updatedCache := make(map[string]cacheEntry)
+	files := make(map[string]*outputBuffer)
+	var mod outputBuffer
+	g.currentOutputFile = filepath.Join(g.SplitOutput, "mod.rs")
+	g.writeHeader(&mod, ".")
+	// The hash in the header of mod.rs is that of the hashes of the modules.
+	moduleDigests := make([]string, 0, len(directories))
+	if g.Doctest {
+		writeLine(&mod, "//! Lox examples checked by `cargo test --doc`.", 0)
+	} else {
+		writeLine(&mod, "use super::*;", 0)
+	}
+	for _, name := range directories {
+		fileName := name + ".rs"
+		mod.WriteString("\n")
+		if feature := g.moduleFeature(name); len(feature) > 0 {
+			writeLine(&mod, featureAttribute(feature), 0)
+		}
+		writeLine(&mod, fmt.Sprintf("#[path = %s]", rustString(fileName)), 0)
+		if g.Doctest {
+			writeLine(&mod, fmt.Sprintf("pub mod %s;", g.directoryModule(name)), 0)
+		} else {
+			writeLine(&mod, fmt.Sprintf("mod %s;", g.directoryModule(name)), 0)
+		}
+
+		hash := ""
+		if len(g.CachePath) > 0 {
+			hash = g.moduleHash(name)
+			entry, ok := cache[name]
+			if _, err := os.Stat(filepath.Join(g.SplitOutput, fileName)); ok && err == nil && len(hash) > 0 && entry.Hash == hash && g.cacheUsable() {
+				// The file written last time is still up to date.
+				g.generatedTestCount += entry.TestCount
+				g.generatedModules = append(g.generatedModules, entry.Modules...)
+				g.testMap = append(g.testMap, entry.TestMap...)
+				g.moduleSummaries = append(g.moduleSummaries, entry.Summaries...)
+				g.skippedFiles = append(g.skippedFiles, entry.Skipped...)
+				for module, gate := range entry.Gates {
+					g.gatedModules[module] = gate
+				}
+				moduleDigests = append(moduleDigests, entry.InputHash)
+				updatedCache[name] = entry
+				continue
+			}
+		}
+
+		testCount, modules, testMapEntries := g.generatedTestCount, len(g.generatedModules), len(g.testMap)
+		summaries, skipped := len(g.moduleSummaries), len(g.skippedFiles)
+		var f outputBuffer
+		g.currentOutputFile = filepath.Join(g.SplitOutput, fileName)
+		inputs := len(g.recordedInputs)
+		g.writeModuleFile(&f, name)
+		digest := inputDigest(g.recordedInputs[inputs:])
+		setInputHash(&f, digest)
+		moduleDigests = append(moduleDigests, digest)
+		files[fileName] = &f
+		updatedCache[name] = cacheEntry{
+			InputHash: digest,
+			Hash:      hash,
+			TestCount: g.generatedTestCount - testCount,
+			Modules:   g.generatedModules[modules:],
+			TestMap:   g.testMap[testMapEntries:],
+			Summaries: g.moduleSummaries[summaries:],
+			Skipped:   g.skippedFiles[skipped:],
+		}
+		for _, module := range g.generatedModules[modules:] {
+			if gate, ok := g.gatedModules[module]; ok {
+				entry := updatedCache[name]
+				if entry.Gates == nil {
+					entry.Gates = make(map[string]gatedModule)
+				}
+				entry.Gates[module] = gate
+				updatedCache[name] = entry
+			}
+		}
+	}
+	g.currentOutputFile = filepath.Join(g.SplitOutput, "mod.rs")
+	if !g.Doctest {
+		if g.SummaryTest {
+			g.writeSummaryTest(&mod, 0)
+		}
+		g.writeTestCount(&mod, 0)
+	}
+	setInputHash(&mod, inputDigest(moduleDigests))
+	files["mod.rs"] = &mod
+
+	if len(g.generationErrors) > 0 {
+		return nil, g.notWritten(g.SplitOutput)
+	}
+	if !g.DryRun && !g.Check {
+		if err := os.MkdirAll(g.SplitOutput, 0755); err != nil {
+			return nil, err
+		}
+	}
+	written := make([]string, 0, len(files))
+	for fileName := range files {
+		written = append(written, filepath.Join(g.SplitOutput, fileName))
+	}
+	// Sorted, so that -dry-run prints the diffs in a stable order.
+	sort.Strings(written)
+	for _, path := range written {
+		if err := g.writeOutput(path, files[filepath.Base(path)].Bytes()); err != nil {
+			return nil, err
+		}
+	}
+	if err := g.removeStaleModules(directories); err != nil {
+		return nil, err
+	}
+	if len(g.CachePath) > 0 && !g.DryRun && !g.Check {
+		data, err := json.MarshalIndent(updatedCache, "", "  ")
+		if err != nil {
+			return nil, err
+		}
+		if err := writeFileAtomically(g.CachePath, append(data, '\n')); err != nil {
+			return nil, err
+		}
+	}
+	return written, nil
+}
+
+// removeStaleModules removes the module files of the -split-output directory generated for
+// directories the input no longer has. Files without the marker of generated code are left alone.
+// With -dry-run it prints their removal instead, and with -check it records them as out of date.
+func (g *Generator) removeStaleModules(directories []string) error {
+	entries, err := os.ReadDir(g.SplitOutput)
+	if errors.Is(err, fs.ErrNotExist) {
+		return nil
+	} else if err != nil {
+		return err
+	}
+	kept := map[string]bool{"mod.rs": true}
+	for _, name := range directories {
+		kept[name+".rs"] = true
+	}
+	for _, entry := range entries {
+		if entry.IsDir() || kept[entry.Name()] || filepath.Ext(entry.Name()) != ".rs" {
+			continue
+		}
+		path := filepath.Join(g.SplitOutput, entry.Name())
+		data, err := ioutil.ReadFile(path)
+		if err != nil {
+			return err
+		}
+		if !bytes.HasPrefix(data, []byte(GENERATED_MARKER+"\n")) {
+			continue
+		}
+		switch {
+		case g.Check:
+			g.staleFiles = append(g.staleFiles, path)
+		case g.DryRun:
+			fmt.Print(unifiedDiff(filepath.ToSlash(path), "/dev/null", diffSplit(string(data)), nil))
+		default:
+			if err := os.Remove(path); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// GENERATOR_VERSION is the version of the generator written in the header of the generated files.
+// It changes whenever the same input and options generate different output.
+const GENERATOR_VERSION = "1.0.0"
+
+// GENERATED_MARKER is the first line of every generated Rust file.
+const GENERATED_MARKER = "// Code generated by loxgen; DO NOT EDIT."
+
+// writeHeader writes the comment every generated Rust file starts with: the standard marker of
+// generated code, which editors and review tools recognize, the version and the options of the
+// generator, and a hash of the files under the input directory the file was generated from, "."
+// for all of them.
+func (g *Generator) writeHeader(outputFile io.StringWriter, directory string) {
+	var options []string
+	for _, option := range g.Command {
+		options = append(options, shellQuote(option))
+	}
+	writeLine(outputFile, GENERATED_MARKER, 0)
+	writeLine(outputFile, "// Generator: generate_tests.go "+GENERATOR_VERSION, 0)
+	writeLine(outputFile, "// Command: go run generate_tests.go "+strings.TrimSpace(strings.Join(options, " ")), 0)
+	// The hash is only known once the file is written, see setInputHash.
+	writeLine(outputFile, fmt.Sprintf("// Input: %s (%s)", path.Join(filepath.ToSlash(g.InputDirectory), directory), INPUT_HASH_PLACEHOLDER), 0)
+	outputFile.WriteString("\n")
+}
+
+// INPUT_HASH_PLACEHOLDER stands for the hash of the inputs in the header until the file is
+// written. It is as long as the hash, which replaces it in place.
+var INPUT_HASH_PLACEHOLDER = "sha256:" + strings.Repeat("0", sha256.Size*2)
+
+// recordInputs adds the files of the tests of a module to recordedInputs.
+func (g *Generator) recordInputs(moduleName string, tests []testFile) {
+	for _, name := range []string{DEFAULTS_FILE, SUITE_FILE} {
+		if data, err := fs.ReadFile(g.inputFS, sourcePath(moduleName, name)); err == nil {
+			g.recordedInputs = append(g.recordedInputs, sourcePath(moduleName, name)+"\n"+string(data))
+		}
+	}
+	for _, test := range tests {
+		g.recordedInputs = append(g.recordedInputs, sourcePath(test.moduleName, test.fileName)+"\n"+strings.Join(test.source, "\n"))
+	}
+}
+
+// inputDigest returns the hash of some inputs, as written in headers.
+func inputDigest(inputs []string) string {
+	hash := sha256.New()
+	for _, input := range inputs {
+		fmt.Fprintf(hash, "%d\n%s", len(input), input)
+	}
+	return fmt.Sprintf("sha256:%x", hash.Sum(nil))
+}
+
+// setInputHash replaces the placeholder in the header of a generated file with the hash of
+// its inputs, so that only changes to the files it was made from change it.
+func setInputHash(f *outputBuffer, digest string) {
+	data := f.Bytes()
+	if index := bytes.Index(data, []byte(INPUT_HASH_PLACEHOLDER)); index >= 0 {
+		copy(data[index:], digest)
+	}
+}
+
+// shellSafeArgument matches the arguments a POSIX shell takes as they are.
+var shellSafeArgument = regexp.MustCompile(`^[A-Za-z0-9_@%+=:,./-]+$`)
+
+// shellQuote quotes an argument for a POSIX shell, unless it only has characters no shell treats specially.
+func shellQuote(argument string) string {
+	if shellSafeArgument.MatchString(argument) {
+		return argument
+	}
+	return "'" + strings.ReplaceAll(argument, "'", `'\''`) + "'"
+}
+
+// manifest describes the tests for -manifest. The tags are the directives of each file:
+// compile-only, gc-stress, no-error, no-output, flaky and should-panic, and known-failure for -known-failures.
+func (g *Generator) manifest(tests []testFile) []manifestEntry {
+	entries := make([]manifestEntry, 0, len(tests))
+	for _, test := range tests {
+		entry := manifestEntry{
+			Path:           test.path,
+			Module:         test.moduleName,
+			Name:           test.name,
+			ExpectedOutput: expectedOutput(test),
+			ExpectedErrors: make([]manifestError, 0, len(test.expectedErrors)),
+			Tags:           make([]string, 0),
+		}
+		if len(test.expectedCompileError.value) > 0 {
+			entry.ExpectedErrors = append(entry.ExpectedErrors, manifestError{Message: test.expectedCompileError.value, Kind: COMPILE_ERROR})
+			entry.Tags = append(entry.Tags, "compile-only")
+		}
+		for i, expected := range test.expectedErrors {
+			manifestError := manifestError{Message: expected.value}
+			if i == 0 {
+				// Only the first error is known to be a compile or a runtime error.
+				manifestError.Kind = test.expectedErrorKind
+				manifestError.Line = test.expectedErrorLine
+				manifestError.Location = test.expectedErrorLocation
+				if len(test.expectedTrace) > 0 {
+					manifestError.StackTrace = traceLines(test, 0)
+				}
+			}
+			entry.ExpectedErrors = append(entry.ExpectedErrors, manifestError)
+		}
+		for _, expected := range test.expectedStreams {
+			entry.ExpectedStreams = append(entry.ExpectedStreams, expected.value)
+		}
+		for i := range test.expectedValues {
+			if test.regexValues[i] {
+				entry.OutputPatterns = append(entry.OutputPatterns, i)
+			}
+		}
+		if test.gcStress {
+			entry.Tags = append(entry.Tags, "gc-stress")
+		}
+		if test.mustNotError {
+			entry.Tags = append(entry.Tags, "no-error")
+		}
+		if test.noOutput {
+			entry.Tags = append(entry.Tags, "no-output")
+		}
+		if test.flaky {
+			entry.Tags = append(entry.Tags, "flaky")
+		}
+		if test.knownFailure {
+			entry.Tags = append(entry.Tags, "known-failure")
+		}
+		if _, ok := g.panicExpectation(test); ok {
+			entry.Tags = append(entry.Tags, "should-panic")
+		}
+		entry.Tags = appendTags(entry.Tags, test.tags)
+		entries = append(entries, entry)
+	}
+	return entries
+}
+
+// writeFileAtomically writes data to a temporary file next to path, then renames it
+// over path, so that an interrupted run never leaves a partially written file behind.
+func writeFileAtomically(path string, data []byte) error {
+	f, err := os.CreateTemp(filepath.Dir(path), "."+filepath.Base(path)+".*.tmp")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(f.Name())
+	// Temporary files are only readable by their owner.
+	if err := f.Chmod(0644); err != nil {
+		f.Close()
+		return err
+	}
+	if _, err := f.Write(data); err != nil {
+		f.Close()
+		return err
+	}
+	if err := f.Close(); err != nil {
+		return err
+	}
+	return os.Rename(f.Name(), path)
+}
+
+// writeOutput writes a generated file. With -dry-run it prints how the file differs from the
+// file on disk instead, and with -check it records that the file on disk is out of date.
+func (g *Generator) writeOutput(path string, data []byte) error {
+	if !g.DryRun && !g.Check {
+		return writeFileAtomically(path, data)
+	}
+	current, err := ioutil.ReadFile(path)
+	oldName := filepath.ToSlash(path)
+	if errors.Is(err, fs.ErrNotExist) {
+		oldName = "/dev/null"
+	} else if err != nil {
+		return err
+	}
+	if bytes.Equal(current, data) {
+		return nil
+	}
+	if g.Check {
+		g.staleFiles = append(g.staleFiles, path)
+	}
+	if !g.DryRun {
+		return nil
+	}
+	fmt.Print(unifiedDiff(oldName, filepath.ToSlash(path), diffSplit(string(current)), diffSplit(string(data))))
+	return nil
+}
+
+// emitOutput writes the modules of the top level directories to a single output file.
+func (g *Generator) emitOutput(directories []string) *outputBuffer {
+	var f outputBuffer
+	g.currentOutputFile = g.OutputFilePath
+	inputs := len(g.recordedInputs)
+	g.backend.writeFile(&f, func(indentationLevel int) {
+		for _, name := range directories {
+			g.writeModule(&f, name, "", indentationLevel)
+		}
+	})
+	setInputHash(&f, inputDigest(g.recordedInputs[inputs:]))
+	return &f
+}
+
+// writeSingleOutput writes every module to -output, inside the top level tests module.
+// It returns the path of the file written.
+func (g *Generator) writeSingleOutput(directories []string) ([]string, error) {
+	f := g.emitOutput(directories)
+	if len(g.generationErrors) > 0 {
+		return nil, g.notWritten(g.OutputFilePath)
+	}
+	if !g.DryRun && !g.Check {
+		if err := os.MkdirAll(filepath.Dir(g.OutputFilePath), 0755); err != nil {
+			return nil, err
+		}
+	}
+	if err := g.writeOutput(g.OutputFilePath, f.Bytes()); err != nil {
+		return nil, err
+	}
+	return []string{g.OutputFilePath}, nil
+}
+
+func (g *Generator) writeToFile(files []fs.FileInfo) error {
+	// Everything not spent discovering, reading or parsing files is spent writing the output.
+	start, before := time.Now(), g.phaseTotal()
+	defer func() {
+		g.phaseTimes["writing"] += time.Since(start) - (g.phaseTotal() - before)
+	}()
+
+	directories := g.moduleDirectories(files)
+	g.validateSources(directories)
+
+	var written []string
+	var err error
+	if len(g.SplitOutput) > 0 {
+		written, err = g.writeSplitOutput(directories)
+	} else {
+		written, err = g.writeSingleOutput(directories)
+	}
+	if err != nil {
+		return err
+	}
+
+	if len(g.instaSnapshots) > 0 {
+		if !g.DryRun && !g.Check {
+			if err := os.MkdirAll(g.InstaSnapshotDirectory, 0755); err != nil {
+				return err
+			}
+		}
+		fileNames := make([]string, 0, len(g.instaSnapshots))
+		for fileName := range g.instaSnapshots {
+			fileNames = append(fileNames, fileName)
+		}
+		sort.Strings(fileNames)
+		for _, fileName := range fileNames {
+			if err := g.writeOutput(filepath.Join(g.InstaSnapshotDirectory, fileName), []byte(g.instaSnapshots[fileName])); err != nil {
+				return err
+			}
+		}
+	}
+	if len(g.ManifestPath) > 0 {
+		data, err := json.MarshalIndent(g.manifest(g.summaryTests), "", "  ")
+		if err != nil {
+			return err
+		}
+		if err := g.writeOutput(g.ManifestPath, append(data, '\n')); err != nil {
+			return err
+		}
+	}
+	if len(g.MapOut) > 0 {
+		data, err := json.MarshalIndent(g.testMap, "", "  ")
+		if err != nil {
+			return err
+		}
+		if err := g.writeOutput(g.MapOut, append(data, '\n')); err != nil {
+			return err
+		}
+	}
+	summary := g.summarize()
+	if !g.Check {
+		printSummary(summary)
+	}
+	if len(g.SummaryJSON) > 0 {
+		data, err := json.MarshalIndent(summary, "", "  ")
+		if err != nil {
+			return err
+		}
+		if err := g.writeOutput(g.SummaryJSON, append(data, '\n')); err != nil {
+			return err
+		}
+	}
+	if g.Verify {
+		return g.verifyOutput(written)
+	}
+	return nil
+}
+
+// RUST_EDITION is the edition of the rlox crate, see Cargo.toml.
+const RUST_EDITION = "2018"
+
+// verifyOutput checks that the generated files parse, with rustfmt, and that the crate compiles
+// with them, with cargo check. The error of a failure has the output of the failing tool.
+func (g *Generator) verifyOutput(files []string) error {
+	for _, file := range files {
+		var stderr bytes.Buffer
+		command := exec.Command("rustfmt", "--edition", RUST_EDITION, "--emit", "stdout", file)
+		command.Stdout = io.Discard
+		command.Stderr = &stderr
+		if err := command.Run(); err != nil {
+			return fmt.Errorf("rustfmt rejected %s: %v\n%s", file, err, stderr.String())
+		}
+	}
+	command := exec.Command("cargo", "check", "--tests", "--quiet")
+	command.Dir = g.VerifyCrate
+	if output, err := command.CombinedOutput(); err != nil {
+		return fmt.Errorf("cargo check failed in %s: %v\n%s", g.VerifyCrate, err, output)
+	}
+	return nil
+}
@@ -0,0 +1,1330 @@
+package loxgen
+
+import (
+	"archive/tar"
+	"archive/zip"
+	"bufio"
+	"bytes"
+	"compress/gzip"
+	"errors"
+	"fmt"
+	"hash/fnv"
+	"io"
+	"io/fs"
+	"log"
+	"os"
+	"path"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"testing/fstest"
+	"time"
+	"unicode/utf8"
+)
+
+// openInput returns a file system for the input, which is either a directory
+// or a .zip, .tar, .tar.gz or .tgz archive whose entries form the test tree.
+// The closer releases the archive once the file system is no longer read.
+func openInput(input string) (fs.FS, io.Closer, error) {
+	switch {
+	case strings.HasSuffix(input, ".zip"):
+		archive, err := zip.OpenReader(input)
+		if err != nil {
+			return nil, nil, err
+		}
+		return archive, archive, nil
+	case strings.HasSuffix(input, ".tar"), strings.HasSuffix(input, ".tar.gz"), strings.HasSuffix(input, ".tgz"):
+		// Read into memory, there is nothing left open.
+		files, err := readTar(input)
+		return files, noCloser{}, err
+	default:
+		return os.DirFS(input), noCloser{}, nil
+	}
+}
+
+// noCloser is the closer of the inputs openInput keeps nothing open for.
+type noCloser struct{}
+
+func (noCloser) Close() error { return nil }
+
+// OpenInput opens the -input of the generator with openInput, as the discovery phase of the
+// generation. The closer has to be closed once the generation is done with the file system.
+func (g *Generator) OpenInput() (fs.FS, io.Closer, error) {
+	defer g.timePhase("discovery", time.Now())
+	return openInput(g.InputDirectory)
+}
+
+// readTar reads every regular file of a, possibly gzipped, tar archive into memory.
+func readTar(input string) (fs.FS, error) {
+	f, err := os.Open(input)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	var r io.Reader = f
+	if !strings.HasSuffix(input, ".tar") {
+		gz, err := gzip.NewReader(f)
+		if err != nil {
+			return nil, err
+		}
+		defer gz.Close()
+		r = gz
+	}
+
+	// MapFS synthesizes the directories from the file paths.
+	files := fstest.MapFS{}
+	tr := tar.NewReader(r)
+	for {
+		header, err := tr.Next()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return nil, err
+		}
+		if header.Typeflag != tar.TypeReg {
+			continue
+		}
+		data, err := io.ReadAll(tr)
+		if err != nil {
+			return nil, err
+		}
+		name := path.Clean(strings.TrimPrefix(header.Name, "./"))
+		files[name] = &fstest.MapFile{Data: data, Mode: 0644, ModTime: header.ModTime}
+	}
+	return files, nil
+}
+
+// readDir lists a directory of the input file system, sorted by name.
+//
+// Everything generated follows this order: modules are written in the order of their
+// directories and tests in the order of their files. Names are compared byte by byte,
+// never by locale or case, so that the output is the same on every platform and for
+// every kind of input, whatever order the file system or the archive lists them in.
+func (g *Generator) readDir(name string) ([]fs.FileInfo, error) {
+	defer g.timePhase("discovery", time.Now())
+	entries, err := fs.ReadDir(g.inputFS, name)
+	if err != nil {
+		return nil, err
+	}
+	infos := make([]fs.FileInfo, 0, len(entries))
+	for _, entry := range entries {
+		info, err := entry.Info()
+		if err != nil {
+			return nil, err
+		}
+		infos = append(infos, info)
+	}
+	sort.SliceStable(infos, func(i, j int) bool { return infos[i].Name() < infos[j].Name() })
+	return infos, nil
+}
+
+// sourcePath returns the path of a test file inside the input file system.
+func sourcePath(moduleName string, fileName string) string {
+	return path.Join(moduleName, fileName)
+}
+
+// parseShard parses the i/n of -shard, where 1 <= i <= n.
+func parseShard(value string) (int, int, error) {
+	parts := strings.SplitN(value, "/", 2)
+	if len(parts) == 2 {
+		index, indexErr := strconv.Atoi(parts[0])
+		count, countErr := strconv.Atoi(parts[1])
+		if indexErr == nil && countErr == nil && index >= 1 && index <= count {
+			return index, count, nil
+		}
+	}
+	return 0, 0, fmt.Errorf("invalid -shard %q, expected i/n with 1 <= i <= n, e.g. 2/4", value)
+}
+
+// inShard reports whether a test file, by its path in the input, belongs to the -shard being
+// generated or run. Files are assigned by a hash of their path, so a file stays in its shard
+// whatever files are added or removed around it, and the n shards together hold every file once.
+func (g *Generator) inShard(sourcePath string) bool {
+	if g.shardCount == 0 {
+		return true
+	}
+	hash := fnv.New32a()
+	hash.Write([]byte(sourcePath))
+	return int(hash.Sum32()%uint32(g.shardCount)) == g.shardIndex-1
+}
+
+// displayPath returns the path of a test file as shown in messages.
+func (g *Generator) displayPath(moduleName string, fileName string) string {
+	return filepath.Join(g.InputDirectory, filepath.FromSlash(sourcePath(moduleName, fileName)))
+}
+
+// referencePath returns the path of the reference output captured from jlox
+// for the given test file, e.g. <reference directory>/string/literals.lox.ref
+func (g *Generator) referencePath(moduleName string, fileName string) string {
+	return filepath.Join(g.ReferenceDirectory, moduleName, fileName+".ref")
+}
+
+// expectation is a value or error message a test expects, along with the line it is declared on.
+type expectation struct {
+	value string
+	line  int
+}
+
+// testFile is a parsed .lox test file.
+type testFile struct {
+	moduleName string
+	fileName   string
+	// File name without the .lox extension.
+	name string
+	// The name the test's identifiers are made from: name, with a numbered suffix if another
+	// file of the module has the same identifier, e.g. if-else.lox and if_else.lox.
+	uniqueName string
+	// Path of the file as shown in messages.
+	path           string
+	empty          bool
+	source         []string
+	expectedValues []expectation
+	// Has an empty value if no error is expected.
+	// The first of expectedErrors.
+	expectedError expectation
+	// Every error the file expects, in order. Most files expect at most one.
+	expectedErrors []expectation
+	// The VMError variant the expected error is reported with, see errorKind.
+	// Empty if the comment does not tell whether it is a compile or a runtime error.
+	expectedErrorKind string
+	// Line of the source the error has to be reported on, 0 if the comment does not say.
+	expectedErrorLine int
+	// Where the comment says the error is reported: END_OF_FILE for `Error at end: `,
+	// the quoted lexeme for `Error at 'x': `, empty if it does not say.
+	expectedErrorLocation string
+	// The call stack the runtime error is reported with, innermost call first,
+	// from the `// [line N] in function()` comments following the error.
+	expectedTrace []traceFrame
+	// Error expected from compiling only, without running the program.
+	// Has an empty value unless the file has a `// expect compile error:` marker.
+	expectedCompileError expectation
+	// Lines expected on stdout and stderr, from the `// expect out:` and `// expect err:` markers,
+	// in order and prefixed with their stream, e.g. "out: 1".
+	expectedStreams []expectation
+	// Status the program has to exit with, 0, 65 or 70, as the reference test runner expects.
+	// Has an empty value unless the file has a `// expect exit: ` marker.
+	expectedExit expectation
+	// Set by `// expect no error`: the program has to run without errors.
+	mustNotError bool
+	// Set by `// no-output`: the program intentionally prints nothing.
+	noOutput bool
+	// Set by `// flaky`: the run subcommand runs the program again when it fails.
+	flaky bool
+	// Set by `// nontest`: the file is not a test, e.g. a helper other files use.
+	nontest bool
+	// Indices of the expectedValues from `// expect-regex: ` comments, whose value is a regular
+	// expression the whole printed line has to match, e.g. for clock() values.
+	regexValues map[int]bool
+	// Set by `// expect panic`: the VM panics on the program instead of reporting an error.
+	// The message the panic has to contain is set by `// expect panic: `, if any.
+	panics        bool
+	expectedPanic expectation
+	// Listed in -known-failures: the generated test is ignored, and the run subcommand
+	// expects the file to fail.
+	knownFailure bool
+	// Names from the `// tags: ` comments, e.g. `// tags: closures, gc`, in order and without duplicates.
+	tags []string
+	// Values of the custom `// expect-<name>: ` directives, by name, see RegisterDirective.
+	directives map[string][]expectation
+	// Whether the file is marked `// gc: stress`, to run with -gc-stress-setup.
+	gcStress bool
+	// Lines of the `// input: ` comments, in order, fed to the program as its standard input.
+	input []string
+	// How long the program may run for, as a Go duration, e.g. 5s.
+	// Has an empty value unless the file has a `// timeout: ` comment.
+	timeout expectation
+	// Cfg predicate of the -feature-gates the test's module is compiled with, if any.
+	featureCfg string
+}
+
+// traceFrame is a line of the stack trace of a runtime error, e.g. `[line 3] in inner()`.
+type traceFrame struct {
+	// Line of the source the call is on.
+	line int
+	// The function, with its parentheses, or script for the top level.
+	function string
+}
+
+// traceLinePattern matches the comments of the stack trace of a runtime error.
+var traceLinePattern = regexp.MustCompile(`// \[line (\d+)\] in (\S.*)$`)
+
+// traceLines returns the lines of the expected stack trace of a test as the VM reports them,
+// with the line numbers moved by offset.
+func traceLines(test testFile, offset int) []string {
+	lines := make([]string, 0, len(test.expectedTrace))
+	for _, frame := range test.expectedTrace {
+		lines = append(lines, fmt.Sprintf("[line %d] in %s", frame.line+offset, frame.function))
+	}
+	return lines
+}
+
+// afterMarker returns the rest of the line after the first occurrence of marker, verbatim,
+// so values that themselves contain the marker are kept whole.
+func afterMarker(line string, marker string) (string, bool) {
+	index := strings.Index(line, marker)
+	if index < 0 {
+		return "", false
+	}
+	return line[index+len(marker):], true
+}
+
+// directiveHook writes the assertions of a custom directive, as DirectiveHook does, with
+// the parsed test.
+type directiveHook func(test testFile, values []expectation) []string
+
+// builtinDirectives are the custom directives of the generator itself, by name.
+var builtinDirectives = map[string]func(g *Generator, test testFile, values []expectation) []string{
+	"contains": (*Generator).containsDirective,
+}
+
+// containsDirective asserts that what the program printed, followed by the latest error message,
+// contains the phrase of each `// expect-contains: ` comment. Unlike the other directives, it is
+// checked by the run subcommand too, against stdout and stderr.
+func (g *Generator) containsDirective(test testFile, values []expectation) []string {
+	lines := make([]string, 0, len(values)+3)
+	if onlyDirectives(test) && len(g.ReferenceDirectory) == 0 {
+		lines = append(lines, "#[allow(unused_must_use)]", "{ "+g.interpret("source")+"; }")
+	}
+	lines = append(lines, fmt.Sprintf("let output = format!(\"{}\\n{}\", %s.iter().map(|v| v.to_string()).collect::<Vec<String>>().join(\"\\n\"), %s);",
+		g.PrintedValues, g.ErrorMessageAccessor))
+	for _, value := range values {
+		phrase := rustString(value.value)
+		message := g.assertMessageArguments(test.path, value.line, 0)
+		if len(message) == 0 {
+			message = fmt.Sprintf("\"expected the output to contain {:?}, got {:?}\", %s, output", phrase)
+		}
+		lines = append(lines, fmt.Sprintf("assert!(output.contains(%s), %s);", phrase, message))
+	}
+	return lines
+}
+
+// onlyDirectives reports whether custom directives are all a test expects, in which case
+// its source is interpreted by their hooks, and any result will do.
+func onlyDirectives(test testFile) bool {
+	other := test
+	other.directives = nil
+	return len(test.directives) > 0 && !hasMarker(other)
+}
+
+// customDirectivePattern matches the comments of custom directives, e.g. `// expect-gc-count: 3`.
+var customDirectivePattern = regexp.MustCompile(`// expect-([a-z0-9]+(?:-[a-z0-9]+)*): `)
+
+// Expectation is the value of a custom directive comment, along with the line it is on.
+type Expectation struct {
+	Value string
+	Line  int
+}
+
+// DirectiveTest is the test file a DirectiveHook writes the assertions of.
+type DirectiveTest struct {
+	// Path of the file as shown in messages, e.g. test/gc/collect.lox.
+	Path string
+	// Lines of the source of the file.
+	Source []string
+	// Whether custom directives are all the file expects, in which case its source is not
+	// interpreted and the hook's lines have to, e.g. with Interpret.
+	OnlyDirectives bool
+	// Expression interpreting the source, bound to source, with the VM, see -interpret-call.
+	Interpret string
+}
+
+// DirectiveHook writes the assertions of a custom directive. It is given the test and the
+// values of the directive's comments, in the order of the file, and returns the lines of Rust
+// to add to the test after the built-in assertions, without indentation.
+type DirectiveHook func(test DirectiveTest, values []Expectation) []string
+
+// RegisterDirective makes parseLines read the `// expect-<name>: value` comments of the
+// test files, and the generated tests run the lines hook returns for the files that
+// have any, e.g.
+//
+//	opts.RegisterDirective("gc-count", func(test loxgen.DirectiveTest, values []loxgen.Expectation) []string {
+//		return []string{fmt.Sprintf("assert_eq!(%s, vm.gc_count());", values[len(values)-1].Value)}
+//	})
+//
+// The tests have to be both parsed and emitted with the options registering the directive.
+// The run subcommand cannot check custom directives and ignores them.
+func (o *Options) RegisterDirective(name string, hook DirectiveHook) error {
+	if !customDirectivePattern.MatchString("// expect-" + name + ": ") {
+		return fmt.Errorf("invalid directive name %q, expected lowercase words separated by -", name)
+	}
+	if _, ok := o.directives[name]; ok || builtinDirectives[name] != nil {
+		return fmt.Errorf("directive %q registered twice", name)
+	}
+	if o.directives == nil {
+		o.directives = make(map[string]DirectiveHook)
+	}
+	o.directives[name] = hook
+	return nil
+}
+
+// registerDirectives sets the directive hooks: the built-in ones and those of the options,
+// which are called with what they are given of the tests.
+func (g *Generator) registerDirectives() {
+	g.directiveHooks = make(map[string]directiveHook)
+	for name, hook := range builtinDirectives {
+		hook := hook
+		g.directiveHooks[name] = func(test testFile, values []expectation) []string {
+			return hook(g, test, values)
+		}
+	}
+	for name, hook := range g.directives {
+		hook := hook
+		g.directiveHooks[name] = func(test testFile, values []expectation) []string {
+			expectations := make([]Expectation, 0, len(values))
+			for _, value := range values {
+				expectations = append(expectations, Expectation{value.value, value.line})
+			}
+			return hook(DirectiveTest{test.path, test.source, onlyDirectives(test), g.interpret("source")}, expectations)
+		}
+	}
+}
+
+// writeDirectiveAssertions writes the lines of the custom directives of a test, in the
+// order of their names.
+func (g *Generator) writeDirectiveAssertions(outputFile io.StringWriter, test testFile, indentationLevel int) {
+	names := make([]string, 0, len(test.directives))
+	for name := range test.directives {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		for _, line := range g.directiveHooks[name](test, test.directives[name]) {
+			writeLine(outputFile, line, indentationLevel)
+		}
+	}
+}
+
+func (g *Generator) parseTest(moduleName string, fileInfo fs.FileInfo) (testFile, error) {
+	if !strings.HasSuffix(fileInfo.Name(), ".lox") {
+		return testFile{}, fmt.Errorf("%s: invalid file input, only .lox files should be present in the input directory", g.displayPath(moduleName, fileInfo.Name()))
+	}
+	test := testFile{
+		moduleName: moduleName,
+		fileName:   fileInfo.Name(),
+		name:       strings.Replace(fileInfo.Name(), ".lox", "", 1),
+		path:       g.displayPath(moduleName, fileInfo.Name()),
+		empty:      fileInfo.Size() == 0,
+
+		knownFailure: g.isKnownFailure(sourcePath(moduleName, fileInfo.Name())),
+	}
+
+	start := time.Now()
+	data, err := fs.ReadFile(g.inputFS, sourcePath(moduleName, fileInfo.Name()))
+	g.timePhase("reading", start)
+	if err != nil {
+		return testFile{}, err
+	}
+	defer g.timePhase("parsing", time.Now())
+	if g.Lossy {
+		data = []byte(strings.ToValidUTF8(string(data), string(utf8.RuneError)))
+	}
+	// The included file reaches the VM as it is, and rlox does not skip a byte order mark.
+	if g.IncludeSource && bytes.HasPrefix(data, UTF8_BOM) {
+		return testFile{}, fmt.Errorf("%s: starts with a UTF-8 byte order mark, which -include-source would pass to the VM", test.path)
+	}
+	if err := g.parseLines(&test, data); err != nil {
+		return testFile{}, fmt.Errorf("%s: %w", test.path, err)
+	}
+	return test, nil
+}
+
+// UTF8_BOM is the byte order mark some Windows editors start UTF-8 files with.
+var UTF8_BOM = []byte("\xEF\xBB\xBF")
+
+// normalizeSource strips the byte order mark of a file and turns its "\r\n" and "\r"
+// line endings into "\n", so that files edited on Windows give the same source
+// and expectation values as the others.
+func normalizeSource(data []byte) []byte {
+	data = bytes.TrimPrefix(data, UTF8_BOM)
+	if bytes.IndexByte(data, '\r') < 0 {
+		return data
+	}
+	data = bytes.ReplaceAll(data, []byte("\r\n"), []byte("\n"))
+	return bytes.ReplaceAll(data, []byte("\r"), []byte("\n"))
+}
+
+// parseLines reads the source and the expectation markers of a test file.
+func (g *Generator) parseLines(test *testFile, data []byte) error {
+	data = normalizeSource(data)
+	sc := bufio.NewScanner(bytes.NewReader(data))
+	// The whole file is in memory already, so a line may be as long as the file: the
+	// default limit of 64 KiB would stop at long string literals.
+	sc.Buffer(nil, len(data)+1)
+
+	lineNumber := 0
+	for sc.Scan() {
+		line := sc.Text()
+		lineNumber++
+		test.source = append(test.source, line)
+
+		// Only the error markers are read, other spellings are left to the fix subcommand and -strict.
+		start := commentStart(line)
+		// Errors only reported by the other implementation are skipped, e.g. in unexpected_character.lox.
+		if start >= 0 && !g.otherDialect(line) {
+			if message, location, ok := errorMessage(line[start:]); ok {
+				if len(test.expectedErrors) == 0 {
+					test.expectedError = expectation{message, lineNumber}
+					test.expectedErrorKind = errorKind(line)
+					test.expectedErrorLine = errorLine(line, lineNumber)
+					test.expectedErrorLocation = location
+				}
+				test.expectedErrors = append(test.expectedErrors, expectation{message, lineNumber})
+			}
+		}
+		if match := traceLinePattern.FindStringSubmatch(line); match != nil {
+			reported, _ := strconv.Atoi(match[1])
+			test.expectedTrace = append(test.expectedTrace, traceFrame{reported, match[2]})
+		}
+		if message, ok := afterMarker(line, "// expect compile error: "); ok && len(test.expectedCompileError.value) == 0 {
+			test.expectedCompileError = expectation{message, lineNumber}
+		}
+		for _, stream := range []string{"out", "err"} {
+			if value, ok := afterMarker(line, "// expect "+stream+": "); ok {
+				test.expectedStreams = append(test.expectedStreams, expectation{stream + ": " + value, lineNumber})
+			}
+		}
+		// Run with the garbage collector collecting on every allocation.
+		if value, ok := afterMarker(line, "// gc: "); ok && strings.TrimSpace(value) == "stress" {
+			test.gcStress = true
+		}
+		if value, ok := afterMarker(line, "// expect exit: "); ok && len(test.expectedExit.value) == 0 {
+			test.expectedExit = expectation{strings.TrimSpace(value), lineNumber}
+		}
+		if value, ok := afterMarker(line, "// timeout: "); ok && len(test.timeout.value) == 0 {
+			test.timeout = expectation{strings.TrimSpace(value), lineNumber}
+		}
+		if value, ok := afterMarker(line, "// input: "); ok {
+			test.input = append(test.input, value)
+		}
+		if strings.Contains(line, "// expect no error") {
+			test.mustNotError = true
+		}
+		if strings.Contains(line, "// no-output") {
+			test.noOutput = true
+		}
+		if strings.Contains(line, "// flaky") {
+			test.flaky = true
+		}
+		if strings.Contains(line, "// nontest") {
+			test.nontest = true
+		}
+		if value, ok := afterMarker(line, "// expect panic: "); ok && !test.panics {
+			test.panics = true
+			test.expectedPanic = expectation{value, lineNumber}
+		} else if strings.HasSuffix(strings.TrimRight(line, " \t"), "// expect panic") {
+			test.panics = true
+		}
+		if value, ok := afterMarker(line, "// tags: "); ok {
+			test.tags = appendTags(test.tags, tagList(value))
+		}
+		// Directives no hook is registered for are left to -strict.
+		if match := customDirectivePattern.FindStringSubmatchIndex(line); match != nil {
+			if name := line[match[2]:match[3]]; g.directiveHooks[name] != nil {
+				if test.directives == nil {
+					test.directives = make(map[string][]expectation)
+				}
+				test.directives[name] = append(test.directives[name], expectation{line[match[1]:], lineNumber})
+			}
+		}
+		if value, ok := afterMarker(line, "// expect: "); ok {
+			test.expectedValues = append(test.expectedValues, expectation{value, lineNumber})
+		} else if value, ok := afterMarker(line, "// expect-regex: "); ok {
+			if test.regexValues == nil {
+				test.regexValues = make(map[int]bool)
+			}
+			test.regexValues[len(test.expectedValues)] = true
+			test.expectedValues = append(test.expectedValues, expectation{value, lineNumber})
+		}
+	}
+	return sc.Err()
+}
+
+// valuePattern compiles the regular expression of an `// expect-regex: ` value, which has to
+// match the whole printed line.
+func valuePattern(value string) (*regexp.Regexp, error) {
+	// Compiled on its own first, so that errors quote the pattern as it is written.
+	if _, err := regexp.Compile(value); err != nil {
+		return nil, err
+	}
+	return regexp.Compile("^(?:" + value + ")$")
+}
+
+// regexLines returns the lines of the `// expect-regex: ` comments of a test.
+func regexLines(test testFile) map[int]bool {
+	lines := make(map[int]bool, len(test.regexValues))
+	for i := range test.regexValues {
+		lines[test.expectedValues[i].line] = true
+	}
+	return lines
+}
+
+// SOURCE_LINE_OFFSET is how many lines the generated source literal adds before the
+// first line of the file: the raw string starts with a newline. Sources read with
+// -include-source start with the first line.
+const SOURCE_LINE_OFFSET = 1
+
+// VMError variants the expected errors are checked against.
+const (
+	COMPILE_ERROR = "CompileError"
+	RUNTIME_ERROR = "RuntimeError"
+)
+
+// compileErrorPattern matches the comments of errors reported by the compiler,
+// e.g. `// [line 3] Error at 'x': ...` or `// Error at end: ...`.
+var compileErrorPattern = regexp.MustCompile(`\[(c |java )?line \d+\] Error|// Error( at |:)`)
+
+// DIALECT_MARKERS are the prefixes of the error comments only one implementation reports.
+var DIALECT_MARKERS = map[string]string{
+	"clox": "[c line ",
+	"jlox": "[java line ",
+}
+
+// otherDialect reports whether the error comment on a line is for an implementation other than -dialect.
+func (g *Generator) otherDialect(line string) bool {
+	for name, marker := range DIALECT_MARKERS {
+		if name != g.Dialect && strings.Contains(line, marker) {
+			return true
+		}
+	}
+	return false
+}
+
+// errorLinePattern matches the line number of comments like `// [line 3] Error at 'x': ...`.
+var errorLinePattern = regexp.MustCompile(`\[(?:c |java )?line (\d+)\]`)
+
+// errorLine returns the line an error expected on the given line of the file has to be
+// reported on: the one in its `[line N]` prefix, or the line of the comment itself for
+// runtime errors and `// Error at` comments. It returns 0 if the comment does not say.
+func errorLine(line string, lineNumber int) int {
+	if match := errorLinePattern.FindStringSubmatch(line); match != nil {
+		reported, _ := strconv.Atoi(match[1])
+		return reported
+	}
+	if len(errorKind(line)) > 0 {
+		return lineNumber
+	}
+	return 0
+}
+
+// END_OF_FILE is the location of the errors reported at the end of the source,
+// e.g. a block left unterminated: `// [line 4] Error at end: Expect '}' after block.`
+const END_OF_FILE = "end"
+
+// errorMessagePattern matches the part of an error comment before its message: one of
+// the error markers of knownMarkers, with the location the error is reported at if the
+// comment says. A quoted lexeme may itself contain ": ", as string literals do, so it is
+// matched up to the first "': ".
+var errorMessagePattern = regexp.MustCompile(`^// (?:expect runtime error|(?:\[(?:c |java )?line \d+\] )?Error(?: at (end|'.*?'))?): `)
+
+// errorMessage returns the message of an error comment, given the line from the // of the
+// comment on, and the location it is reported at, END_OF_FILE, a lexeme or empty. It
+// returns false if the comment is not an error marker.
+func errorMessage(comment string) (string, string, bool) {
+	match := errorMessagePattern.FindStringSubmatchIndex(comment)
+	if match == nil {
+		return "", "", false
+	}
+	location := ""
+	if match[2] >= 0 {
+		location = comment[match[2]:match[3]]
+	}
+	return comment[match[1]:], location, true
+}
+
+// errorKind returns the VMError variant of the error expected on a line,
+// or an empty string if the comment does not say.
+func errorKind(line string) string {
+	if strings.Contains(line, "// expect runtime error: ") {
+		return RUNTIME_ERROR
+	}
+	if compileErrorPattern.MatchString(line) {
+		return COMPILE_ERROR
+	}
+	return ""
+}
+
+// SUITE_FILE configures the test directory it is in, see suiteConfig.
+const SUITE_FILE = "suite.toml"
+
+// suiteConfig is the configuration of a test directory, from its suite.toml, e.g.
+//
+//	module = "closures"
+//	tags = [closures, slow]
+//	timeout = "10s"
+//	skip = "upvalues are not implemented yet"
+//	dialect = "jlox"
+//
+// Subdirectories inherit the tags, timeout and dialect of their parent, which their own
+// suite.toml adds to or overrides. The module name is only that of the directory itself.
+type suiteConfig struct {
+	// Identifier of the generated module, instead of <directory>_tests.
+	module string
+	// Tags added to those of every test file, and the timeout of those without one.
+	tags    []string
+	timeout string
+	// Set by skip = true, or skip = "reason": the directory is left out, like with -exclude.
+	skipped bool
+	reason  string
+	// Set by skip = false: the directory is generated without -include selecting it, unless
+	// -include is set.
+	selected bool
+	// Overrides -dialect for the error comments of the directory's files.
+	dialect string
+}
+
+// loadSuite reads the suite.toml of a directory, along with those of the directories above
+// it. A directory without one has the configuration of its parent. Errors in the files of
+// the parents are left to them to report.
+func (g *Generator) loadSuite(moduleName string) (suiteConfig, error) {
+	var suite suiteConfig
+	if parent := path.Dir(moduleName); parent != "." {
+		inherited, _ := g.loadSuite(parent)
+		suite.tags = append([]string{}, inherited.tags...)
+		suite.timeout, suite.dialect = inherited.timeout, inherited.dialect
+	}
+	data, err := fs.ReadFile(g.inputFS, sourcePath(moduleName, SUITE_FILE))
+	if errors.Is(err, fs.ErrNotExist) {
+		return suite, nil
+	}
+	if err != nil {
+		return suite, err
+	}
+	name := g.displayPath(moduleName, SUITE_FILE)
+	config, err := parseConfig(name, data)
+	if err != nil {
+		return suite, err
+	}
+	keys := make([]string, 0, len(config))
+	for key := range config {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	for _, key := range keys {
+		value := strings.Join(config[key], ",")
+		switch key {
+		case "module":
+			if identifier(value) != value {
+				return suite, fmt.Errorf("%s: module %q is not a Rust identifier", name, value)
+			}
+			suite.module = value
+		case "tags":
+			suite.tags = appendTags(suite.tags, config[key])
+		case "timeout":
+			if duration, err := time.ParseDuration(value); err != nil || duration <= 0 {
+				return suite, fmt.Errorf("%s: invalid timeout %q, expected a duration such as 5s", name, value)
+			}
+			suite.timeout = value
+		case "skip":
+			suite.skipped = value != "false"
+			suite.selected = value == "false"
+			if value != "true" && value != "false" {
+				suite.reason = value
+			}
+		case "dialect":
+			if _, ok := DIALECT_MARKERS[value]; !ok {
+				return suite, fmt.Errorf("%s: unknown dialect %q, expected clox or jlox", name, value)
+			}
+			suite.dialect = value
+		default:
+			return suite, fmt.Errorf("%s: unknown key %q, expected module, tags, timeout, skip or dialect", name, key)
+		}
+	}
+	return suite, nil
+}
+
+// skipReason returns why a directory skipped by its suite.toml is left out.
+func (suite suiteConfig) skipReason() string {
+	if len(suite.reason) > 0 {
+		return "skipped by its " + SUITE_FILE + ": " + suite.reason
+	}
+	return "skipped by its " + SUITE_FILE
+}
+
+// directoryModule returns the identifier of the module generated for a directory: the module
+// of its suite.toml, or <directory>_tests.
+func (g *Generator) directoryModule(moduleName string) string {
+	if suite, _ := g.loadSuite(moduleName); len(suite.module) > 0 {
+		return suite.module
+	}
+	return identifier(path.Base(moduleName) + "_tests")
+}
+
+// DEFAULTS_FILE holds expectations shared by every test of its directory, see applyDefaults.
+const DEFAULTS_FILE = "_defaults.lox.expect"
+
+// loadDefaults parses the defaults file of a directory. It returns false if there is none.
+func (g *Generator) loadDefaults(moduleName string) (testFile, bool, error) {
+	data, err := fs.ReadFile(g.inputFS, sourcePath(moduleName, DEFAULTS_FILE))
+	if errors.Is(err, fs.ErrNotExist) {
+		return testFile{}, false, nil
+	}
+	if err != nil {
+		return testFile{}, false, err
+	}
+	var defaults testFile
+	if err := g.parseLines(&defaults, data); err != nil {
+		return testFile{}, false, err
+	}
+	return defaults, true, nil
+}
+
+// applyDefaults merges the expectations of a directory's defaults file into one of its tests:
+//   - `// expect no error` applies unless the test expects an error or a compile error itself,
+//   - expected values, errors, compile errors and stream output are only inherited
+//     when the test has no expectation of that kind,
+//   - `// expect exit: ` applies unless the test expects an error or a compile error itself,
+//   - `// input: ` lines and `// timeout: ` are only inherited when the test has none,
+//   - `// flaky` applies to every test,
+//   - `// tags: ` are added to the test's own,
+//   - custom `// expect-<name>: ` directives are only inherited when the test has none of that name,
+//   - setup directives such as `// gc: stress` are added, unless the test has them already.
+//
+// Defaults only apply to the files directly inside the directory.
+func applyDefaults(test *testFile, defaults testFile) {
+	expectsError := len(test.expectedError.value) > 0 || len(test.expectedCompileError.value) > 0
+	if defaults.mustNotError && !expectsError {
+		test.mustNotError = true
+	}
+	if len(test.expectedValues) == 0 {
+		test.expectedValues = defaults.expectedValues
+		test.regexValues = defaults.regexValues
+	}
+	if len(test.expectedError.value) == 0 && !test.mustNotError {
+		test.expectedError = defaults.expectedError
+		test.expectedErrors = defaults.expectedErrors
+		test.expectedErrorKind = defaults.expectedErrorKind
+		// The line of the defaults file says nothing about the test's source.
+		test.expectedErrorLine = 0
+		test.expectedErrorLocation = defaults.expectedErrorLocation
+		test.expectedTrace = defaults.expectedTrace
+	}
+	if len(test.expectedCompileError.value) == 0 && !test.mustNotError {
+		test.expectedCompileError = defaults.expectedCompileError
+	}
+	if len(test.expectedExit.value) == 0 && !expectsError {
+		test.expectedExit = defaults.expectedExit
+	}
+	if len(test.expectedStreams) == 0 {
+		test.expectedStreams = defaults.expectedStreams
+	}
+	if len(test.input) == 0 {
+		test.input = defaults.input
+	}
+	if len(test.timeout.value) == 0 {
+		test.timeout = defaults.timeout
+	}
+	test.flaky = test.flaky || defaults.flaky
+	test.gcStress = test.gcStress || defaults.gcStress
+	test.tags = appendTags(test.tags, defaults.tags)
+	for name, values := range defaults.directives {
+		if len(test.directives[name]) == 0 {
+			if test.directives == nil {
+				test.directives = make(map[string][]expectation)
+			}
+			test.directives[name] = values
+		}
+	}
+}
+
+// applyExitStatus turns the `// expect exit: ` marker of a test into the expectations it stands for:
+// 0 for running without errors, 65 for a compile error and 70 for a runtime error.
+// It fails if the status is none of those or contradicts the other markers of the test.
+func applyExitStatus(test *testFile) error {
+	if len(test.expectedExit.value) == 0 {
+		return nil
+	}
+	location := fmt.Sprintf("%s:%d", test.path, test.expectedExit.line)
+	switch test.expectedExit.value {
+	case strconv.Itoa(EXIT_SUCCESS):
+		if len(test.expectedError.value) > 0 || len(test.expectedCompileError.value) > 0 {
+			return fmt.Errorf("%s: expects exit status 0, but also an error", location)
+		}
+		test.mustNotError = true
+	case strconv.Itoa(EXIT_COMPILE_ERROR), strconv.Itoa(EXIT_RUNTIME_ERROR):
+		kind := COMPILE_ERROR
+		if test.expectedExit.value == strconv.Itoa(EXIT_RUNTIME_ERROR) {
+			kind = RUNTIME_ERROR
+		}
+		switch {
+		case test.mustNotError:
+			return fmt.Errorf("%s: expects exit status %s, but also no error", location, test.expectedExit.value)
+		case len(test.expectedCompileError.value) > 0 && kind != COMPILE_ERROR,
+			len(test.expectedErrorKind) > 0 && test.expectedErrorKind != kind:
+			return fmt.Errorf("%s: expects exit status %s, but the error comment is not a %s", location, test.expectedExit.value, errorDescription(kind))
+		}
+		test.expectedErrorKind = kind
+	default:
+		return fmt.Errorf("%s: invalid exit status %q, expected 0, 65 or 70", location, test.expectedExit.value)
+	}
+	return nil
+}
+
+func containsString(list []string, text string) bool {
+	for _, entry := range list {
+		if entry == text {
+			return true
+		}
+	}
+	return false
+}
+
+// hasMarker reports whether the test declares what it expects in any way.
+func hasMarker(test testFile) bool {
+	return len(test.expectedValues) > 0 ||
+		len(test.expectedError.value) > 0 ||
+		len(test.expectedCompileError.value) > 0 ||
+		len(test.expectedStreams) > 0 ||
+		len(test.expectedExit.value) > 0 ||
+		test.mustNotError ||
+		test.noOutput ||
+		test.panics ||
+		len(test.directives) > 0
+}
+
+// panicExpectation returns the message a test expects the VM to panic with, empty for any panic,
+// and whether the test expects a panic at all: with `// expect panic`, or with -should-panic
+// for the tests expecting a runtime error.
+func (g *Generator) panicExpectation(test testFile) (string, bool) {
+	if test.panics {
+		return test.expectedPanic.value, true
+	}
+	if g.ShouldPanic && test.expectedErrorKind == RUNTIME_ERROR {
+		return test.expectedError.value, true
+	}
+	return "", false
+}
+
+// tagList splits a comma separated list of tags, e.g. "closures, gc", dropping empty entries.
+func tagList(value string) []string {
+	var tags []string
+	for _, tag := range strings.Split(value, ",") {
+		if tag = strings.TrimSpace(tag); len(tag) > 0 {
+			tags = append(tags, tag)
+		}
+	}
+	return tags
+}
+
+// appendTags appends the tags not already in the list.
+func appendTags(list []string, tags []string) []string {
+	for _, tag := range tags {
+		if !containsString(list, tag) {
+			list = append(list, tag)
+		}
+	}
+	return list
+}
+
+// selectedByTags reports whether a test has one of -tags, if set, and none of -skip-tags.
+func (g *Generator) selectedByTags(test testFile) bool {
+	for _, tag := range g.skippedTags {
+		if containsString(test.tags, tag) {
+			return false
+		}
+	}
+	if len(g.selectedTags) == 0 {
+		return true
+	}
+	for _, tag := range g.selectedTags {
+		if containsString(test.tags, tag) {
+			return true
+		}
+	}
+	return false
+}
+
+// matchesExpectations reports whether any of the test's expected values or its expected error matches re.
+func matchesExpectations(test testFile, re *regexp.Regexp) bool {
+	for _, expected := range test.expectedErrors {
+		if re.MatchString(expected.value) {
+			return true
+		}
+	}
+	for _, expected := range test.expectedValues {
+		if re.MatchString(expected.value) {
+			return true
+		}
+	}
+	return false
+}
+
+// listModule returns the files and the subdirectories, as paths relative to the input,
+// of one of the input directories. Subdirectories matching -exclude are left out,
+// unless -ignore-excluded is set.
+func (g *Generator) listModule(moduleName string) ([]fs.FileInfo, []string, error) {
+	infos, err := g.readDir(moduleName)
+	if err != nil {
+		return nil, nil, err
+	}
+	files := make([]fs.FileInfo, 0, len(infos))
+	subdirectories := make([]string, 0)
+	for _, info := range infos {
+		if !info.IsDir() {
+			if info.Name() != SUITE_FILE {
+				files = append(files, info)
+			}
+			continue
+		}
+		subdirectory := path.Join(moduleName, info.Name())
+		if len(g.Chapter) > 0 && !g.chapterVisits(subdirectory) {
+			g.excludedDirectories[subdirectory] = true
+			continue
+		}
+		if matchesAny(g.ExcludePatterns, subdirectory) {
+			if !g.IgnoreExcluded {
+				g.excludedDirectories[subdirectory] = true
+				continue
+			}
+			g.ignoredDirectories[subdirectory] = "left out by -exclude"
+		} else if suite, _ := g.loadSuite(subdirectory); suite.skipped {
+			if !g.IgnoreExcluded {
+				g.excludedDirectories[subdirectory] = true
+				continue
+			}
+			g.ignoredDirectories[subdirectory] = suite.skipReason()
+		}
+		subdirectories = append(subdirectories, subdirectory)
+	}
+	return files, subdirectories, nil
+}
+
+// parseModule parses the test files of a directory, with the directory's defaults and
+// suite.toml applied. Files that are skipped or filtered out are left out.
+func (g *Generator) parseModule(moduleName string, modFilesInfo []fs.FileInfo) []testFile {
+	suite, err := g.loadSuite(moduleName)
+	if err != nil {
+		g.reportError(err)
+	}
+	if len(suite.dialect) > 0 {
+		// The error comments of the directory's files are read for its dialect.
+		previousDialect := g.Dialect
+		g.Dialect = suite.dialect
+		defer func() {
+			g.Dialect = previousDialect
+		}()
+	}
+	defaults, hasDefaults, err := g.loadDefaults(moduleName)
+	if err != nil {
+		g.reportError(err)
+	}
+
+	tests := make([]testFile, 0, len(modFilesInfo))
+	for _, tf := range modFilesInfo {
+		if g.stopped() {
+			break
+		}
+		if tf.Name() == DEFAULTS_FILE {
+			continue
+		}
+		// Files left out by -run are not worth listing as skipped, they are most of them.
+		if g.runFilter != nil && !g.runFilter.MatchString(strings.TrimSuffix(sourcePath(moduleName, tf.Name()), ".lox")) {
+			continue
+		}
+		// So are those of the other shards.
+		if !g.inShard(sourcePath(moduleName, tf.Name())) {
+			continue
+		}
+		if len(g.Chapter) > 0 && !g.chapterRuns(sourcePath(moduleName, tf.Name())) {
+			g.skippedFiles = append(g.skippedFiles, g.displayPath(moduleName, tf.Name())+": not run by -chapter "+g.Chapter)
+			continue
+		}
+		if tf.Size() == 0 && !g.AllowEmptySource {
+			log.Printf("Warning: skipping empty file %s.", g.displayPath(moduleName, tf.Name()))
+			g.skippedFiles = append(g.skippedFiles, g.displayPath(moduleName, tf.Name())+": empty")
+			continue
+		}
+		if len(g.ReferenceDirectory) > 0 {
+			if _, err := os.Stat(g.referencePath(moduleName, tf.Name())); err != nil {
+				log.Printf("Warning: skipping %s, no reference output found.", g.displayPath(moduleName, tf.Name()))
+				g.skippedFiles = append(g.skippedFiles, g.displayPath(moduleName, tf.Name())+": no reference output")
+				continue
+			}
+		}
+		test, err := g.parseTest(moduleName, tf)
+		if err != nil {
+			g.reportError(err)
+			continue
+		}
+		if test.nontest {
+			g.skippedFiles = append(g.skippedFiles, test.path+": marked // nontest")
+			continue
+		}
+		if g.Strict {
+			if problems := g.lintComments(test); len(problems) > 0 {
+				for _, problem := range problems {
+					g.reportError(problem)
+				}
+				continue
+			}
+		}
+		if hasDefaults {
+			applyDefaults(&test, defaults)
+		}
+		test.tags = appendTags(test.tags, suite.tags)
+		if len(test.timeout.value) == 0 {
+			test.timeout.value = suite.timeout
+		}
+		if err := applyExitStatus(&test); err != nil {
+			g.reportError(err)
+			continue
+		}
+		for i := range test.regexValues {
+			if _, err := valuePattern(test.expectedValues[i].value); err != nil {
+				g.reportError(fmt.Errorf("%s:%d: invalid // expect-regex: pattern: %v", test.path, test.expectedValues[i].line, err))
+			}
+		}
+		if duration, err := time.ParseDuration(test.timeout.value); len(test.timeout.value) > 0 && (err != nil || duration <= 0) {
+			g.reportError(fmt.Errorf("%s:%d: invalid timeout %q, expected a duration such as 5s", test.path, test.timeout.line, test.timeout.value))
+			continue
+		}
+		// Empty files are already sanctioned by -allow-empty-source.
+		if g.RequireMarker && !test.empty && !hasMarker(test) {
+			g.reportError(fmt.Errorf("%s: no expectation, error marker or // no-output directive", test.path))
+			continue
+		}
+		if g.filterExpect != nil && !matchesExpectations(test, g.filterExpect) {
+			g.skippedFiles = append(g.skippedFiles, test.path+": not selected by -filter-expect")
+			continue
+		}
+		if !g.selectedByTags(test) {
+			g.skippedFiles = append(g.skippedFiles, test.path+": not selected by -tags or -skip-tags")
+			continue
+		}
+		tests = append(tests, test)
+	}
+	return tests
+}
+
+// matchesAny reports whether name matches one of the comma separated glob patterns.
+func matchesAny(patterns string, name string) bool {
+	for pattern := range parseList(patterns) {
+		if matched, _ := path.Match(pattern, name); matched {
+			return true
+		}
+	}
+	return false
+}
+
+// validatePatterns checks the syntax of comma separated glob patterns.
+func validatePatterns(patterns string) error {
+	for pattern := range parseList(patterns) {
+		if _, err := path.Match(pattern, ""); err != nil {
+			return fmt.Errorf("invalid pattern %q: %v", pattern, err)
+		}
+	}
+	return nil
+}
+
+// CHAPTERS are the chapters of the book the clox test harness of craftinginterpreters
+// has a suite for, in order.
+var CHAPTERS = []string{
+	"chap17_compiling",
+	"chap18_types",
+	"chap19_strings",
+	"chap20_hash_tables",
+	"chap21_global_variables",
+	"chap22_local_variables",
+	"chap23_jumping_back_and_forth",
+	"chap24_calls_and_functions",
+	"chap25_closures",
+	"chap26_garbage_collection",
+	"chap27_classes_and_instances",
+	"chap28_methods_and_initializers",
+	"chap29_superclasses",
+	"chap30_optimization",
+}
+
+// CHAPTER_PATHS maps the paths of the upstream test suite to the chapter whose suite starts
+// running them, and from which every later chapter runs them too. The longest path containing
+// a file decides, so a file can land in a later chapter than the rest of its directory.
+// An empty chapter means clox never runs the path: it belongs to jlox, or is a benchmark.
+var CHAPTER_PATHS = map[string]string{
+	"expressions":              "",
+	"expressions/evaluate.lox": "chap17_compiling",
+	"scanning":                 "",
+	"benchmark":                "",
+
+	"assignment":           "chap21_global_variables",
+	"bool":                 "chap21_global_variables",
+	"comments":             "chap21_global_variables",
+	"nil":                  "chap21_global_variables",
+	"number":               "chap21_global_variables",
+	"operator":             "chap21_global_variables",
+	"print":                "chap21_global_variables",
+	"regression":           "chap21_global_variables",
+	"string":               "chap21_global_variables",
+	"variable":             "chap21_global_variables",
+	"assignment/local.lox": "chap22_local_variables",
+
+	"block":                                        "chap22_local_variables",
+	"variable/duplicate_local.lox":                 "chap22_local_variables",
+	"variable/in_middle_of_block.lox":              "chap22_local_variables",
+	"variable/in_nested_block.lox":                 "chap22_local_variables",
+	"variable/scope_reuse_in_different_blocks.lox": "chap22_local_variables",
+	"variable/shadow_and_local.lox":                "chap22_local_variables",
+	"variable/shadow_global.lox":                   "chap22_local_variables",
+	"variable/shadow_local.lox":                    "chap22_local_variables",
+	"variable/use_local_in_initializer.lox":        "chap22_local_variables",
+
+	"for":                              "chap23_jumping_back_and_forth",
+	"if":                               "chap23_jumping_back_and_forth",
+	"logical_operator":                 "chap23_jumping_back_and_forth",
+	"while":                            "chap23_jumping_back_and_forth",
+	"variable/unreached_undefined.lox": "chap23_jumping_back_and_forth",
+
+	"call":                                "chap24_calls_and_functions",
+	"function":                            "chap24_calls_and_functions",
+	"limit":                               "chap24_calls_and_functions",
+	"return":                              "chap24_calls_and_functions",
+	"variable/collide_with_parameter.lox": "chap24_calls_and_functions",
+	"variable/duplicate_parameter.lox":    "chap24_calls_and_functions",
+
+	"closure":                   "chap25_closures",
+	"variable/early_bound.lox":  "chap25_closures",
+	"for/closure_in_body.lox":   "chap25_closures",
+	"while/closure_in_body.lox": "chap25_closures",
+
+	"class":                          "chap27_classes_and_instances",
+	"field":                          "chap27_classes_and_instances",
+	"variable/local_from_method.lox": "chap28_methods_and_initializers",
+
+	"constructor": "chap28_methods_and_initializers",
+	"method":      "chap28_methods_and_initializers",
+	"this":        "chap28_methods_and_initializers",
+
+	"inheritance": "chap29_superclasses",
+	"super":       "chap29_superclasses",
+}
+
+// chapterIndex returns the position of a chapter in CHAPTERS, or -1.
+func chapterIndex(name string) int {
+	for i, chapter := range CHAPTERS {
+		if chapter == name {
+			return i
+		}
+	}
+	return -1
+}
+
+// chapterRuns reports whether the suite of -chapter runs the file or directory at name,
+// a path relative to the input. Paths outside the upstream suite are never run.
+func (g *Generator) chapterRuns(name string) bool {
+	for {
+		if first, ok := CHAPTER_PATHS[name]; ok {
+			return len(first) > 0 && chapterIndex(first) <= chapterIndex(g.Chapter)
+		}
+		if !strings.Contains(name, "/") {
+			return false
+		}
+		name = path.Dir(name)
+	}
+}
+
+// chapterVisits reports whether the suite of -chapter runs anything inside the directory at name.
+func (g *Generator) chapterVisits(name string) bool {
+	if g.chapterRuns(name) {
+		return true
+	}
+	for candidate := range CHAPTER_PATHS {
+		if strings.HasPrefix(candidate, name+"/") && g.chapterRuns(candidate) {
+			return true
+		}
+	}
+	return false
+}
+
+// moduleDirectories returns the names of the input directories to generate test modules for.
+func (g *Generator) moduleDirectories(files []fs.FileInfo) []string {
+	names := make([]string, 0)
+	for _, fileInfo := range files {
+		name := fileInfo.Name()
+
+		if !fileInfo.IsDir() {
+			// If it is a file, write the test in the top level module.
+			// writeTest(f, &fileInfo, "", 1)
+			continue
+		}
+
+		// If it is a directory, create a new test module for its tests.
+		if len(g.Chapter) > 0 && !g.chapterVisits(name) {
+			g.excludedDirectories[name] = true
+			continue
+		}
+		suite, _ := g.loadSuite(name)
+		if !matchesAny(g.IncludePatterns, name) && !(suite.selected && g.defaultInclude) {
+			if !g.IgnoreExcluded {
+				g.excludedDirectories[name] = true
+				continue
+			}
+			g.ignoredDirectories[name] = "not selected by -include"
+		} else if matchesAny(g.ExcludePatterns, name) {
+			if !g.IgnoreExcluded {
+				g.excludedDirectories[name] = true
+				continue
+			}
+			g.ignoredDirectories[name] = "left out by -exclude"
+		} else if suite.skipped {
+			if !g.IgnoreExcluded {
+				g.excludedDirectories[name] = true
+				continue
+			}
+			g.ignoredDirectories[name] = suite.skipReason()
+		}
+		names = append(names, name)
+	}
+	return names
+}
+
+// invalidUTF8Offset returns the byte offset of the first invalid UTF-8 sequence in data, or -1.
+func invalidUTF8Offset(data []byte) int {
+	for offset := 0; offset < len(data); {
+		r, size := utf8.DecodeRune(data[offset:])
+		if r == utf8.RuneError && size == 1 {
+			return offset
+		}
+		offset += size
+	}
+	return -1
+}
+
+// validateSources checks that every test file is valid UTF-8, since the generated
+// Rust string literals would be invalid otherwise. With -lossy, invalid bytes are
+// replaced when the file is parsed instead.
+func (g *Generator) validateSources(directories []string) {
+	if g.Lossy {
+		return
+	}
+	for _, name := range directories {
+		if g.stopped() {
+			return
+		}
+		modTestFilesInfo, subdirectories, err := g.listModule(name)
+		if err != nil {
+			g.reportError(err)
+			continue
+		}
+		g.validateSources(subdirectories)
+		for _, tf := range modTestFilesInfo {
+			if g.stopped() {
+				return
+			}
+			if tf.Name() == DEFAULTS_FILE {
+				continue
+			}
+			start := time.Now()
+			data, err := fs.ReadFile(g.inputFS, sourcePath(name, tf.Name()))
+			g.timePhase("reading", start)
+			if err != nil {
+				g.reportError(err)
+				continue
+			}
+			if offset := invalidUTF8Offset(data); offset >= 0 {
+				g.reportError(fmt.Errorf("%s: invalid UTF-8 at byte offset %d (use -lossy to replace invalid bytes)", g.displayPath(name, tf.Name()), offset))
+			}
+		}
+	}
+}
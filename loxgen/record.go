@@ -0,0 +1,155 @@
+package loxgen
+
+import (
+	"fmt"
+	"io/fs"
+	"io/ioutil"
+	"log"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strconv"
+	"strings"
+)
+
+// RECORDED_NOTICE ends the files -record writes expectations into, until they are checked.
+const RECORDED_NOTICE = "// TODO: the expectations of this file were recorded from the output of rlox, verify them by hand and remove this line."
+
+// printPattern matches the print statements of a line of Lox.
+var printPattern = regexp.MustCompile(`\bprint\b`)
+
+// reportedCompileErrorPattern matches the compile errors rlox prints, e.g.
+// `[line 3] Error at "b": Expect ';' after value.`, the lexeme being quoted as a Rust string.
+var reportedCompileErrorPattern = regexp.MustCompile(`^\[line (\d+)\] Error( at end| at "(.*)")?: (.*)$`)
+
+// reportedTracePattern matches the lines of the stack trace of a runtime error, e.g. `[line 3] in script`.
+var reportedTracePattern = regexp.MustCompile(`^\[line (\d+)\] in `)
+
+// recordExpectations runs the selected test files that have no expectation with the rlox
+// executable, and writes the comments of what it printed into them:
+//   - an `// expect: ` comment for each line of stdout, on the line of its print statement if
+//     there are as many print statements as lines printed, each on a line of its own, else at
+//     the end of the file,
+//   - the compile errors on the lines they are reported on, as `// Error at 'x': ` comments,
+//   - a runtime error as an `// expect runtime error: ` comment on the line it stopped at,
+//   - `// no-output` if the program ran without printing anything.
+//
+// The files end with RECORDED_NOTICE, as what the executable does is not necessarily right.
+func (g *Generator) recordExpectations(files []fs.FileInfo) error {
+	selected, err := g.selectedTests(files)
+	if err != nil {
+		return err
+	}
+	tests := make([]testFile, 0)
+	for _, test := range selected {
+		if !hasMarker(test) && !test.empty && !test.nontest {
+			tests = append(tests, test)
+		}
+	}
+
+	recorded := 0
+	for _, test := range tests {
+		stdout, stderr, exitCode, err := g.execute(g.RloxBinary, test)
+		if err != nil {
+			g.reportError(fmt.Errorf("%s: %v", test.path, err))
+			continue
+		}
+		lines := recordedSource(test.source, stdout, stderr, exitCode)
+		target := filepath.Join(g.InputDirectory, filepath.FromSlash(sourcePath(test.moduleName, test.fileName)))
+		info, err := os.Stat(target)
+		if err != nil {
+			g.reportError(err)
+			continue
+		}
+		if err := ioutil.WriteFile(target, []byte(strings.Join(lines, "\n")+"\n"), info.Mode()); err != nil {
+			g.reportError(err)
+			continue
+		}
+		recorded++
+		log.Printf("Recorded the expectations of %s.", test.path)
+	}
+	for _, err := range g.generationErrors {
+		log.Print(err)
+	}
+	if recorded > 0 {
+		log.Printf("Recorded the output of %d file(s). Verify the comments by hand: they say what %s does, not what it should do.", recorded, g.RloxBinary)
+	} else {
+		log.Print("No selected file lacks expectations, nothing was recorded.")
+	}
+	if len(g.generationErrors) > 0 {
+		return ErrFailed
+	}
+	return nil
+}
+
+// recordedSource returns the lines of a source with the comments of a run's output added,
+// see recordExpectations.
+func recordedSource(source []string, stdout []string, stderr []string, exitCode int) []string {
+	lines := append([]string(nil), source...)
+	annotate := func(line int, comment string) bool {
+		if line < 1 || line > len(lines) {
+			return false
+		}
+		lines[line-1] = strings.TrimRight(lines[line-1], " \t") + " " + comment
+		return true
+	}
+	var trailing []string
+
+	// The values are put on their print statements if they can only have come from them.
+	printLines := make([]int, 0)
+	for i, line := range source {
+		if count := len(printPattern.FindAllString(codeOf(line), -1)); count == 1 {
+			printLines = append(printLines, i+1)
+		} else if count > 1 {
+			printLines = nil
+			break
+		}
+	}
+	inline := len(printLines) == len(stdout)
+	for i, value := range stdout {
+		if !inline || !annotate(printLines[i], "// expect: "+value) {
+			trailing = append(trailing, "// expect: "+value)
+		}
+	}
+
+	switch exitCode {
+	case EXIT_COMPILE_ERROR:
+		for _, line := range stderr {
+			match := reportedCompileErrorPattern.FindStringSubmatch(line)
+			if match == nil {
+				continue
+			}
+			comment := "// Error: " + match[4]
+			if match[2] == " at end" {
+				comment = "// Error at end: " + match[4]
+			} else if len(match[2]) > 0 {
+				comment = fmt.Sprintf("// Error at '%s': %s", match[3], match[4])
+			}
+			reported, _ := strconv.Atoi(match[1])
+			if !annotate(reported, comment) {
+				trailing = append(trailing, "// [line "+match[1]+"] "+strings.TrimPrefix(comment, "// "))
+			}
+		}
+	case EXIT_RUNTIME_ERROR:
+		if len(stderr) > 0 {
+			comment := "// expect runtime error: " + stderr[0]
+			reported := 0
+			for _, line := range stderr[1:] {
+				if match := reportedTracePattern.FindStringSubmatch(line); match != nil {
+					reported, _ = strconv.Atoi(match[1])
+					break
+				}
+			}
+			if !annotate(reported, comment) {
+				trailing = append(trailing, comment)
+			}
+		}
+	case EXIT_SUCCESS:
+		if len(stdout) == 0 {
+			trailing = append(trailing, "// no-output")
+		}
+	default:
+		trailing = append(trailing, fmt.Sprintf("// expect exit: %d", exitCode))
+	}
+	return append(append(lines, trailing...), RECORDED_NOTICE)
+}
@@ -0,0 +1,499 @@
+package loxgen
+
+import (
+	"bytes"
+	"encoding/xml"
+	"fmt"
+	htmltemplate "html/template"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// printGitHubAnnotations prints a GitHub Actions workflow command for each failure, and a warning
+// for each flaky pass, so that they are shown on the line of the test file they are about in the
+// diff of a pull request. It returns how many tests failed.
+func printGitHubAnnotations(results []runResult) int {
+	failed := 0
+	for _, result := range results {
+		if len(result.problem) > 0 {
+			failed++
+			fmt.Printf("::error file=%s,line=%d::%s\n", annotationProperty(result.test.path), failureLine(result), annotationData(result.problem))
+		} else if result.flakyPass() {
+			message := fmt.Sprintf("flaky, passed on attempt %d, after %s", len(result.retried)+1, strings.Join(result.retried, " / "))
+			fmt.Printf("::warning file=%s,line=1::%s\n", annotationProperty(result.test.path), annotationData(message))
+		}
+	}
+	return failed
+}
+
+// failureLine returns the line of the test file a failure is best shown on: the first expected
+// value not printed, else the line the error is expected on, else the first line.
+func failureLine(result runResult) int {
+	for i, expected := range result.test.expectedValues {
+		if i >= len(result.stdout) || result.stdout[i] != expected.value {
+			return expected.line
+		}
+	}
+	switch {
+	case result.test.expectedErrorLine > 0:
+		return result.test.expectedErrorLine
+	case len(result.test.expectedCompileError.value) > 0:
+		return result.test.expectedCompileError.line
+	case len(result.test.expectedErrors) > 0:
+		return result.test.expectedErrors[0].line
+	case len(result.test.expectedError.value) > 0:
+		return result.test.expectedError.line
+	}
+	return 1
+}
+
+// annotationData escapes the message of a workflow command.
+func annotationData(text string) string {
+	return strings.NewReplacer("%", "%25", "\r", "%0D", "\n", "%0A").Replace(text)
+}
+
+// annotationProperty escapes a property value of a workflow command, such as its file.
+func annotationProperty(text string) string {
+	return strings.NewReplacer("%", "%25", "\r", "%0D", "\n", "%0A", ":", "%3A", ",", "%2C").Replace(text)
+}
+
+// printTAP prints the results in the Test Anything Protocol, one test point per file,
+// with a YAML diagnostic block for failures. It returns how many tests failed.
+func printTAP(results []runResult) int {
+	failed := 0
+	fmt.Println("TAP version 13")
+	fmt.Printf("1..%d\n", len(results))
+	for i, result := range results {
+		if result.flakyPass() {
+			fmt.Printf("ok %d - %s (flaky, passed on attempt %d)\n", i+1, result.test.path, len(result.retried)+1)
+			continue
+		}
+		if len(result.expectedFailure) > 0 {
+			// Failing TODO test points are not counted as failures.
+			fmt.Printf("not ok %d - %s # TODO %s: %s\n", i+1, result.test.path, KNOWN_FAILURE_REASON, result.expectedFailure)
+			continue
+		}
+		if len(result.problem) == 0 {
+			fmt.Printf("ok %d - %s\n", i+1, result.test.path)
+			continue
+		}
+		failed++
+		fmt.Printf("not ok %d - %s\n", i+1, result.test.path)
+		fmt.Println("  ---")
+		fmt.Printf("  message: %s\n", strconv.Quote(result.problem))
+		fmt.Printf("  duration_ms: %d\n", result.duration.Milliseconds())
+		writeYAMLBlock("diff", strings.Split(strings.TrimSuffix(outputDiff(expectedOutput(result.test), result.stdout), "\n"), "\n"))
+		writeYAMLBlock("stderr", result.stderr)
+		fmt.Println("  ...")
+	}
+	return failed
+}
+
+// writeYAMLBlock prints lines as a literal block of a TAP diagnostic, unless there are none.
+func writeYAMLBlock(key string, lines []string) {
+	if len(lines) == 0 || (len(lines) == 1 && len(lines[0]) == 0) {
+		return
+	}
+	fmt.Printf("  %s: |\n", key)
+	for _, line := range lines {
+		fmt.Printf("    %s\n", line)
+	}
+}
+
+// htmlReport lays out the results of the run subcommand, with the sections of failures opened.
+var htmlReport = htmltemplate.Must(htmltemplate.New("report").Parse(`<!DOCTYPE html>
+<html>
+<head>
+<meta charset="utf-8">
+<title>rlox conformance</title>
+<style>
+body { font-family: sans-serif; }
+pre { background: #f6f8fa; padding: 0.5em; }
+.pass summary { color: #1a7f37; }
+.fail summary { color: #cf222e; font-weight: bold; }
+.flaky summary { color: #9a6700; }
+.xfail summary { color: #57606a; }
+.removed { background: #ffebe9; }
+.added { background: #dafbe1; }
+</style>
+</head>
+<body>
+<h1>rlox conformance</h1>
+<p>{{.Passed}} passed, {{.Failed}} failed.</p>
+{{range .Tests}}
+<details class="{{if .Problem}}fail{{else if .ExpectedFailure}}xfail{{else if .Retried}}flaky{{else}}pass{{end}}"{{if .Problem}} open{{end}}>
+<summary>{{.Path}}{{if .Problem}}: {{.Problem}}{{else if .ExpectedFailure}}: known failure, {{.ExpectedFailure}}{{else if .Retried}}: flaky, passed after {{range $i, $problem := .Retried}}{{if $i}} / {{end}}{{$problem}}{{end}}{{end}} ({{.Duration}})</summary>
+<h3>Source</h3>
+<pre>{{.Source}}</pre>
+<h3>Expected output</h3>
+<pre>{{.Expected}}</pre>
+<h3>Actual output</h3>
+<pre>{{.Actual}}</pre>
+{{if .Stderr}}<h3>stderr</h3>
+<pre>{{.Stderr}}</pre>{{end}}
+{{if .Problem}}<h3>Diff</h3>
+<pre>{{range .Diff}}<span class="{{.Class}}">{{.Line}}</span>
+{{end}}</pre>{{end}}
+</details>
+{{end}}
+</body>
+</html>
+`))
+
+type htmlDiffLine struct {
+	Class string
+	Line  string
+}
+
+type htmlTest struct {
+	Path     string
+	Problem  string
+	Duration time.Duration
+	Source   string
+	Expected string
+	Actual   string
+	Stderr   string
+	Diff     []htmlDiffLine
+	// What failed before a flaky pass.
+	Retried []string
+	// What failed for a known failure.
+	ExpectedFailure string
+}
+
+// writeHTMLReport writes the results as an HTML page with a section for each test.
+func writeHTMLReport(path string, results []runResult, failed int) error {
+	tests := make([]htmlTest, 0, len(results))
+	for _, result := range results {
+		expected := expectedOutput(result.test)
+		test := htmlTest{
+			Path:     result.test.path,
+			Problem:  result.problem,
+			Duration: result.duration.Round(time.Microsecond),
+			Source:   strings.Join(result.test.source, "\n"),
+			Expected: strings.Join(expected, "\n"),
+			Actual:   strings.Join(result.stdout, "\n"),
+			Stderr:   strings.Join(result.stderr, "\n"),
+
+			ExpectedFailure: result.expectedFailure,
+		}
+		if result.flakyPass() {
+			test.Retried = result.retried
+		}
+		for _, line := range strings.Split(strings.TrimSuffix(outputDiff(expected, result.stdout), "\n"), "\n") {
+			class := ""
+			if strings.HasPrefix(line, "- ") {
+				class = "removed"
+			} else if strings.HasPrefix(line, "+ ") {
+				class = "added"
+			}
+			test.Diff = append(test.Diff, htmlDiffLine{class, line})
+		}
+		tests = append(tests, test)
+	}
+	var page bytes.Buffer
+	err := htmlReport.Execute(&page, struct {
+		Passed, Failed int
+		Tests          []htmlTest
+	}{len(results) - failed - knownFailureCount(results), failed, tests})
+	if err != nil {
+		return err
+	}
+	return writeFileAtomically(path, page.Bytes())
+}
+
+// MARKDOWN_SNIPPET_LINES is how many lines of the diff and of stderr the Markdown report shows for a failure.
+const MARKDOWN_SNIPPET_LINES = 20
+
+// writeMarkdownReport writes the results as a Markdown summary: the number of tests passed and
+// failed in each directory, then a collapsed section with the diff and stderr of each failure.
+func writeMarkdownReport(path string, results []runResult, failed int) error {
+	type moduleCounts struct {
+		name                                 string
+		passed, failed, flaky, knownFailures int
+	}
+	modules := make([]moduleCounts, 0)
+	indices := make(map[string]int)
+	for _, result := range results {
+		index, ok := indices[result.test.moduleName]
+		if !ok {
+			index = len(modules)
+			indices[result.test.moduleName] = index
+			modules = append(modules, moduleCounts{name: result.test.moduleName})
+		}
+		switch {
+		case len(result.problem) > 0:
+			modules[index].failed++
+		case len(result.expectedFailure) > 0:
+			modules[index].knownFailures++
+		case result.flakyPass():
+			modules[index].flaky++
+			modules[index].passed++
+		default:
+			modules[index].passed++
+		}
+	}
+
+	var report strings.Builder
+	status := ":white_check_mark:"
+	if failed > 0 {
+		status = ":x:"
+	}
+	fmt.Fprintf(&report, "## %s rlox conformance\n\n", status)
+	known := knownFailureCount(results)
+	if known > 0 {
+		fmt.Fprintf(&report, "%d passed, %d known failure(s), %d failed.\n\n", len(results)-failed-known, known, failed)
+	} else {
+		fmt.Fprintf(&report, "%d passed, %d failed.\n\n", len(results)-failed, failed)
+	}
+	report.WriteString("| Directory | Passed | Failed | Flaky | Known failures |\n")
+	report.WriteString("| --- | ---: | ---: | ---: | ---: |\n")
+	for _, module := range modules {
+		name := module.name
+		if len(name) == 0 {
+			name = "."
+		}
+		fmt.Fprintf(&report, "| %s | %d | %d | %d | %d |\n", markdownCell(name), module.passed, module.failed, module.flaky, module.knownFailures)
+	}
+
+	if failed > 0 {
+		report.WriteString("\n### Failures\n")
+	}
+	for _, result := range results {
+		if len(result.problem) == 0 {
+			continue
+		}
+		fmt.Fprintf(&report, "\n<details>\n<summary><code>%s</code>: %s</summary>\n\n",
+			htmltemplate.HTMLEscapeString(result.test.path), htmltemplate.HTMLEscapeString(result.problem))
+		diff := strings.Split(strings.TrimSuffix(outputDiff(expectedOutput(result.test), result.stdout), "\n"), "\n")
+		writeMarkdownSnippet(&report, "diff", diff)
+		writeMarkdownSnippet(&report, "text", result.stderr)
+		report.WriteString("</details>\n")
+	}
+	return writeFileAtomically(path, []byte(report.String()))
+}
+
+// writeMarkdownSnippet writes lines as a fenced code block, cut after MARKDOWN_SNIPPET_LINES lines,
+// unless there are none.
+func writeMarkdownSnippet(report *strings.Builder, language string, lines []string) {
+	if len(lines) == 0 || (len(lines) == 1 && len(lines[0]) == 0) {
+		return
+	}
+	omitted := 0
+	if len(lines) > MARKDOWN_SNIPPET_LINES {
+		omitted = len(lines) - MARKDOWN_SNIPPET_LINES
+		lines = lines[:MARKDOWN_SNIPPET_LINES]
+	}
+	fence := "```"
+	for strings.Contains(strings.Join(lines, "\n"), fence) {
+		fence += "`"
+	}
+	fmt.Fprintf(report, "%s%s\n%s\n", fence, language, strings.Join(lines, "\n"))
+	if omitted > 0 {
+		fmt.Fprintf(report, "... %d more line(s)\n", omitted)
+	}
+	fmt.Fprintf(report, "%s\n\n", fence)
+}
+
+// markdownCell escapes the characters ending or formatting a cell of a Markdown table.
+func markdownCell(text string) string {
+	return strings.NewReplacer("|", "\\|", "_", "\\_", "*", "\\*").Replace(text)
+}
+
+// expectedOutput returns the lines a test expects the executable to print on stdout.
+func expectedOutput(test testFile) []string {
+	expected := make([]string, 0, len(test.expectedValues))
+	for _, value := range test.expectedValues {
+		expected = append(expected, value.value)
+	}
+	return expected
+}
+
+// outputDiff compares the expected and actual lines, prefixing lines only expected with "- ",
+// lines only printed with "+ " and matching lines with two spaces.
+func outputDiff(expected []string, actual []string) string {
+	var diff strings.Builder
+	for i := 0; i < len(expected) || i < len(actual); i++ {
+		switch {
+		case i < len(expected) && i < len(actual) && expected[i] == actual[i]:
+			diff.WriteString("  " + expected[i] + "\n")
+		default:
+			if i < len(expected) {
+				diff.WriteString("- " + expected[i] + "\n")
+			}
+			if i < len(actual) {
+				diff.WriteString("+ " + actual[i] + "\n")
+			}
+		}
+	}
+	return diff.String()
+}
+
+// JUnit XML elements, as read by Jenkins, GitLab and Azure Pipelines.
+type junitTestSuites struct {
+	XMLName xml.Name         `xml:"testsuites"`
+	Suites  []junitTestSuite `xml:"testsuite"`
+}
+
+type junitTestSuite struct {
+	Name     string          `xml:"name,attr"`
+	Tests    int             `xml:"tests,attr"`
+	Failures int             `xml:"failures,attr"`
+	Skipped  int             `xml:"skipped,attr"`
+	Time     string          `xml:"time,attr"`
+	Cases    []junitTestCase `xml:"testcase"`
+}
+
+type junitTestCase struct {
+	Name      string        `xml:"name,attr"`
+	ClassName string        `xml:"classname,attr"`
+	File      string        `xml:"file,attr"`
+	Time      string        `xml:"time,attr"`
+	Failure   *junitFailure `xml:"failure,omitempty"`
+	// Set for a known failure, that failed as expected.
+	Skipped *junitSkipped `xml:"skipped,omitempty"`
+	// The failed attempts of a flaky pass, as Maven Surefire reports them.
+	FlakyFailures []junitFailure `xml:"flakyFailure,omitempty"`
+}
+
+type junitSkipped struct {
+	Message string `xml:"message,attr"`
+}
+
+type junitFailure struct {
+	Message string `xml:"message,attr"`
+	Body    string `xml:",chardata"`
+}
+
+// writeJUnit writes the results as JUnit XML, with one test suite per directory.
+// The body of a failure is the diff of the expected and the actual output, followed by stderr.
+func writeJUnit(path string, results []runResult) error {
+	var report junitTestSuites
+	suites := make(map[string]int)
+	durations := make([]time.Duration, 0)
+	for _, result := range results {
+		index, ok := suites[result.test.moduleName]
+		if !ok {
+			index = len(report.Suites)
+			suites[result.test.moduleName] = index
+			report.Suites = append(report.Suites, junitTestSuite{Name: result.test.moduleName})
+			durations = append(durations, 0)
+		}
+		suite := &report.Suites[index]
+		testCase := junitTestCase{
+			Name:      result.test.name,
+			ClassName: strings.ReplaceAll(result.test.moduleName, "/", "."),
+			File:      result.test.path,
+			Time:      fmt.Sprintf("%.3f", result.duration.Seconds()),
+		}
+		if len(result.problem) > 0 {
+			body := outputDiff(expectedOutput(result.test), result.stdout)
+			if len(result.stderr) > 0 {
+				body += "stderr:\n" + strings.Join(result.stderr, "\n") + "\n"
+			}
+			testCase.Failure = &junitFailure{Message: result.problem, Body: body}
+			suite.Failures++
+		} else if len(result.expectedFailure) > 0 {
+			testCase.Skipped = &junitSkipped{Message: KNOWN_FAILURE_REASON + ": " + result.expectedFailure}
+			suite.Skipped++
+		} else {
+			for _, problem := range result.retried {
+				testCase.FlakyFailures = append(testCase.FlakyFailures, junitFailure{Message: problem})
+			}
+		}
+		durations[index] += result.duration
+		suite.Time = fmt.Sprintf("%.3f", durations[index].Seconds())
+		suite.Tests++
+		suite.Cases = append(suite.Cases, testCase)
+	}
+	data, err := xml.MarshalIndent(report, "", "  ")
+	if err != nil {
+		return err
+	}
+	return writeFileAtomically(path, append([]byte(xml.Header), append(data, '\n')...))
+}
+
+// outputLines splits the output of the executable into lines.
+func outputLines(output string) []string {
+	if len(output) == 0 {
+		return nil
+	}
+	return strings.Split(strings.TrimSuffix(output, "\n"), "\n")
+}
+
+// summarizeModule counts the tests of a directory by what they expect. A test expecting
+// both output and an error counts towards both.
+func (g *Generator) summarizeModule(moduleName string, tests []testFile) moduleSummary {
+	summary := moduleSummary{Module: moduleName, Tests: len(tests), Ignored: len(g.ignoreReason) > 0}
+	for _, test := range tests {
+		withOutput := len(test.expectedValues) > 0 || len(test.expectedStreams) > 0 || test.noOutput || len(g.ReferenceDirectory) > 0
+		withErrors := len(test.expectedErrors) > 0 || len(test.expectedCompileError.value) > 0 || len(test.expectedErrorKind) > 0 || test.panics
+		if withOutput {
+			summary.WithOutput++
+		}
+		if withErrors {
+			summary.WithErrors++
+		}
+		if !withOutput && !withErrors {
+			summary.WithoutExpectations++
+		}
+	}
+	return summary
+}
+
+// summarize totals the summaries of the modules generated.
+func (g *Generator) summarize() generationSummary {
+	summary := generationSummary{
+		Modules:             g.moduleSummaries,
+		SkippedFiles:        g.skippedFiles,
+		ExcludedDirectories: make([]string, 0, len(g.excludedDirectories)),
+	}
+	if summary.Modules == nil {
+		summary.Modules = make([]moduleSummary, 0)
+	}
+	if summary.SkippedFiles == nil {
+		summary.SkippedFiles = make([]string, 0)
+	}
+	for _, module := range g.moduleSummaries {
+		summary.Tests += module.Tests
+		summary.WithOutput += module.WithOutput
+		summary.WithErrors += module.WithErrors
+		summary.WithoutExpectations += module.WithoutExpectations
+	}
+	for name := range g.excludedDirectories {
+		summary.ExcludedDirectories = append(summary.ExcludedDirectories, name)
+	}
+	sort.Strings(summary.ExcludedDirectories)
+	return summary
+}
+
+// printSummary prints how many tests were generated from each directory, and what was left out.
+func printSummary(summary generationSummary) {
+	fmt.Fprintf(os.Stderr, "Generated %d test(s) in %d module(s): %d with output expectations, %d with error expectations, %d with neither.\n",
+		summary.Tests, len(summary.Modules), summary.WithOutput, summary.WithErrors, summary.WithoutExpectations)
+	width := 0
+	for _, module := range summary.Modules {
+		if len(module.Module) > width {
+			width = len(module.Module)
+		}
+	}
+	for _, module := range summary.Modules {
+		ignored := ""
+		if module.Ignored {
+			ignored = ", ignored"
+		}
+		fmt.Fprintf(os.Stderr, "  %-*s %4d (%d output, %d error, %d neither%s)\n",
+			width, module.Module, module.Tests, module.WithOutput, module.WithErrors, module.WithoutExpectations, ignored)
+	}
+	if len(summary.SkippedFiles) > 0 {
+		fmt.Fprintf(os.Stderr, "Skipped %d file(s):\n", len(summary.SkippedFiles))
+		for _, skipped := range summary.SkippedFiles {
+			fmt.Fprintf(os.Stderr, "  %s\n", skipped)
+		}
+	}
+	if len(summary.ExcludedDirectories) > 0 {
+		fmt.Fprintf(os.Stderr, "Directories left out: %s\n", strings.Join(summary.ExcludedDirectories, ", "))
+	}
+}
@@ -0,0 +1,477 @@
+package loxgen
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"io/fs"
+	"io/ioutil"
+	"log"
+	"math"
+	"os"
+	"os/exec"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Exit codes of the rlox executable, see run_file in src/main.rs.
+const (
+	EXIT_SUCCESS       = 0
+	EXIT_COMPILE_ERROR = 65
+	EXIT_RUNTIME_ERROR = 70
+	// The status of a Rust program that panicked.
+	EXIT_PANIC = 101
+)
+
+// runResult is the outcome of running a test with the rlox executable.
+type runResult struct {
+	test testFile
+	// What did not match the test's expectations, empty if it passed.
+	problem  string
+	stdout   []string
+	stderr   []string
+	duration time.Duration
+	// What did not match in the attempts before this one, if the test was run again after failing.
+	// A test passing after a retry is a flaky pass.
+	retried []string
+	// What did not match for a known failure, which does not count as a failure then.
+	expectedFailure string
+}
+
+// FLAKY_RETRIES is how many times a `// flaky` test is run again at least.
+const FLAKY_RETRIES = 2
+
+// knownFailureCount returns how many of the results are known failures that failed as expected.
+func knownFailureCount(results []runResult) int {
+	count := 0
+	for _, result := range results {
+		if len(result.expectedFailure) > 0 {
+			count++
+		}
+	}
+	return count
+}
+
+// flakyPass reports whether a test only passed after failing.
+func (result runResult) flakyPass() bool {
+	return len(result.problem) == 0 && len(result.retried) > 0
+}
+
+// runWithRetries runs a test, and again after each failure, up to -retries times,
+// or FLAKY_RETRIES times for a `// flaky` test if that is more. A known failure is run once,
+// and fails if it passes.
+func (g *Generator) runWithRetries(test testFile) runResult {
+	if test.knownFailure {
+		// Failing is what a known failure is expected to do, it is not run again.
+		result := g.runTest(test)
+		if len(result.problem) > 0 {
+			result.expectedFailure, result.problem = result.problem, ""
+		} else {
+			result.problem = fmt.Sprintf("passed unexpectedly, remove it from %s", g.KnownFailuresPath)
+		}
+		return result
+	}
+	attempts := g.Retries
+	if test.flaky && attempts < FLAKY_RETRIES {
+		attempts = FLAKY_RETRIES
+	}
+	result := g.runTest(test)
+	var retried []string
+	for ; len(result.problem) > 0 && attempts > 0; attempts-- {
+		retried = append(retried, result.problem)
+		result = g.runTest(test)
+	}
+	result.retried = retried
+	return result
+}
+
+// runTests runs every selected test with the rlox executable and compares what it prints and
+// its exit code with the expectations, without generating any Rust. It returns ErrFailed
+// if a test failed.
+func (g *Generator) runTests(files []fs.FileInfo) error {
+	tests, err := g.selectedTests(files)
+	if err != nil {
+		return err
+	}
+	results := g.runAll(tests)
+
+	failed, flaky := 0, 0
+	for _, result := range results {
+		if result.flakyPass() {
+			flaky++
+		}
+	}
+	if g.RunFormat == "tap" {
+		failed = printTAP(results)
+	} else if g.RunFormat == "github" {
+		failed = printGitHubAnnotations(results)
+	} else {
+		for _, result := range results {
+			if len(result.problem) > 0 {
+				failed++
+				fmt.Printf("FAIL %s: %s\n", result.test.path, result.problem)
+			} else if len(result.expectedFailure) > 0 {
+				fmt.Printf("XFAIL %s: %s\n", result.test.path, result.expectedFailure)
+			} else if result.flakyPass() {
+				fmt.Printf("FLAKY %s: passed on attempt %d, after %s\n", result.test.path, len(result.retried)+1, strings.Join(result.retried, " / "))
+			} else {
+				fmt.Printf("PASS %s\n", result.test.path)
+			}
+		}
+	}
+	if len(g.JunitPath) > 0 {
+		if err := writeJUnit(g.JunitPath, results); err != nil {
+			g.reportError(err)
+		}
+	}
+	if len(g.HtmlReportPath) > 0 {
+		if err := writeHTMLReport(g.HtmlReportPath, results, failed); err != nil {
+			g.reportError(err)
+		}
+	}
+	if len(g.MarkdownReportPath) > 0 {
+		if err := writeMarkdownReport(g.MarkdownReportPath, results, failed); err != nil {
+			g.reportError(err)
+		}
+	}
+	for _, err := range g.generationErrors {
+		log.Print(err)
+	}
+	expectedFailures := knownFailureCount(results)
+	passed := fmt.Sprintf("%d passed", len(results)-failed-expectedFailures)
+	if flaky > 0 {
+		passed += fmt.Sprintf(" (%d flaky)", flaky)
+	}
+	if expectedFailures > 0 {
+		passed += fmt.Sprintf(", %d known failure(s)", expectedFailures)
+	}
+	if g.RunFormat == "tap" {
+		fmt.Printf("# %s, %d failed.\n", passed, failed)
+	} else {
+		fmt.Printf("%s, %d failed.\n", passed, failed)
+	}
+	if failed > 0 || len(g.generationErrors) > 0 {
+		return ErrFailed
+	}
+	return nil
+}
+
+// collectTests returns the tests of a directory followed by those of its subdirectories.
+func (g *Generator) collectTests(moduleName string) []testFile {
+	if g.stopped() {
+		return nil
+	}
+	modFilesInfo, subdirectories, err := g.listModule(moduleName)
+	if err != nil {
+		g.reportError(err)
+		return nil
+	}
+	tests := g.parseModule(moduleName, modFilesInfo)
+	for _, subdirectory := range subdirectories {
+		if _, ok := g.ignoredDirectories[subdirectory]; !ok {
+			tests = append(tests, g.collectTests(subdirectory)...)
+		}
+	}
+	return tests
+}
+
+// selectedTests returns the tests of the top level directories that are not ignored, for
+// the subcommands running them. With -fail-fast, it returns the first problem instead.
+func (g *Generator) selectedTests(files []fs.FileInfo) ([]testFile, error) {
+	tests := make([]testFile, 0)
+	for _, name := range g.moduleDirectories(files) {
+		if _, ok := g.ignoredDirectories[name]; !ok {
+			tests = append(tests, g.collectTests(name)...)
+		}
+	}
+	if g.stopped() {
+		return nil, g.generationErrors[0]
+	}
+	return tests, nil
+}
+
+// runAll runs the tests on -j workers. The results are in the same order as the tests,
+// however long each of them takes.
+func (g *Generator) runAll(tests []testFile) []runResult {
+	results := make([]runResult, len(tests))
+	indices := make(chan int)
+	var workers sync.WaitGroup
+	for worker := 0; worker < g.Jobs; worker++ {
+		workers.Add(1)
+		go func() {
+			defer workers.Done()
+			for i := range indices {
+				results[i] = g.runWithRetries(tests[i])
+			}
+		}()
+	}
+	for i := range tests {
+		indices <- i
+	}
+	close(indices)
+	workers.Wait()
+	return results
+}
+
+// runTest runs the rlox executable on the source of a test and checks the result.
+func (g *Generator) runTest(test testFile) (result runResult) {
+	result.test = test
+	start := time.Now()
+	defer func() {
+		result.duration = time.Since(start)
+	}()
+
+	stdout, stderr, exitCode, err := g.execute(g.RloxBinary, test)
+	if err != nil {
+		result.problem = err.Error()
+		return result
+	}
+	result.stdout = stdout
+	result.stderr = stderr
+	result.problem = g.checkRun(test, result.stdout, result.stderr, exitCode)
+	return result
+}
+
+// execute runs the source of a test with an rlox executable, and returns the lines it printed
+// on stdout and stderr and its exit code, or why it could not be run to the end.
+func (g *Generator) execute(binary string, test testFile) (stdout []string, stderr []string, exitCode int, err error) {
+	// The source is copied to a file of its own, since the input may be an archive.
+	file, err := os.CreateTemp("", test.name+"-*.lox")
+	if err != nil {
+		return nil, nil, 0, err
+	}
+	defer os.Remove(file.Name())
+	_, err = file.WriteString(strings.Join(test.source, "\n") + "\n")
+	if closeErr := file.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		return nil, nil, 0, err
+	}
+
+	ctx := context.Background()
+	if timeout := g.testTimeout(test); timeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, timeout)
+		defer cancel()
+	}
+	var stdoutBuffer, stderrBuffer bytes.Buffer
+	// The context kills rlox once the timeout is over. Processes it started could keep its
+	// output open, so they are only waited for a little while longer.
+	command := exec.CommandContext(ctx, binary, file.Name())
+	command.WaitDelay = time.Second
+	command.Stdin = strings.NewReader(stdinText(test))
+	command.Stdout = &stdoutBuffer
+	command.Stderr = &stderrBuffer
+	if err := command.Run(); err != nil {
+		if ctx.Err() == context.DeadlineExceeded {
+			return nil, nil, 0, fmt.Errorf("timed out after %v", g.testTimeout(test))
+		}
+		var exitError *exec.ExitError
+		if !errors.As(err, &exitError) {
+			return nil, nil, 0, err
+		}
+		exitCode = exitError.ExitCode()
+	}
+	return outputLines(stdoutBuffer.String()), outputLines(stderrBuffer.String()), exitCode, nil
+}
+
+// expectedExitStatus returns the status rlox has to exit with when running a test. It is 0
+// when the test expects an error without saying of which kind, and any error will do.
+func expectedExitStatus(test testFile) int {
+	switch {
+	case len(test.expectedCompileError.value) > 0, test.expectedErrorKind == COMPILE_ERROR:
+		return EXIT_COMPILE_ERROR
+	case test.expectedErrorKind == RUNTIME_ERROR:
+		return EXIT_RUNTIME_ERROR
+	}
+	return EXIT_SUCCESS
+}
+
+// checkRun compares the output and exit code of a run with the expectations of a test.
+// Unlike the generated tests, it checks the printed values and the errors of a file together,
+// so a program printing values before a runtime error passes. It returns what did not match,
+// or an empty string.
+func (g *Generator) checkRun(test testFile, stdout []string, stderr []string, exitCode int) string {
+	if len(g.ReferenceDirectory) > 0 {
+		reference, err := ioutil.ReadFile(g.referencePath(test.moduleName, test.fileName))
+		if err != nil {
+			return err.Error()
+		}
+		if strings.Join(stdout, "\n") != strings.TrimSuffix(string(reference), "\n") {
+			return "output differs from the reference output"
+		}
+		return ""
+	}
+
+	if message, ok := g.panicExpectation(test); ok {
+		if exitCode != EXIT_PANIC {
+			return fmt.Sprintf("expected a panic, exited with status %d: %s", exitCode, strings.Join(stderr, " / "))
+		}
+		if !strings.Contains(strings.Join(stderr, "\n"), message) {
+			return fmt.Sprintf("expected a panic with %q, got %q", message, stderr)
+		}
+		return ""
+	}
+
+	expectedErrors := test.expectedErrors
+	if len(test.expectedCompileError.value) > 0 {
+		expectedErrors = []expectation{test.expectedCompileError}
+	}
+	expectedExitCode := expectedExitStatus(test)
+	if len(expectedErrors) > 0 && expectedExitCode == EXIT_SUCCESS {
+		// The comment does not say which kind of error it is, any will do.
+		if exitCode == 0 {
+			return "expected an error, exited with status 0"
+		}
+	} else if exitCode != expectedExitCode && !onlyDirectives(test) {
+		return fmt.Sprintf("expected exit status %d, got %d: %s", expectedExitCode, exitCode, strings.Join(stderr, " / "))
+	}
+
+	// Each stream is checked on its own, so that a line printed on the wrong one fails.
+	// All of stdout is expected, nothing at all without `// expect: ` lines, while stderr may
+	// also hold the trace of a runtime error.
+	if expected := streamValues(test, "out"); !onlyDirectives(test) {
+		if !g.outputMatches(expected, regexLines(test), stdout) {
+			return fmt.Sprintf("expected the output %q, got %q", streamExpectations(test, "out"), stdout)
+		}
+	}
+
+	if !reportsErrors(stderr, expectedErrors) {
+		messages := make([]string, 0, len(expectedErrors))
+		for _, expected := range expectedErrors {
+			messages = append(messages, expected.value)
+		}
+		if len(expectedErrors) > 0 && reportsErrors(stdout, expectedErrors) {
+			return fmt.Sprintf("expected the errors %q on stderr, they were printed on stdout", messages)
+		}
+		return fmt.Sprintf("expected the errors %q, got %q", messages, stderr)
+	}
+	if reported := reportedErrorCount(stderr, exitCode); g.ExactErrors && reported != len(expectedErrors) {
+		return fmt.Sprintf("expected %d error(s), got %d: %q", len(expectedErrors), reported, stderr)
+	}
+	if test.expectedErrorLine > 0 && !strings.Contains(strings.Join(stderr, "\n"), fmt.Sprintf("[line %d]", test.expectedErrorLine)) {
+		return fmt.Sprintf("expected the error on line %d, got %q", test.expectedErrorLine, stderr)
+	}
+	// Lexemes are quoted differently by each implementation, only the end of the source is checked.
+	if test.expectedErrorLocation == END_OF_FILE && !strings.Contains(strings.Join(stderr, "\n"), " at end: "+test.expectedError.value) {
+		return fmt.Sprintf("expected the error %q at end, got %q", test.expectedError.value, stderr)
+	}
+	if expected := traceLines(test, 0); !containsInOrder(stderr, expected) {
+		return fmt.Sprintf("expected the stack trace %q, got %q", expected, stderr)
+	}
+
+	if expected := streamExpectations(test, "err"); !containsInOrder(stderr, expected) {
+		return fmt.Sprintf("expected stderr to hold %q, got %q", expected, stderr)
+	}
+	output := strings.Join(append(stdout[:len(stdout):len(stdout)], stderr...), "\n")
+	for _, phrase := range test.directives["contains"] {
+		if !strings.Contains(output, phrase.value) {
+			return fmt.Sprintf("expected the output to contain %q, got %q", phrase.value, output)
+		}
+	}
+	return ""
+}
+
+// outputMatches reports whether the printed lines are the expected ones. The values of the
+// comments on the lines of patterns are regular expressions. With -float-epsilon, a fractional
+// number matches any number within epsilon of it.
+func (g *Generator) outputMatches(expected []expectation, patterns map[int]bool, actual []string) bool {
+	if len(expected) != len(actual) {
+		return false
+	}
+	for i, value := range expected {
+		if patterns[value.line] {
+			// Checked by parseModule.
+			pattern, _ := valuePattern(value.value)
+			if pattern == nil || !pattern.MatchString(actual[i]) {
+				return false
+			}
+			continue
+		}
+		if value.value == actual[i] {
+			continue
+		}
+		if g.FloatEpsilon <= 0 || !isFloatValue(value.value) {
+			return false
+		}
+		want, _ := strconv.ParseFloat(value.value, 64)
+		got, err := strconv.ParseFloat(actual[i], 64)
+		if err != nil || math.Abs(got-want) > g.FloatEpsilon {
+			return false
+		}
+	}
+	return true
+}
+
+// streamExpectations returns the lines a test expects on a stream, "out" or "err", in the
+// order of the file. The `// expect: ` values are printed on stdout too.
+func streamExpectations(test testFile, stream string) []string {
+	expected := streamValues(test, stream)
+	lines := make([]string, 0, len(expected))
+	for _, value := range expected {
+		lines = append(lines, value.value)
+	}
+	return lines
+}
+
+// streamValues returns the expectations of the lines of streamExpectations, with their lines.
+func streamValues(test testFile, stream string) []expectation {
+	expected := make([]expectation, 0, len(test.expectedValues)+len(test.expectedStreams))
+	if stream == "out" {
+		expected = append(expected, test.expectedValues...)
+	}
+	for _, value := range test.expectedStreams {
+		if strings.HasPrefix(value.value, stream+": ") {
+			expected = append(expected, expectation{strings.TrimPrefix(value.value, stream+": "), value.line})
+		}
+	}
+	sort.SliceStable(expected, func(i, j int) bool { return expected[i].line < expected[j].line })
+	return expected
+}
+
+// containsInOrder reports whether every expected line is in lines, in the same order.
+func containsInOrder(lines []string, expected []string) bool {
+	next := 0
+	for _, line := range lines {
+		if next < len(expected) && line == expected[next] {
+			next++
+		}
+	}
+	return next == len(expected)
+}
+
+// compileErrorReportPattern matches the lines the compiler reports an error with.
+var compileErrorReportPattern = regexp.MustCompile(`^\[line \d+\] Error`)
+
+// reportedErrorCount returns how many errors a run reported: one for each compile error
+// line, and the one error a runtime error stops the program with.
+func reportedErrorCount(stderr []string, exitCode int) int {
+	count := 0
+	for _, line := range stderr {
+		if compileErrorReportPattern.MatchString(line) {
+			count++
+		}
+	}
+	if exitCode == EXIT_RUNTIME_ERROR {
+		count++
+	}
+	return count
+}
+
+// reportsErrors reports whether the expected error messages appear in stderr in order,
+// either on a line of their own or after the ": " of a `[line N] Error at ...` prefix.
+func reportsErrors(stderr []string, expected []expectation) bool {
+	next := 0
+	for _, line := range stderr {
+		if next < len(expected) && (line == expected[next].value || strings.HasSuffix(line, ": "+expected[next].value)) {
+			next++
+		}
+	}
+	return next == len(expected)
+}
@@ -0,0 +1,113 @@
+package loxgen
+
+import (
+	"archive/tar"
+	"bytes"
+	"compress/gzip"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+// DEFAULT_SYNC_URL is where the sync subcommand downloads the craftinginterpreters repository from.
+const DEFAULT_SYNC_URL = "https://github.com/munificent/craftinginterpreters/archive/%s.tar.gz"
+
+// DEFAULT_SYNC_TIMEOUT is how long downloading the repository may take, unless -sync-timeout says.
+const DEFAULT_SYNC_TIMEOUT = 5 * time.Minute
+
+// fetchUpstream downloads the craftinginterpreters repository at -ref from -sync-url and
+// calls visit with the path, under the test directory, and the content of each of its
+// .lox test files. It stops at the first error of visit.
+func (g *Generator) fetchUpstream(visit func(name string, data []byte) error) error {
+	url := g.SyncURL
+	if strings.Contains(url, "%s") {
+		url = fmt.Sprintf(g.SyncURL, g.SyncRef)
+	}
+	log.Printf("Downloading %s.", url)
+	// The timeout covers reading the body too, so a stalled download fails instead of hanging.
+	client := &http.Client{Timeout: g.SyncTimeout}
+	response, err := client.Get(url)
+	if err != nil {
+		return err
+	}
+	defer response.Body.Close()
+	if response.StatusCode != http.StatusOK {
+		return fmt.Errorf("downloading %s: %s", url, response.Status)
+	}
+	gz, err := gzip.NewReader(response.Body)
+	if err != nil {
+		return err
+	}
+	defer gz.Close()
+
+	visited := 0
+	tr := tar.NewReader(gz)
+	for {
+		header, err := tr.Next()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return err
+		}
+		// Entries are under a single directory named after the repository and the ref,
+		// e.g. craftinginterpreters-master/test/bool/equality.lox.
+		_, name, _ := strings.Cut(header.Name, "/")
+		name, ok := strings.CutPrefix(name, "test/")
+		if !ok || header.Typeflag != tar.TypeReg || !strings.HasSuffix(name, ".lox") || !filepath.IsLocal(name) {
+			continue
+		}
+		data, err := io.ReadAll(tr)
+		if err != nil {
+			return err
+		}
+		if err := visit(name, data); err != nil {
+			return err
+		}
+		visited++
+	}
+	if visited == 0 {
+		return fmt.Errorf("%s has no test directory", url)
+	}
+	return nil
+}
+
+// SyncTests downloads the test directory of the craftinginterpreters repository at -ref into
+// -sync-directory. Upstream files replace the local copies, files only present locally are kept.
+func (g *Generator) SyncTests() error {
+	directory := g.SyncDirectory
+	if len(directory) == 0 {
+		directory = g.InputDirectory
+	}
+	if info, err := os.Stat(directory); err == nil && !info.IsDir() {
+		return fmt.Errorf("cannot sync into %s, it is not a directory", directory)
+	}
+
+	written, unchanged := 0, 0
+	err := g.fetchUpstream(func(name string, data []byte) error {
+		target := filepath.Join(directory, filepath.FromSlash(name))
+		if current, err := ioutil.ReadFile(target); err == nil && bytes.Equal(current, data) {
+			unchanged++
+			return nil
+		}
+		if err := os.MkdirAll(filepath.Dir(target), 0755); err != nil {
+			return err
+		}
+		if err := writeFileAtomically(target, data); err != nil {
+			return err
+		}
+		written++
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+	log.Printf("Synced craftinginterpreters at %s into %s: %d file(s) written, %d unchanged.", g.SyncRef, directory, written, unchanged)
+	return nil
+}